@@ -68,14 +68,17 @@ type rawCopyCmdArgs struct {
 
 	// new include/exclude only apply to file names
 	// implemented for remove (and sync) only
-	include               string
-	exclude               string
-	includePath           string // NOTE: This gets handled like list-of-files! It may LOOK like a bug, but it is not.
-	excludePath           string
-	includeFileAttributes string
-	excludeFileAttributes string
-	legacyInclude         string // used only for warnings
-	legacyExclude         string // used only for warnings
+	include                string
+	exclude                string
+	includePath            string // NOTE: This gets handled like list-of-files! It may LOOK like a bug, but it is not.
+	excludePath            string
+	includeFileAttributes  string
+	excludeFileAttributes  string
+	minAge                 string
+	includeContentEncoding string
+	excludeContentEncoding string
+	legacyInclude          string // used only for warnings
+	legacyExclude          string // used only for warnings
 
 	// filters from flags
 	listOfFilesToCopy string
@@ -125,6 +128,21 @@ type rawCopyCmdArgs struct {
 	// specify how user wants to handle invalid metadata.
 	s2sInvalidMetadataHandleOption string
 
+	// options for enumerating an S3 source. See cookS3SourceOptions
+	s3SkipUnsafeKeys     bool
+	s3MaxBytes           int64
+	s3CaseCollision      string
+	s3Partition          string
+	s3StartAfter         string
+	s3StopAtKey          string
+	s3SkipPendingRestore bool
+	s3BucketOrder        string
+	s3PreserveTags       bool
+	s3InvalidTagHandling string
+	s3V1Listing          bool
+	s3ReversePageOrder   bool
+	s3Manifest           string
+
 	// internal override to enforce strip-top-dir
 	internalOverrideStripTopDir bool
 }
@@ -605,9 +623,146 @@ func (raw rawCopyCmdArgs) cookWithId(jobId common.JobID) (cookedCopyCmdArgs, err
 	cooked.includeFileAttributes = raw.parsePatterns(raw.includeFileAttributes)
 	cooked.excludeFileAttributes = raw.parsePatterns(raw.excludeFileAttributes)
 
+	if raw.minAge != "" {
+		// Azure Files listings don't include last modified times, so every file would look old enough
+		switch fromTo.From() {
+		case common.ELocation.Local(), common.ELocation.Blob(), common.ELocation.BlobFS(), common.ELocation.S3():
+		default:
+			return cooked, fmt.Errorf("min-age is not supported when the source is %s", fromTo.From())
+		}
+		cooked.minAge, err = time.ParseDuration(raw.minAge)
+		if err != nil {
+			return cooked, fmt.Errorf("cannot parse min-age %q: %v", raw.minAge, err)
+		} else if cooked.minAge < 0 {
+			return cooked, fmt.Errorf("min-age cannot be negative")
+		}
+	}
+
+	if raw.includeContentEncoding != "" || raw.excludeContentEncoding != "" {
+		// Blob listings always include the content encoding, and the S3 traverser fetches it when asked (see cookS3SourceOptions)
+		switch fromTo.From() {
+		case common.ELocation.Blob(), common.ELocation.S3():
+		default:
+			return cooked, fmt.Errorf("include-content-encoding and exclude-content-encoding are not supported when the source is %s", fromTo.From())
+		}
+	}
+	cooked.includeContentEncodings = raw.parsePatterns(raw.includeContentEncoding)
+	cooked.excludeContentEncodings = raw.parsePatterns(raw.excludeContentEncoding)
+
+	cooked.s3SourceOptions, err = raw.cookS3SourceOptions(fromTo)
+	if err != nil {
+		return cooked, err
+	}
+	cooked.s3ManifestPath = raw.s3Manifest
+
 	return cooked, nil
 }
 
+// cookS3SourceOptions turns the S3-specific flags into options for the S3 traverser. They only make sense when the source is S3
+func (raw *rawCopyCmdArgs) cookS3SourceOptions(fromTo common.FromTo) (options s3TraverserOptions, err error) {
+	usedFlags := make([]string, 0)
+
+	if raw.s3SkipUnsafeKeys {
+		usedFlags = append(usedFlags, "s3-skip-unsafe-keys")
+		options.skipUnsafeKeys = true
+	}
+
+	if raw.s3MaxBytes < 0 {
+		return s3TraverserOptions{}, fmt.Errorf("s3-max-bytes cannot be negative")
+	} else if raw.s3MaxBytes > 0 {
+		usedFlags = append(usedFlags, "s3-max-bytes")
+		options.maxBytes = raw.s3MaxBytes
+	}
+
+	if raw.s3CaseCollision != "" {
+		usedFlags = append(usedFlags, "s3-case-collision")
+		if options.caseCollisionPolicy, err = parseCaseCollisionPolicy(raw.s3CaseCollision); err != nil {
+			return s3TraverserOptions{}, err
+		}
+	}
+
+	if raw.s3Partition != "" {
+		usedFlags = append(usedFlags, "s3-partition")
+		var partitionCount int
+		if options.partitionIndex, partitionCount, err = parseKeyPartition(raw.s3Partition); err != nil {
+			return s3TraverserOptions{}, err
+		}
+		options.partitionFunc = hashKeyPartition(partitionCount)
+	}
+
+	if raw.s3StartAfter != "" {
+		usedFlags = append(usedFlags, "s3-start-after")
+		options.startAfter = raw.s3StartAfter
+	}
+
+	if raw.s3StopAtKey != "" {
+		usedFlags = append(usedFlags, "s3-stop-at-key")
+		if raw.s3StartAfter != "" && raw.s3StopAtKey <= raw.s3StartAfter {
+			return s3TraverserOptions{}, fmt.Errorf("s3-stop-at-key must come after s3-start-after, or no objects would be copied")
+		}
+		options.stopAtKey = raw.s3StopAtKey
+	}
+
+	if raw.s3SkipPendingRestore {
+		usedFlags = append(usedFlags, "s3-skip-pending-restore")
+		// the traverser warns about each object that it skips, and the copy enumerator counts them
+		options.onPendingRestore = func(object storedObject) {}
+	}
+
+	if raw.s3BucketOrder != "" {
+		usedFlags = append(usedFlags, "s3-bucket-order")
+		priority := strings.Split(raw.s3BucketOrder, ",")
+		for i := range priority {
+			priority[i] = strings.TrimSpace(priority[i])
+			if priority[i] == "" {
+				return s3TraverserOptions{}, fmt.Errorf("s3-bucket-order cannot contain an empty bucket name")
+			}
+		}
+		options.bucketLess = bucketPriorityOrder(priority)
+	}
+
+	if raw.s3PreserveTags {
+		usedFlags = append(usedFlags, "s3-preserve-tags")
+		// the tags go in the metadata, so they'd be lost along with it
+		if !raw.s2sPreserveProperties {
+			return s3TraverserOptions{}, fmt.Errorf("s3-preserve-tags cannot be used when s2s-preserve-properties is false")
+		}
+		options.getTags = true
+	}
+	if raw.s3InvalidTagHandling != "" {
+		if !raw.s3PreserveTags {
+			return s3TraverserOptions{}, fmt.Errorf("s3-invalid-tag-handling can only be used with s3-preserve-tags")
+		}
+		if options.tagPolicy, err = parseS3TagPolicy(raw.s3InvalidTagHandling); err != nil {
+			return s3TraverserOptions{}, err
+		}
+	}
+
+	if raw.s3V1Listing {
+		usedFlags = append(usedFlags, "s3-v1-listing")
+		options.useV1Listing = true
+	}
+
+	if raw.s3ReversePageOrder {
+		usedFlags = append(usedFlags, "s3-reverse-page-order")
+		options.reversePageOrder = true
+	}
+
+	// S3 listings don't include the content encoding, so the content encoding filters need the traverser to fetch it.
+	// Those flags aren't S3 only, so they don't count as used here
+	options.getContentEncoding = raw.includeContentEncoding != "" || raw.excludeContentEncoding != ""
+
+	if raw.s3Manifest != "" {
+		// the file itself is made by the copy enumerator, which sets options.manifest
+		usedFlags = append(usedFlags, "s3-manifest")
+	}
+
+	if len(usedFlags) > 0 && fromTo.From() != common.ELocation.S3() {
+		return s3TraverserOptions{}, fmt.Errorf("%s can only be used when the source is S3", strings.Join(usedFlags, ", "))
+	}
+	return options, nil
+}
+
 var excludeWarningOncer = &sync.Once{}
 var includeWarningOncer = &sync.Once{}
 
@@ -659,11 +814,14 @@ type cookedCopyCmdArgs struct {
 	// new include/exclude only apply to file names
 	// implemented for remove (and sync) only
 	// includePathPatterns are handled like a list-of-files. Do not panic. This is not a bug that it is not present here.
-	includePatterns       []string
-	excludePatterns       []string
-	excludePathPatterns   []string
-	includeFileAttributes []string
-	excludeFileAttributes []string
+	includePatterns         []string
+	excludePatterns         []string
+	excludePathPatterns     []string
+	includeFileAttributes   []string
+	excludeFileAttributes   []string
+	minAge                  time.Duration
+	includeContentEncodings []string
+	excludeContentEncodings []string
 
 	// filters from flags
 	listOfFilesChannel chan string // Channels are nullable.
@@ -733,6 +891,12 @@ type cookedCopyCmdArgs struct {
 	// specify how user wants to handle invalid metadata.
 	s2sInvalidMetadataHandleOption common.InvalidMetadataHandleOption
 
+	// options for the S3 traverser, when the source is S3. Set from the S3-specific flags
+	s3SourceOptions s3TraverserOptions
+	// if not empty, the path of the CSV manifest that the S3 service traverser writes. The file is only created
+	// once enumeration starts, so it isn't in s3SourceOptions
+	s3ManifestPath string
+
 	// followup/cleanup properties are NOT available on resume, and so should not be used for jobs that may be resumed
 	// TODO: consider find a way to enforce that, or else to allow them to be preserved. Initially, they are just for benchmark jobs, so not a problem immediately because those jobs can't be resumed, by design.
 	followupJobArgs   *cookedCopyCmdArgs
@@ -1391,6 +1555,11 @@ func init() {
 	cpCmd.PersistentFlags().StringVar(&raw.md5ValidationOption, "check-md5", common.DefaultHashValidationOption.String(), "Specifies how strictly MD5 hashes should be validated when downloading. Only available when downloading. Available options: NoCheck, LogOnly, FailIfDifferent, FailIfDifferentOrMissing. (default 'FailIfDifferent')")
 	cpCmd.PersistentFlags().StringVar(&raw.includeFileAttributes, "include-attributes", "", "(Windows only) Include files whose attributes match the attribute list. For example: A;S;R")
 	cpCmd.PersistentFlags().StringVar(&raw.excludeFileAttributes, "exclude-attributes", "", "(Windows only) Exclude files whose attributes match the attribute list. For example: A;S;R")
+	cpCmd.PersistentFlags().StringVar(&raw.minAge, "min-age", "", "Exclude files and objects that were modified less than this long ago, e.g. because they may still be being written. For example: 10m or 2h. Not available when the source is Azure Files.")
+	cpCmd.PersistentFlags().StringVar(&raw.includeContentEncoding, "include-content-encoding", "", "Include only the blobs and objects whose content encoding is in the list. For example: gzip;br. "+
+		"For S3 sources, this requires one additional request per object, unless properties are fetched while enumerating anyway. Only available when the source is Blob or S3.")
+	cpCmd.PersistentFlags().StringVar(&raw.excludeContentEncoding, "exclude-content-encoding", "", "Exclude the blobs and objects whose content encoding is in the list. For example: gzip;br. "+
+		"For S3 sources, this requires one additional request per object, unless properties are fetched while enumerating anyway. Only available when the source is Blob or S3.")
 	cpCmd.PersistentFlags().BoolVar(&raw.CheckLength, "check-length", true, "Check the length of a file on the destination after the transfer. If there is a mismatch between source and destination, the transfer is marked as failed.")
 	cpCmd.PersistentFlags().BoolVar(&raw.s2sPreserveProperties, "s2s-preserve-properties", true, "Preserve full properties during service to service copy. "+
 		"For AWS S3 and Azure File non-single file source, the list operation doesn't return full properties of objects and files. To preserve full properties, AzCopy needs to send one additional request per object or file.")
@@ -1400,6 +1569,32 @@ func init() {
 	cpCmd.PersistentFlags().BoolVar(&raw.s2sSourceChangeValidation, "s2s-detect-source-changed", false, "Check if source has changed after enumerating. ")
 	cpCmd.PersistentFlags().StringVar(&raw.s2sInvalidMetadataHandleOption, "s2s-handle-invalid-metadata", common.DefaultInvalidMetadataHandleOption.String(), "Specifies how invalid metadata keys are handled. Available options: ExcludeIfInvalid, FailIfInvalid, RenameIfInvalid. (default 'ExcludeIfInvalid').")
 
+	// options for enumerating an S3 source
+	cpCmd.PersistentFlags().BoolVar(&raw.s3SkipUnsafeKeys, "s3-skip-unsafe-keys", false, "Skip, with a warning, S3 objects whose keys are not valid UTF-8 or contain control characters. Only available when the source is S3.")
+	cpCmd.PersistentFlags().Int64Var(&raw.s3MaxBytes, "s3-max-bytes", 0, "Stop enumerating the S3 source at the first object that would take the total size of the objects found so far over this many bytes, e.g. to copy a bounded sample. 0 (the default) means no limit. Only available when the source is S3.")
+	cpCmd.PersistentFlags().StringVar(&raw.s3CaseCollision, "s3-case-collision", "", "Specifies what to do with S3 objects whose keys differ only in case from one found earlier in the same bucket, "+
+		"since they would overwrite each other at a case-insensitive destination. Available options: None, Warn, Skip, Rename. (default 'None'). Only available when the source is S3.")
+	cpCmd.PersistentFlags().StringVar(&raw.s3Partition, "s3-partition", "", "Only copy the S3 objects in this partition of the source, given as index/count. "+
+		"Objects are assigned to partitions by a hash of their keys, so running the copy once for each index, e.g. 0/4, 1/4, 2/4 and 3/4, copies every object exactly once. Only available when the source is S3.")
+	cpCmd.PersistentFlags().StringVar(&raw.s3StartAfter, "s3-start-after", "", "Only copy the S3 objects whose keys come after this one, in S3's (lexicographic) order. "+
+		"When a copy stops early, e.g. at s3-max-bytes, it reports the last key that it listed, so that another copy can carry on from there. Only available when the source is a single S3 bucket.")
+	cpCmd.PersistentFlags().StringVar(&raw.s3StopAtKey, "s3-stop-at-key", "", "Only copy the S3 objects whose keys come before this one, in S3's (lexicographic) order, and stop listing there. "+
+		"E.g. where keys begin with a date, like logs/2019-06-01/, logs/2019-06-01 copies the days before that. Together with s3-start-after, it copies a range of keys. Only available when the source is S3.")
+	cpCmd.PersistentFlags().BoolVar(&raw.s3SkipPendingRestore, "s3-skip-pending-restore", false, "Skip, with a warning, S3 objects that are still being restored from archive storage (e.g. Glacier), and so can't be read yet. "+
+		"Requires one additional request per object, unless properties are fetched while enumerating anyway. Only available when the source is S3.")
+	cpCmd.PersistentFlags().StringVar(&raw.s3BucketOrder, "s3-bucket-order", "", "Copy these S3 buckets (comma separated) first, in the order given, and then the rest in alphabetical order, "+
+		"so that a copy that stops early always covers the same buckets first. Only available when the source is an S3 service URL.")
+	cpCmd.PersistentFlags().BoolVar(&raw.s3PreserveTags, "s3-preserve-tags", false, "Copy the tags of S3 objects into the metadata of the destination blobs. "+
+		"Requires one additional request per object, and properties are fetched while enumerating, rather than in the backend. Only available when the source is S3.")
+	cpCmd.PersistentFlags().StringVar(&raw.s3InvalidTagHandling, "s3-invalid-tag-handling", "", "Specifies how S3 tags that can't be stored in Azure metadata are handled, "+
+		"e.g. because of their characters or the metadata size limit. Available options: Skip, Truncate, Error. (default 'Skip'). Only available with s3-preserve-tags.")
+	cpCmd.PersistentFlags().BoolVar(&raw.s3V1Listing, "s3-v1-listing", false, "List the S3 source with the older, marker-based, ListObjects call instead of ListObjectsV2, "+
+		"for S3-compatible stores that mishandle V2 continuation tokens, and so miss objects or list them forever. Only available when the source is S3.")
+	cpCmd.PersistentFlags().BoolVar(&raw.s3ReversePageOrder, "s3-reverse-page-order", false, "Schedule the S3 objects of each list page (of up to 1000 keys) in descending key order, e.g. to copy the newest of date-prefixed keys first. "+
+		"S3 can only list in ascending order, so the pages themselves are still in ascending order. Only available when the source is S3.")
+	cpCmd.PersistentFlags().StringVar(&raw.s3Manifest, "s3-manifest", "", "Write a CSV manifest of the S3 objects that were scheduled for copying (bucket, key, size, ETag and last modified time) to this file, "+
+		"for auditing. Each line is written as its object is scheduled, so the manifest is still valid if the copy stops part way. Only available when the source is an S3 service URL.")
+
 	// s2sGetPropertiesInBackend is an optional flag for controlling whether S3 object's or Azure file's full properties are get during enumerating in frontend or
 	// right before transferring in ste(backend).
 	// The traditional behavior of all existing enumerator is to get full properties during enumerating(more specifically listing),
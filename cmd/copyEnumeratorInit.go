@@ -57,17 +57,60 @@ func (cca *cookedCopyCmdArgs) initEnumerator(jobPartOrder common.CopyJobPartOrde
 	getRemoteProperties := (cca.fromTo.From() == common.ELocation.File() && !cca.fromTo.To().IsRemote()) || // If download, we still need LMT and MD5 from files.
 		(cca.fromTo.From() == common.ELocation.File() && cca.fromTo.To().IsRemote() && cca.s2sSourceChangeValidation) || // If S2S from File to *, and sourceChangeValidation is enabled, we get properties anyway (according to the old code)
 		(cca.fromTo.From().IsRemote() && cca.fromTo.To().IsRemote() && cca.s2sPreserveProperties && !cca.s2sGetPropertiesInBackend) // If S2S and preserve properties AND get properties in backend is on, turn this off, as properties will be obtained in the backend.
+	// If S3 tags are preserved, they're added to the metadata, so that must be read here too
+	getRemoteProperties = getRemoteProperties || cca.s3SourceOptions.getTags
 	jobPartOrder.S2SGetPropertiesInBackend = cca.s2sPreserveProperties && !getRemoteProperties && cca.s2sGetPropertiesInBackend // Infer GetProperties if GetPropertiesInBackend is enabled.
 	jobPartOrder.S2SSourceChangeValidation = cca.s2sSourceChangeValidation
 	jobPartOrder.DestLengthValidation = cca.CheckLength
 	jobPartOrder.S2SInvalidMetadataHandleOption = cca.s2sInvalidMetadataHandleOption
 
-	traverser, err = initResourceTraverser(src, cca.fromTo.From(), &ctx, &srcCredInfo, &cca.followSymlinks, cca.listOfFilesChannel, cca.recursive, getRemoteProperties, func() {})
+	// the last key listed from an S3 source, so that a copy that stops early can be carried on with s3-start-after
+	lastListedS3Key := ""
+	s3Options := cca.s3SourceOptions
+	s3Options.onCursor = func(bucketName string, key string) {
+		lastListedS3Key = key
+	}
+	// objects that are too big for a block blob would only fail once their upload was under way, so leave them out up front
+	if cca.fromTo == common.EFromTo.S3Blob() && (cca.blobType == common.EBlobType.Detect() || cca.blobType == common.EBlobType.BlockBlob()) {
+		s3Options.destinationSizeLimit = maxBlockBlobSize
+	}
+	// how long S3 took to answer each list request, for diagnosing slow enumeration
+	s3Options.listLatencies = &listLatencyRecorder{}
+	pendingRestoreCount := 0
+	if s3Options.onPendingRestore != nil {
+		s3Options.onPendingRestore = func(object storedObject) {
+			pendingRestoreCount++
+		}
+	}
+
+	traverser, err = initResourceTraverserWithOptions(src, cca.fromTo.From(), &ctx, &srcCredInfo, &cca.followSymlinks, cca.listOfFilesChannel, cca.recursive, getRemoteProperties, func() {}, s3Options)
 
 	if err != nil {
 		return nil, err
 	}
 
+	// the service traverser lists many buckets, so a key means nothing to it
+	_, isS3BucketSource := traverser.(*s3Traverser)
+	if s3Options.startAfter != "" && !isS3BucketSource {
+		return nil, errors.New("s3-start-after can only be used when the source is a single S3 bucket")
+	}
+	s3ServiceSource, isS3ServiceSource := traverser.(*s3ServiceTraverser)
+	if s3Options.bucketLess != nil && !isS3ServiceSource {
+		return nil, errors.New("s3-bucket-order can only be used when the source is an S3 service URL")
+	}
+	// the manifest is made here, rather than passed in with the other options, so that we only create a file
+	// once we know the source can fill it
+	var s3Manifest *os.File
+	if cca.s3ManifestPath != "" {
+		if !isS3ServiceSource {
+			return nil, errors.New("s3-manifest can only be used when the source is an S3 service URL")
+		}
+		if s3Manifest, err = os.Create(cca.s3ManifestPath); err != nil {
+			return nil, fmt.Errorf("cannot create the S3 manifest: %v", err)
+		}
+		s3ServiceSource.manifest = s3Manifest
+	}
+
 	// Ensure we're only copying from a directory with a trailing wildcard or recursive.
 	isSourceDir := traverser.isDirectory(true)
 	if isSourceDir && !cca.recursive && !cca.stripTopDir {
@@ -196,6 +239,12 @@ func (cca *cookedCopyCmdArgs) initEnumerator(jobPartOrder common.CopyJobPartOrde
 	}
 
 	filters := cca.initModularFilters()
+	// filtered, rather than dropped by the processor, so that they don't go in the S3 manifest
+	var oversized *oversizedObjectFilter
+	if s3Options.destinationSizeLimit > 0 {
+		oversized = &oversizedObjectFilter{}
+		filters = append(filters, oversized)
+	}
 	processor := func(object storedObject) error {
 		// Start by resolving the name and creating the container
 		if object.containerName != "" {
@@ -239,6 +288,23 @@ func (cca *cookedCopyCmdArgs) initEnumerator(jobPartOrder common.CopyJobPartOrde
 		return addTransfer(&jobPartOrder, transfer, cca)
 	}
 	finalizer := func() error {
+		if pendingRestoreCount > 0 {
+			LogStdoutAndJobLog(fmt.Sprintf("%d S3 object(s) were skipped, because they are still being restored from archive storage. Copy them again once the restore has finished.", pendingRestoreCount))
+		}
+		if oversized != nil && oversized.count > 0 {
+			LogStdoutAndJobLog(fmt.Sprintf("%d S3 object(s) were skipped, because they are bigger than a block blob can be.", oversized.count))
+		}
+		if isS3BucketSource && (s3Options.maxBytes > 0 || s3Options.stopAtKey != "") && lastListedS3Key != "" {
+			LogStdoutAndJobLog(fmt.Sprintf("The last S3 key that was listed is %q. To copy the objects after it, run the copy again with --s3-start-after set to that key.", lastListedS3Key))
+		}
+		if s3Manifest != nil {
+			if err := s3Manifest.Close(); err != nil {
+				return fmt.Errorf("cannot close the S3 manifest: %v", err)
+			}
+		}
+		if latencies := s3Options.listLatencies.summary(); latencies.count > 0 && ste.JobsAdmin != nil {
+			ste.JobsAdmin.LogToJobLog(fmt.Sprintf("S3 enumeration made %v", latencies))
+		}
 		return dispatchFinalPart(&jobPartOrder, cca)
 	}
 
@@ -309,6 +375,11 @@ func (cca *cookedCopyCmdArgs) initModularFilters() []objectFilter {
 		filters = append(filters, buildAttrFilters(cca.excludeFileAttributes, cca.source, false)...)
 	}
 
+	filters = append(filters, buildMinAgeFilters(cca.minAge)...)
+
+	filters = append(filters, buildContentEncodingFilters(cca.includeContentEncodings, true)...)
+	filters = append(filters, buildContentEncodingFilters(cca.excludeContentEncodings, false)...)
+
 	return filters
 }
 
@@ -0,0 +1,102 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+// s3TaggingCore is the client that the S3 traversers use for real, i.e. minio.Core plus GetObjectTagging, which the version of
+// minio-go that we use can't do. It reads the tags with a GET of the object's ?tagging subresource, which minio-go signs for us,
+// by presigning the URL. That way the request is signed with the same credentials, for the same (looked up) bucket region,
+// and with the same addressing style, as all the client's other requests.
+type s3TaggingCore struct {
+	minio.Core
+
+	// used for the tagging requests. Requests are presigned, so it needs nothing special
+	httpClient *http.Client
+
+	// whether to add x-amz-request-payer. It goes in the query, and so is signed, since there's no Authorization header to re-sign
+	requesterPays bool
+}
+
+var _ s3TagClient = s3TaggingCore{}
+var _ s3GetObjectClient = s3TaggingCore{}
+
+// how long each presigned tagging URL is valid for. Just long enough to make the request, allowing for clock skew
+const s3TaggingURLExpiry = 15 * time.Minute
+
+// the body of a GetObjectTagging response
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []struct {
+		Key   string `xml:"Key"`
+		Value string `xml:"Value"`
+	} `xml:"TagSet>Tag"`
+}
+
+func (c s3TaggingCore) GetObjectTagging(bucketName, objectName string) (map[string]string, error) {
+	params := url.Values{}
+	params.Set("tagging", "")
+	if c.requesterPays {
+		params.Set("x-amz-request-payer", "requester")
+	}
+	taggingURL, err := c.PresignedGetObject(bucketName, objectName, s3TaggingURLExpiry, params)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Get(taggingURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		errorResponse := minio.ErrorResponse{}
+		if xml.Unmarshal(body, &errorResponse) != nil || errorResponse.Code == "" {
+			return nil, fmt.Errorf("reading the tags failed with status %s", resp.Status)
+		}
+		errorResponse.StatusCode = resp.StatusCode
+		return nil, errorResponse
+	}
+
+	tagging := s3Tagging{}
+	if err = xml.Unmarshal(body, &tagging); err != nil {
+		return nil, fmt.Errorf("cannot parse the tags: %v", err)
+	}
+	tags := make(map[string]string, len(tagging.TagSet))
+	for _, tag := range tagging.TagSet {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, nil
+}
@@ -0,0 +1,97 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/minio/minio-go"
+	chk "gopkg.in/check.v1"
+)
+
+type s3ObjectTaggingTestSuite struct{}
+
+var _ = chk.Suite(&s3ObjectTaggingTestSuite{})
+
+// newTestTaggingCore returns a tagging client for the given server. Setting the region saves minio from looking up the bucket's location
+func newTestTaggingCore(c *chk.C, server *httptest.Server, requesterPays bool) s3TaggingCore {
+	serverURL, err := url.Parse(server.URL)
+	c.Assert(err, chk.IsNil)
+	client, err := minio.NewWithRegion(serverURL.Host, "AKID", "SECRET", false, "us-east-1")
+	c.Assert(err, chk.IsNil)
+	return s3TaggingCore{Core: minio.Core{Client: client}, httpClient: server.Client(), requesterPays: requesterPays}
+}
+
+func (s *s3ObjectTaggingTestSuite) TestGetObjectTagging(c *chk.C) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Tagging xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><TagSet>
+<Tag><Key>project</Key><Value>apollo</Value></Tag><Tag><Key>empty</Key><Value></Value></Tag>
+</TagSet></Tagging>`))
+	}))
+	defer server.Close()
+
+	tags, err := newTestTaggingCore(c, server, false).GetObjectTagging("bucket", "dir/key")
+	c.Assert(err, chk.IsNil)
+	c.Assert(tags, chk.DeepEquals, map[string]string{"project": "apollo", "empty": ""})
+
+	// it's a signed GET of the tagging subresource
+	c.Assert(requests, chk.HasLen, 1)
+	c.Assert(requests[0].Method, chk.Equals, http.MethodGet)
+	c.Assert(requests[0].URL.Path, chk.Equals, "/bucket/dir/key")
+	query := requests[0].URL.Query()
+	_, hasTagging := query["tagging"]
+	c.Assert(hasTagging, chk.Equals, true)
+	c.Assert(query.Get("X-Amz-Credential"), chk.Matches, "AKID/.*/us-east-1/s3/aws4_request")
+	c.Assert(query.Get("X-Amz-Signature"), chk.Not(chk.Equals), "")
+	c.Assert(query.Get("x-amz-request-payer"), chk.Equals, "")
+
+	// requester pays goes into the signed query
+	_, err = newTestTaggingCore(c, server, true).GetObjectTagging("bucket", "dir/key")
+	c.Assert(err, chk.IsNil)
+	c.Assert(requests[1].URL.Query().Get("x-amz-request-payer"), chk.Equals, "requester")
+}
+
+func (s *s3ObjectTaggingTestSuite) TestGetObjectTaggingErrors(c *chk.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	core := newTestTaggingCore(c, server, false)
+
+	_, err := core.GetObjectTagging("bucket", "missing")
+	c.Assert(err, chk.NotNil)
+	c.Assert(minio.ToErrorResponse(err).Code, chk.Equals, "NoSuchKey")
+	c.Assert(minio.ToErrorResponse(err).StatusCode, chk.Equals, http.StatusNotFound)
+
+	// a failure with no S3 error in the body still fails
+	_, err = core.GetObjectTagging("bucket", "other")
+	c.Assert(err, chk.ErrorMatches, "reading the tags failed with status 500.*")
+}
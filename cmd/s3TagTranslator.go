@@ -0,0 +1,173 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// S3 allows up to 10 tags per object, with keys of up to 128 characters and values of up to 256, in any Unicode letters,
+// digits, spaces and +-=._:/@. Azure metadata is stricter: keys must be C# identifiers, values must be printable ASCII,
+// and all the metadata of one blob, keys and values together, must fit in 8 KB. Keys are case-insensitive.
+const azureMaxMetadataBytes = 8 * 1024
+
+// What to do with an S3 tag that can't be stored, as it is, in Azure metadata
+type s3TagPolicy uint8
+
+var eS3TagPolicy s3TagPolicy = 0
+
+func (s3TagPolicy) Skip() s3TagPolicy     { return 0 } // leave the tag out, with a warning
+func (s3TagPolicy) Truncate() s3TagPolicy { return 1 } // make it fit, replacing invalid characters with '_' and shortening the value if it's too long. Tags that still can't fit are left out
+func (s3TagPolicy) Error() s3TagPolicy    { return 2 } // fail the object
+
+// parseS3TagPolicy parses the name of a policy, ignoring case, e.g. "truncate"
+func parseS3TagPolicy(s string) (s3TagPolicy, error) {
+	switch strings.ToLower(s) {
+	case "skip":
+		return eS3TagPolicy.Skip(), nil
+	case "truncate":
+		return eS3TagPolicy.Truncate(), nil
+	case "error":
+		return eS3TagPolicy.Error(), nil
+	default:
+		return eS3TagPolicy.Skip(), fmt.Errorf("unknown tag policy %q, expected Skip, Truncate or Error", s)
+	}
+}
+
+// translateS3Tags turns the tags of an object into metadata that Azure will accept, applying the policy to any that it won't.
+// existing is the metadata that the object already has, since that uses up part of the size limit, and the tags must not
+// collide with it. Tags are translated in order of their keys, so that the same tags always give the same result.
+// dropped lists the (original) keys of the tags that were left out.
+func translateS3Tags(tags map[string]string, existing map[string]string, policy s3TagPolicy) (translated map[string]string, dropped []string, err error) {
+	translated = make(map[string]string)
+	dropped = make([]string, 0)
+
+	usedKeys := make(map[string]bool)
+	usedBytes := 0
+	for k, v := range existing {
+		usedKeys[strings.ToLower(k)] = true
+		usedBytes += len(k) + len(v)
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, originalKey := range keys {
+		key, value := originalKey, tags[originalKey]
+		problem := ""
+
+		if !isValidAzureMetadataKey(key) || !isValidAzureMetadataValue(value) {
+			problem = "contains characters that Azure metadata doesn't allow"
+			if policy == eS3TagPolicy.Truncate() {
+				key, value = sanitizeAzureMetadataKey(key), sanitizeAzureMetadataValue(value)
+				problem = ""
+			}
+		}
+
+		if problem == "" && usedKeys[strings.ToLower(key)] {
+			problem = fmt.Sprintf("would have the same metadata key as another tag or metadata item, %q", key)
+		}
+
+		if problem == "" && usedBytes+len(key)+len(value) > azureMaxMetadataBytes {
+			problem = "doesn't fit in the space left in the metadata"
+			if room := azureMaxMetadataBytes - usedBytes - len(key); policy == eS3TagPolicy.Truncate() && room >= 0 {
+				value = value[:room] // safe to slice bytewise, since the value is ASCII by now
+				problem = ""
+			}
+		}
+
+		if problem != "" {
+			if policy == eS3TagPolicy.Error() {
+				return nil, nil, fmt.Errorf("tag %q %s", originalKey, problem)
+			}
+			dropped = append(dropped, originalKey)
+			continue
+		}
+
+		translated[key] = value
+		usedKeys[strings.ToLower(key)] = true
+		usedBytes += len(key) + len(value)
+	}
+	return translated, dropped, nil
+}
+
+// isValidAzureMetadataKey says whether key is a C# identifier, as Azure requires of metadata keys
+func isValidAzureMetadataKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, r := range key {
+		if !isAzureMetadataKeyRune(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAzureMetadataKeyRune(r rune, isFirst bool) bool {
+	return r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (!isFirst && r >= '0' && r <= '9')
+}
+
+// sanitizeAzureMetadataKey replaces the characters that can't be in a metadata key with '_', and prefixes '_' if the key starts with a digit
+func sanitizeAzureMetadataKey(key string) string {
+	sb := strings.Builder{}
+	for _, r := range key {
+		if isAzureMetadataKeyRune(r, false) {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	result := sb.String()
+	if result == "" || !isAzureMetadataKeyRune(rune(result[0]), true) {
+		result = "_" + result
+	}
+	return result
+}
+
+// isValidAzureMetadataValue says whether value is printable ASCII, as HTTP headers, and so Azure metadata values, must be
+func isValidAzureMetadataValue(value string) bool {
+	for _, r := range value {
+		if !isAzureMetadataValueRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAzureMetadataValueRune(r rune) bool {
+	return r >= ' ' && r <= '~'
+}
+
+// sanitizeAzureMetadataValue replaces the characters that can't be in a metadata value with '_'
+func sanitizeAzureMetadataValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if isAzureMetadataValueRune(r) {
+			return r
+		}
+		return '_'
+	}, value)
+}
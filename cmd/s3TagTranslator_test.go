@@ -0,0 +1,84 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	chk "gopkg.in/check.v1"
+)
+
+type s3TagTranslatorTestSuite struct{}
+
+var _ = chk.Suite(&s3TagTranslatorTestSuite{})
+
+func (s *s3TagTranslatorTestSuite) TestValidTagsAreKept(c *chk.C) {
+	tags := map[string]string{"Project": "apollo", "_owner2": "team a+b=c", "empty": ""}
+	translated, dropped, err := translateS3Tags(tags, nil, eS3TagPolicy.Error())
+	c.Assert(err, chk.IsNil)
+	c.Assert(translated, chk.DeepEquals, tags)
+	c.Assert(dropped, chk.HasLen, 0)
+}
+
+func (s *s3TagTranslatorTestSuite) TestInvalidTags(c *chk.C) {
+	tags := map[string]string{"cost-centre": "42", "2fa": "on", "city": "Zürich", "ok": "yes"}
+
+	translated, dropped, err := translateS3Tags(tags, nil, eS3TagPolicy.Skip())
+	c.Assert(err, chk.IsNil)
+	c.Assert(translated, chk.DeepEquals, map[string]string{"ok": "yes"})
+	c.Assert(dropped, chk.DeepEquals, []string{"2fa", "city", "cost-centre"})
+
+	translated, dropped, err = translateS3Tags(tags, nil, eS3TagPolicy.Truncate())
+	c.Assert(err, chk.IsNil)
+	c.Assert(translated, chk.DeepEquals, map[string]string{"cost_centre": "42", "_2fa": "on", "city": "Z_rich", "ok": "yes"})
+	c.Assert(dropped, chk.HasLen, 0)
+
+	_, _, err = translateS3Tags(tags, nil, eS3TagPolicy.Error())
+	c.Assert(err, chk.ErrorMatches, `tag "2fa" contains characters that Azure metadata doesn't allow`)
+}
+
+func (s *s3TagTranslatorTestSuite) TestCollidingTags(c *chk.C) {
+	// keys are case-insensitive in Azure, and sanitizing can make two keys the same
+	tags := map[string]string{"Owner": "a", "cost centre": "1", "cost-centre": "2"}
+	translated, dropped, err := translateS3Tags(tags, map[string]string{"owner": "b"}, eS3TagPolicy.Truncate())
+	c.Assert(err, chk.IsNil)
+	c.Assert(translated, chk.DeepEquals, map[string]string{"cost_centre": "1"})
+	c.Assert(dropped, chk.DeepEquals, []string{"Owner", "cost-centre"})
+}
+
+func (s *s3TagTranslatorTestSuite) TestSizeLimit(c *chk.C) {
+	existing := map[string]string{"big": strings.Repeat("x", azureMaxMetadataBytes-100)}
+	tags := map[string]string{"a": strings.Repeat("y", 200), "b": "small"}
+
+	translated, dropped, err := translateS3Tags(tags, existing, eS3TagPolicy.Skip())
+	c.Assert(err, chk.IsNil)
+	c.Assert(translated, chk.DeepEquals, map[string]string{"b": "small"})
+	c.Assert(dropped, chk.DeepEquals, []string{"a"})
+
+	// truncating fills the space that's left, so nothing more fits after it
+	translated, dropped, err = translateS3Tags(tags, existing, eS3TagPolicy.Truncate())
+	c.Assert(err, chk.IsNil)
+	c.Assert(translated, chk.DeepEquals, map[string]string{"a": strings.Repeat("y", 100-len("big")-len("a"))})
+	c.Assert(dropped, chk.DeepEquals, []string{"b"})
+
+	_, _, err = translateS3Tags(tags, existing, eS3TagPolicy.Error())
+	c.Assert(err, chk.ErrorMatches, `tag "a" doesn't fit in the space left in the metadata`)
+}
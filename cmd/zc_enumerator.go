@@ -75,6 +75,12 @@ type storedObject struct {
 	blobAccessTier azblob.AccessTierType
 	// metadata, included in S2S transfers
 	Metadata common.Metadata
+
+	// true if the object is bigger than the destination can take. Only included by the S3 traverser when requested
+	exceedsDestinationSizeLimit bool
+
+	// the object's ETag, only included by the S3 traverser
+	etag string
 }
 
 const (
@@ -203,6 +209,11 @@ func recommendHttpsIfNecessary(url url.URL) {
 // followSymlinks is only required for local resources (defaults to false)
 // errorOnDirWOutRecursive is used by copy.
 func initResourceTraverser(resource string, location common.Location, ctx *context.Context, credential *common.CredentialInfo, followSymlinks *bool, listofFilesChannel chan string, recursive, getProperties bool, incrementEnumerationCounter func()) (resourceTraverser, error) {
+	return initResourceTraverserWithOptions(resource, location, ctx, credential, followSymlinks, listofFilesChannel, recursive, getProperties, incrementEnumerationCounter, s3TraverserOptions{})
+}
+
+// initResourceTraverserWithOptions is like initResourceTraverser, but passes s3Options to the S3 traversers. Other locations ignore them
+func initResourceTraverserWithOptions(resource string, location common.Location, ctx *context.Context, credential *common.CredentialInfo, followSymlinks *bool, listofFilesChannel chan string, recursive, getProperties bool, incrementEnumerationCounter func(), s3Options s3TraverserOptions) (resourceTraverser, error) {
 	var output resourceTraverser
 	var p *pipeline.Pipeline
 
@@ -382,13 +393,13 @@ func initResourceTraverser(resource string, location common.Location, ctx *conte
 				return nil, errors.New(accountTraversalInherentlyRecursiveError)
 			}
 
-			output, err = newS3ServiceTraverser(resourceURL, *ctx, getProperties, incrementEnumerationCounter)
+			output, err = newS3ServiceTraverserWithOptions(resourceURL, *ctx, getProperties, incrementEnumerationCounter, s3Options)
 
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			output, err = newS3Traverser(resourceURL, *ctx, recursive, getProperties, incrementEnumerationCounter)
+			output, err = newS3TraverserWithOptions(resourceURL, *ctx, recursive, getProperties, incrementEnumerationCounter, s3Options)
 
 			if err != nil {
 				return nil, err
@@ -23,6 +23,7 @@ package cmd
 import (
 	"path"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 
@@ -156,3 +157,88 @@ func buildIncludeFilters(patterns []string) []objectFilter {
 
 	return []objectFilter{&includeFilter{patterns: validPatterns}}
 }
+
+// design explanation:
+// objects that were modified very recently may still be being written or updated by their producers,
+// so the min age filter rejects them, and only lets through objects that have been left alone for at least minAge.
+// The clock can be replaced, for testing.
+type minAgeFilter struct {
+	minAge time.Duration
+	now    func() time.Time // nil means time.Now
+}
+
+func (f *minAgeFilter) doesSupportThisOS() (msg string, supported bool) {
+	msg = ""
+	supported = true
+	return
+}
+
+func (f *minAgeFilter) doesPass(storedObject storedObject) bool {
+	now := time.Now
+	if f.now != nil {
+		now = f.now
+	}
+
+	// an object modified exactly minAge ago is old enough
+	return !storedObject.lastModifiedTime.After(now().Add(-f.minAge))
+}
+
+func buildMinAgeFilters(minAge time.Duration) []objectFilter {
+	if minAge <= 0 {
+		return []objectFilter{}
+	}
+
+	return []objectFilter{&minAgeFilter{minAge: minAge}}
+}
+
+// design explanation:
+// objects stored with a content encoding (e.g. gzip) may need different handling at the destination, so callers can
+// copy them separately, or leave them out. If include is true, only objects with one of the encodings pass; otherwise,
+// only objects with none of them pass. Encodings are compared ignoring case, and objects without an encoding have "".
+// Traversers only fill in the content encoding when asked for it (e.g. the S3 traverser's getContentEncoding), so use it with that.
+type contentEncodingFilter struct {
+	encodings map[string]bool
+	include   bool
+}
+
+func (f *contentEncodingFilter) doesSupportThisOS() (msg string, supported bool) {
+	msg = ""
+	supported = true
+	return
+}
+
+func (f *contentEncodingFilter) doesPass(storedObject storedObject) bool {
+	return f.encodings[strings.ToLower(strings.TrimSpace(storedObject.contentEncoding))] == f.include
+}
+
+func buildContentEncodingFilters(encodings []string, include bool) []objectFilter {
+	if len(encodings) == 0 {
+		return []objectFilter{}
+	}
+
+	filter := &contentEncodingFilter{encodings: make(map[string]bool), include: include}
+	for _, encoding := range encodings {
+		filter.encodings[strings.ToLower(strings.TrimSpace(encoding))] = true
+	}
+	return []objectFilter{filter}
+}
+
+// oversizedObjectFilter leaves out the objects that the traverser flagged as too big for the destination (see the S3 traverser's
+// destinationSizeLimit), and counts them, so that the caller can say how many there were. The traverser warns about each one
+type oversizedObjectFilter struct {
+	count int
+}
+
+func (f *oversizedObjectFilter) doesSupportThisOS() (msg string, supported bool) {
+	msg = ""
+	supported = true
+	return
+}
+
+func (f *oversizedObjectFilter) doesPass(storedObject storedObject) bool {
+	if storedObject.exceedsDestinationSizeLimit {
+		f.count++
+		return false
+	}
+	return true
+}
@@ -21,8 +21,10 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -130,3 +132,183 @@ func (s *copyTransferProcessor) sendPartToSte() common.CopyJobPartOrderResponse
 
 	return resp
 }
+
+// objectBatcher accumulates storedObjects and hands them on in batches, rather than one at a time.
+// Its process method is an objectProcessor, so it can be given to any traverser.
+// A batch is handed on as soon as it reaches maxCount objects, or maxBytes total size (whichever comes first).
+// Either limit may be zero, to disable it. Call flush at the end of the traversal, to hand on the final, partial, batch.
+type objectBatcher struct {
+	maxCount     int
+	maxBytes     int64
+	processBatch func(batch []storedObject) error
+
+	batch      []storedObject
+	batchBytes int64
+}
+
+func newObjectBatcher(maxCount int, maxBytes int64, processBatch func(batch []storedObject) error) *objectBatcher {
+	return &objectBatcher{
+		maxCount:     maxCount,
+		maxBytes:     maxBytes,
+		processBatch: processBatch,
+	}
+}
+
+func (b *objectBatcher) process(storedObject storedObject) error {
+	b.batch = append(b.batch, storedObject)
+	b.batchBytes += storedObject.size
+
+	countReached := b.maxCount > 0 && len(b.batch) >= b.maxCount
+	bytesReached := b.maxBytes > 0 && b.batchBytes >= b.maxBytes
+	if countReached || bytesReached {
+		return b.flush()
+	}
+
+	return nil
+}
+
+// flush hands on whatever is in the current batch (if anything) and starts a new one
+func (b *objectBatcher) flush() error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+
+	// don't re-use the slice, since processBatch may keep it
+	batch := b.batch
+	b.batch = nil
+	b.batchBytes = 0
+
+	return b.processBatch(batch)
+}
+
+// objectBundle describes a group of small objects, all from the same container, that a later step can pack into one blob
+// (e.g. as a tar file), since copying a vast number of tiny objects one by one is very slow
+type objectBundle struct {
+	index         int // position of the bundle in the sequence made by the bundler, from 0
+	containerName string
+	relativePaths []string
+	totalBytes    int64
+}
+
+// smallObjectBundler groups the objects of up to maxObjectSize bytes into bundles of up to maxCount objects and maxBytes bytes
+// (either limit may be zero, to disable it), and hands each bundle to processBundle. Bigger objects go to processLarge, as usual.
+// Bundles never span containers. The grouping depends only on the order, sizes and containers of the objects, so a
+// traversal that lists the same objects in the same order (as S3 listings do) gives the same bundles, which makes bundling restartable.
+// Call flush at the end of the traversal, to hand on the final, partial, bundle.
+type smallObjectBundler struct {
+	maxObjectSize int64
+	maxCount      int
+	maxBytes      int64
+	processBundle func(bundle objectBundle) error
+	processLarge  objectProcessor
+
+	bundle    objectBundle
+	nextIndex int
+}
+
+func newSmallObjectBundler(maxObjectSize int64, maxCount int, maxBytes int64, processBundle func(bundle objectBundle) error, processLarge objectProcessor) *smallObjectBundler {
+	return &smallObjectBundler{
+		maxObjectSize: maxObjectSize,
+		maxCount:      maxCount,
+		maxBytes:      maxBytes,
+		processBundle: processBundle,
+		processLarge:  processLarge,
+	}
+}
+
+func (b *smallObjectBundler) process(storedObject storedObject) error {
+	if storedObject.size > b.maxObjectSize {
+		return b.processLarge(storedObject)
+	}
+
+	// start a new bundle if this object doesn't belong in, or wouldn't fit in, the current one
+	if len(b.bundle.relativePaths) > 0 {
+		otherContainer := storedObject.containerName != b.bundle.containerName
+		countReached := b.maxCount > 0 && len(b.bundle.relativePaths) >= b.maxCount
+		bytesExceeded := b.maxBytes > 0 && b.bundle.totalBytes+storedObject.size > b.maxBytes
+		if otherContainer || countReached || bytesExceeded {
+			if err := b.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	b.bundle.containerName = storedObject.containerName
+	b.bundle.relativePaths = append(b.bundle.relativePaths, storedObject.relativePath)
+	b.bundle.totalBytes += storedObject.size
+	return nil
+}
+
+// flush hands on the current bundle (if it has anything in it) and starts a new one
+func (b *smallObjectBundler) flush() error {
+	if len(b.bundle.relativePaths) == 0 {
+		return nil
+	}
+
+	bundle := b.bundle
+	bundle.index = b.nextIndex
+	b.nextIndex++
+	b.bundle = objectBundle{}
+
+	return b.processBundle(bundle)
+}
+
+// objectRateLimiter paces the objects handed on to a processor, to at most objectsPerSecond, with a token bucket.
+// Its process method is an objectProcessor, so it can be given to any traverser. When objects come faster than the rate,
+// process blocks, and so the traversal slows down to match what's downstream, rather than queueing up objects in RAM.
+// Up to burst objects may go through at once, after a lull. A rate of zero or less means no limit (there's no sense in a rate
+// that would never let anything through). Like the traversers, it's for use by one goroutine at a time.
+type objectRateLimiter struct {
+	ctx              context.Context
+	objectsPerSecond float64
+	burst            float64
+	processor        objectProcessor
+
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newObjectRateLimiter(ctx context.Context, objectsPerSecond float64, burst int, processor objectProcessor) *objectRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &objectRateLimiter{
+		ctx:              ctx,
+		objectsPerSecond: objectsPerSecond,
+		burst:            float64(burst),
+		processor:        processor,
+		tokens:           float64(burst), // so that we don't start slowly
+		lastRefill:       time.Now(),
+	}
+}
+
+// process waits for a token, or for the context to be cancelled, and then hands on the object
+func (l *objectRateLimiter) process(storedObject storedObject) error {
+	if l.objectsPerSecond <= 0 {
+		return l.processor(storedObject) // unlimited. (And the wait below would divide by zero, or be negative, so it would spin)
+	}
+
+	l.refill()
+	for l.tokens < 1 {
+		wait := time.Duration((1 - l.tokens) / l.objectsPerSecond * float64(time.Second))
+		select {
+		case <-l.ctx.Done():
+			return l.ctx.Err()
+		case <-time.After(wait):
+		}
+		l.refill()
+	}
+	l.tokens--
+
+	return l.processor(storedObject)
+}
+
+// refill adds the tokens that have accrued since the last refill, up to the burst size
+func (l *objectRateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.lastRefill).Seconds() * l.objectsPerSecond
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.lastRefill = now
+}
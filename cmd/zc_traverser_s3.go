@@ -22,10 +22,20 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/minio/minio-go"
 
@@ -39,10 +49,246 @@ type s3Traverser struct {
 	getProperties bool
 
 	s3URLParts s3URLPartsExtension
-	s3Client   *minio.Client
+	s3Client   s3TraverserClient
 
 	// A generic function to notify that a new stored object has been enumerated
 	incrementEnumerationCounter func()
+
+	s3TraverserOptions
+}
+
+// Optional behaviours of the S3 traversers. The zero value gives the default behaviour.
+// The service traverser passes its options on to the traverser of each bucket.
+type s3TraverserOptions struct {
+	// accept the charges for our requests, so that we can enumerate requester-pays buckets
+	requesterPays bool
+
+	// access S3 as this role (e.g. in a partner's account), instead of with the credentials from the environment
+	assumeRole common.S3AssumeRoleInfo
+
+	// fetch the content encoding (e.g. "gzip") of each object, so that it can be filtered on (see contentEncodingFilter),
+	// or used downstream to decide whether to decompress. Requires a StatObject call per object, if getProperties is not set
+	getContentEncoding bool
+
+	// if not nil, called once for each list request (ListObjectsV2 page, or ListBuckets) that is sent to S3
+	incrementListRequestCounter func()
+
+	// if not nil, the duration of each list request is recorded here, so that the caller can get a summary, such as percentiles, after the traversal.
+	// The service traverser shares it with the traversers of its buckets, so it covers the whole traversal
+	listLatencies *listLatencyRecorder
+
+	// skip, with a warning, objects whose keys are not valid UTF-8 or contain control characters, since such keys cause trouble downstream
+	skipUnsafeKeys bool
+
+	// if not nil, a CSV manifest of every object that was processed without error (its bucket, key, size, ETag and last modified time)
+	// is written here, as the traversal goes. Each record is flushed as soon as it's written, so if the process dies part way through,
+	// the manifest is still valid, just incomplete. If the manifest can't be written, the traversal fails, since it's for auditing.
+	// Only applies to the service traverser
+	manifest io.Writer
+
+	// if not nil, the matched buckets are traversed in this order, instead of the order that ListBuckets returns them in,
+	// so that partial runs always cover the same buckets first. E.g. alphabeticalBucketOrder, or one from bucketPriorityOrder.
+	// Only applies to the service traverser
+	bucketLess func(a, b string) bool
+
+	// if greater than zero, the traversal ends (without error) at the first object that would take the total size of the objects
+	// processed so far over this many bytes. For taking bounded samples. In the service traverser, the budget covers all the buckets
+	maxBytes int64
+
+	// what to do when two emitted objects have keys that differ only in case, and so would collide at a case-insensitive destination.
+	// Detection needs a map entry per emitted object, so it's off by default. It's per bucket, since each bucket has its own destination
+	caseCollisionPolicy caseCollisionPolicy
+
+	// if not nil, only objects for which partitionFunc(key) == partitionIndex are emitted. So N traversals, with partition indexes
+	// 0 to N-1, cover the bucket between them, without overlapping. The objects of other partitions are dropped straight after
+	// listing, before any StatObject calls are made for them
+	partitionFunc  func(key string) int
+	partitionIndex int
+
+	// if not empty, listing starts after this key, e.g. to resume from a cursor that was reported by onCursor in an earlier run.
+	// Only applies to the traverser of a single bucket, since the service traverser lists many buckets
+	startAfter string
+
+	// if not nil, called with each listed key, once we are done with that object (whether or not it was emitted). Keys are listed
+	// in lexicographic order, so the cursor only moves forward, and a later traversal with startAfter set to the last cursor
+	// picks up where this one left off
+	onCursor func(bucketName string, key string)
+
+	// if not empty, listing ends (without error) at the first key that is greater than or equal to this one, so the rest of the
+	// bucket isn't listed at all. S3 lists keys in lexicographic order, not by time, so this only helps where keys begin with
+	// a sortable date (e.g. "logs/2019-06-01/..."): use dateKeyBoundary to make the boundary from a date. Combined with
+	// startAfter, it bounds the listing to a range of dates, which S3 can't do by time itself
+	stopAtKey string
+
+	// if not nil, objects that are part way through being restored from Glacier (and so can't be read yet) are passed to this,
+	// with a warning, instead of to the processor. E.g. to list them for a later run. They must pass the filters, like any other object.
+	// Requires a StatObject call per object, if getProperties is not set, since listings don't include the restore status
+	onPendingRestore func(object storedObject)
+
+	// fetch the tags of each object, translate them to Azure metadata rules, applying tagPolicy to any that don't fit, and add
+	// them to the object's metadata. Requires an extra request per object, and a client that can read tags (see s3TagClient)
+	getTags   bool
+	tagPolicy s3TagPolicy
+
+	// if greater than zero, objects bigger than this many bytes (e.g. maxBlockBlobSize, when copying to block blobs) are flagged,
+	// with exceedsDestinationSizeLimit and a warning, so that downstream can skip them (as copy does) or route them elsewhere,
+	// rather than finding out when the upload fails. They are still emitted
+	destinationSizeLimit int64
+
+	// emit the objects of each list page in reverse (i.e. descending) order. S3 can only list in ascending order, and reversing
+	// the whole listing would mean holding all of it in RAM, so only the order within each page (of up to s3MaxKeysPerListPage keys)
+	// is reversed: the pages themselves still come in ascending order. E.g. to process the newest of date-prefixed keys first,
+	// at least within each page. With onCursor, the cursor only moves at the end of each page, so that it never goes backwards
+	reversePageOrder bool
+
+	// list with the older, marker-based, ListObjects call, instead of ListObjectsV2. Some S3-compatible stores (e.g. older Ceph gateways)
+	// mishandle V2 continuation tokens, so that listings miss objects or loop; markers are just keys, so they are more robust.
+	// Requires a client that can make the call (see s3V1ListClient)
+	useV1Listing bool
+
+	// if not nil, used instead of a client made from the URL. For testing
+	client s3TraverserClient
+}
+
+// The S3 calls that the traversers make. minio.Core implements it, and tests can supply a fake.
+type s3TraverserClient interface {
+	ListBuckets() ([]minio.BucketInfo, error)
+	ListObjectsV2(bucketName, objectPrefix, continuationToken string, fetchOwner bool, delimiter string, maxkeys int, startAfter string) (minio.ListBucketV2Result, error)
+	StatObject(bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+}
+
+// The marker-based listing call, which is separate from s3TraverserClient because it's only used by useV1Listing.
+// minio.Core implements it
+type s3V1ListClient interface {
+	ListObjects(bucket, prefix, marker, delimiter string, maxKeys int) (minio.ListBucketResult, error)
+}
+
+// The tagging call, which is separate from s3TraverserClient because minio.Core, in the version of minio-go that we use, can't make it.
+// So getTags only works with clients that implement this too. The real client does, through s3TaggingCore
+type s3TagClient interface {
+	GetObjectTagging(bucketName, objectName string) (map[string]string, error)
+}
+
+// The download call, which is separate from s3TraverserClient because only the inventory traverser uses it, to read the
+// inventory report. minio.Core implements it
+type s3GetObjectClient interface {
+	GetObject(bucketName, objectName string, opts minio.GetObjectOptions) (io.ReadCloser, minio.ObjectInfo, error)
+}
+
+// newS3TraverserClient returns the injected client, if there is one, else makes a real one with the given credential
+func newS3TraverserClient(ctx context.Context, options s3TraverserOptions, credInfo common.CredentialInfo) (s3TraverserClient, error) {
+	if options.client != nil {
+		return options.client, nil
+	}
+
+	client, err := common.CreateS3Client(
+		ctx,
+		credInfo,
+		common.CredentialOpOptions{
+			LogError: glcm.Error,
+		})
+	if err != nil {
+		return nil, err
+	}
+	return s3TaggingCore{
+		Core:          minio.Core{Client: client},
+		httpClient:    &http.Client{Transport: minio.DefaultTransport},
+		requesterPays: credInfo.S3CredentialInfo.RequesterPays,
+	}, nil
+}
+
+// the most keys that S3 will return in one page of a listing
+const s3MaxKeysPerListPage = 1000
+
+// the biggest block blob that can be uploaded: the maximum number of blocks, each of the maximum size
+const maxBlockBlobSize = int64(common.MaxBlockBlobBlockSize) * common.MaxNumberOfBlocksPerBlob
+
+// returned by the processor from byteBudgetProcessor, to stop the traversal (and the listing) once the byte budget is spent.
+// The traversers don't pass it on to their callers, since reaching the budget is a normal way to finish
+var errS3ByteBudgetReached = errors.New("byte budget for the traversal has been reached")
+
+// What an S3 traverser does with an object whose key differs only in case from one that was emitted earlier in the traversal
+type caseCollisionPolicy uint8
+
+var eCaseCollisionPolicy caseCollisionPolicy = 0
+
+func (caseCollisionPolicy) None() caseCollisionPolicy   { return 0 } // don't check
+func (caseCollisionPolicy) Warn() caseCollisionPolicy   { return 1 } // warn, but emit the object anyway
+func (caseCollisionPolicy) Skip() caseCollisionPolicy   { return 2 } // warn, and don't emit the object
+func (caseCollisionPolicy) Rename() caseCollisionPolicy { return 3 } // warn, and emit the object with a suffix that makes its name unique, ignoring case
+
+// parseCaseCollisionPolicy parses the name of a policy, ignoring case, e.g. "skip"
+func parseCaseCollisionPolicy(s string) (caseCollisionPolicy, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return eCaseCollisionPolicy.None(), nil
+	case "warn":
+		return eCaseCollisionPolicy.Warn(), nil
+	case "skip":
+		return eCaseCollisionPolicy.Skip(), nil
+	case "rename":
+		return eCaseCollisionPolicy.Rename(), nil
+	default:
+		return eCaseCollisionPolicy.None(), fmt.Errorf("unknown case collision policy %q, expected None, Warn, Skip or Rename", s)
+	}
+}
+
+// caseCollisionProcessor wraps processor so that it applies the policy to objects whose relative paths collide, ignoring case,
+// with those of objects that have already been processed
+func caseCollisionProcessor(processor objectProcessor, policy caseCollisionPolicy, bucketName string) objectProcessor {
+	seen := make(map[string]string) // lower-cased relative path -> relative path as emitted
+	return func(object storedObject) error {
+		folded := strings.ToLower(object.relativePath)
+		existing, collides := seen[folded]
+		if !collides {
+			seen[folded] = object.relativePath
+			return processor(object)
+		}
+
+		switch policy {
+		case eCaseCollisionPolicy.Skip():
+			LogStdoutAndJobLog(fmt.Sprintf("skipping object %q in bucket %s, because its key differs only in case from %q", object.relativePath, bucketName, existing))
+			return nil
+		case eCaseCollisionPolicy.Rename():
+			renamed := object.relativePath
+			for n := 2; collides; n++ {
+				renamed = caseCollisionSuffixed(object.relativePath, n)
+				_, collides = seen[strings.ToLower(renamed)]
+			}
+			LogStdoutAndJobLog(fmt.Sprintf("renaming object %q in bucket %s to %q, because its key differs only in case from %q", object.relativePath, bucketName, renamed, existing))
+			seen[strings.ToLower(renamed)] = renamed
+			object.relativePath = renamed
+			object.name = path.Base(renamed)
+		default:
+			LogStdoutAndJobLog(fmt.Sprintf("object %q in bucket %s differs only in case from %q, so they may overwrite each other at the destination", object.relativePath, bucketName, existing))
+		}
+		return processor(object)
+	}
+}
+
+// caseCollisionSuffixed inserts a numeric suffix before the extension, so that "dir/File.txt" becomes "dir/File (2).txt"
+func caseCollisionSuffixed(relativePath string, n int) string {
+	ext := path.Ext(relativePath)
+	if ext == path.Base(relativePath) {
+		ext = "" // e.g. ".profile" is a name, not an extension
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(relativePath, ext), n, ext)
+}
+
+// byteBudgetProcessor wraps processor so that it returns errS3ByteBudgetReached, instead of processing the object,
+// for the first object that would take the total size processed over maxBytes
+func byteBudgetProcessor(processor objectProcessor, maxBytes int64) objectProcessor {
+	var totalBytes int64
+	return func(object storedObject) error {
+		if totalBytes+object.size > maxBytes {
+			return errS3ByteBudgetReached
+		}
+		err := processor(object)
+		if err == nil {
+			totalBytes += object.size
+		}
+		return err
+	}
 }
 
 func (t *s3Traverser) isDirectory(isSource bool) bool {
@@ -64,6 +310,19 @@ func (t *s3Traverser) isDirectory(isSource bool) bool {
 }
 
 func (t *s3Traverser) traverse(preprocessor objectMorpher, processor objectProcessor, filters []objectFilter) (err error) {
+	if t.maxBytes > 0 {
+		processor = byteBudgetProcessor(processor, t.maxBytes)
+		defer func() {
+			if err == errS3ByteBudgetReached {
+				err = nil
+			}
+		}()
+	}
+
+	if t.caseCollisionPolicy != eCaseCollisionPolicy.None() {
+		processor = caseCollisionProcessor(processor, t.caseCollisionPolicy, t.s3URLParts.BucketName)
+	}
+
 	// Check if resource is a single object.
 	if t.s3URLParts.IsObjectSyntactically() && !t.s3URLParts.IsDirectorySyntactically() && !t.s3URLParts.IsBucketSyntactically() {
 		objectPath := strings.Split(t.s3URLParts.ObjectKey, "/")
@@ -75,6 +334,10 @@ func (t *s3Traverser) traverse(preprocessor objectMorpher, processor objectProce
 		// Otherwise, treat it as a directory.
 		// According to IsDirectorySyntactically, objects and folders can share names
 		if err == nil {
+			if !t.inPartition(t.s3URLParts.ObjectKey) {
+				return nil
+			}
+
 			storedObject := newStoredObject(
 				preprocessor,
 				objectName,
@@ -85,6 +348,8 @@ func (t *s3Traverser) traverse(preprocessor objectMorpher, processor objectProce
 				blobTypeNA,
 				t.s3URLParts.BucketName)
 
+			t.checkSizeLimit(&storedObject, t.s3URLParts.ObjectKey)
+
 			// We had to statObject anyway, get ALL the info.
 			oie := common.ObjectInfoExtension{ObjectInfo: oi}
 
@@ -96,6 +361,16 @@ func (t *s3Traverser) traverse(preprocessor objectMorpher, processor objectProce
 			storedObject.contentEncoding = oie.ContentEncoding()
 			storedObject.Metadata = oie.NewCommonMetadata()
 
+			storedObject.etag = oi.ETag
+			t.applyOptionalObjectInfo(&storedObject, oie)
+			if err = t.applyTags(&storedObject, t.s3URLParts.ObjectKey); err != nil {
+				return err
+			}
+
+			if t.onPendingRestore != nil && oie.RestoreInProgress() {
+				processor = t.pendingRestoreProcessor(t.s3URLParts.ObjectKey)
+			}
+
 			err = processIfPassedFilters(
 				filters,
 				storedObject,
@@ -119,47 +394,85 @@ func (t *s3Traverser) traverse(preprocessor objectMorpher, processor objectProce
 	searchPrefix := t.s3URLParts.ObjectKey
 
 	// It's a bucket or virtual directory.
-	for objectInfo := range t.s3Client.ListObjectsV2(t.s3URLParts.BucketName, searchPrefix, t.recursive, t.ctx.Done()) {
-		if objectInfo.Err != nil {
-			return fmt.Errorf("cannot list objects, %v", objectInfo.Err)
+	return t.listObjectPages(searchPrefix, func(page minio.ListBucketV2Result) error {
+		contents := page.Contents
+		if t.reversePageOrder {
+			contents = make([]minio.ObjectInfo, len(page.Contents))
+			for i, objectInfo := range page.Contents {
+				contents[len(contents)-1-i] = objectInfo
+			}
 		}
 
-		if objectInfo.StorageClass == "" {
-			// Directories are the only objects without storage classes.
-			continue
+		for _, objectInfo := range contents {
+			if err := t.processListedObject(preprocessor, processor, filters, objectInfo, searchPrefix); err != nil {
+				return err
+			}
+
+			if t.onCursor != nil && !t.reversePageOrder {
+				t.onCursor(t.s3URLParts.BucketName, objectInfo.Key)
+			}
 		}
 
-		objectPath := strings.Split(objectInfo.Key, "/")
-		objectName := objectPath[len(objectPath)-1]
+		// in reverse, the cursor can only move on once the whole page is done, since it must never go backwards
+		if t.onCursor != nil && t.reversePageOrder && len(page.Contents) > 0 {
+			t.onCursor(t.s3URLParts.BucketName, page.Contents[len(page.Contents)-1].Key)
+		}
+		return nil
+	})
+}
 
-		// re-join the unescaped path.
-		relativePath := strings.TrimPrefix(objectInfo.Key, searchPrefix)
+// processListedObject turns one object from a listing into a storedObject, and processes it if it passes the filters
+func (t *s3Traverser) processListedObject(preprocessor objectMorpher, processor objectProcessor, filters []objectFilter, objectInfo minio.ObjectInfo, searchPrefix string) (err error) {
+	if objectInfo.StorageClass == "" {
+		// Directories are the only objects without storage classes.
+		return nil
+	}
 
-		if strings.HasSuffix(relativePath, "/") {
-			// If a file has a suffix of /, it's still treated as a folder.
-			// Thus, akin to the old code. skip it.
-			continue
-		}
+	if t.skipUnsafeKeys && isUnsafeObjectKey(objectInfo.Key) {
+		LogStdoutAndJobLog(fmt.Sprintf("skipping object %q in bucket %s, because its key is not valid UTF-8 or contains control characters", objectInfo.Key, t.s3URLParts.BucketName))
+		return nil
+	}
 
-		storedObject := newStoredObject(
-			preprocessor,
-			objectName,
-			relativePath,
-			objectInfo.LastModified,
-			objectInfo.Size,
-			nil,
-			blobTypeNA,
-			t.s3URLParts.BucketName)
+	if !t.inPartition(objectInfo.Key) {
+		return nil
+	}
 
-		if t.getProperties {
-			oi, err := t.s3Client.StatObject(t.s3URLParts.BucketName, objectInfo.Key, minio.StatObjectOptions{})
+	objectPath := strings.Split(objectInfo.Key, "/")
+	objectName := objectPath[len(objectPath)-1]
 
-			if err != nil {
-				return err
-			}
+	// re-join the unescaped path.
+	relativePath := strings.TrimPrefix(objectInfo.Key, searchPrefix)
 
-			oie := common.ObjectInfoExtension{ObjectInfo: oi}
+	if strings.HasSuffix(relativePath, "/") {
+		// If a file has a suffix of /, it's still treated as a folder.
+		// Thus, akin to the old code. skip it.
+		return nil
+	}
+
+	storedObject := newStoredObject(
+		preprocessor,
+		objectName,
+		relativePath,
+		objectInfo.LastModified,
+		objectInfo.Size,
+		nil,
+		blobTypeNA,
+		t.s3URLParts.BucketName)
+	storedObject.etag = objectInfo.ETag
+
+	key := objectInfo.Key
+	t.checkSizeLimit(&storedObject, key)
+
+	if t.needsObjectInfo() {
+		oi, err := t.s3Client.StatObject(t.s3URLParts.BucketName, key, minio.StatObjectOptions{})
 
+		if err != nil {
+			return err
+		}
+
+		oie := common.ObjectInfoExtension{ObjectInfo: oi}
+
+		if t.getProperties {
 			storedObject.contentType = oi.ContentType
 			storedObject.md5 = oie.ContentMD5()
 			storedObject.cacheControl = oie.CacheControl()
@@ -169,19 +482,313 @@ func (t *s3Traverser) traverse(preprocessor objectMorpher, processor objectProce
 			storedObject.Metadata = oie.NewCommonMetadata()
 		}
 
-		err = processIfPassedFilters(filters,
-			storedObject,
-			processor)
+		t.applyOptionalObjectInfo(&storedObject, oie)
+
+		if t.onPendingRestore != nil && oie.RestoreInProgress() {
+			processor = t.pendingRestoreProcessor(key)
+		}
+	}
+
+	if err = t.applyTags(&storedObject, key); err != nil {
+		return err
+	}
+
+	return processIfPassedFilters(filters,
+		storedObject,
+		processor)
+}
+
+// listObjectPages lists the objects under prefix, one page at a time, passing each page to handlePage.
+// We do our own paging, rather than using minio's channel-based listing, so that we can see (and count) the individual requests.
+func (t *s3Traverser) listObjectPages(prefix string, handlePage func(page minio.ListBucketV2Result) error) error {
+	// Default listing is delimited at "/"
+	delimiter := "/"
+	if t.recursive {
+		delimiter = ""
+	}
+
+	continuationToken := "" // or, with useV1Listing, the marker
+	if t.useV1Listing {
+		continuationToken = t.startAfter
+	}
+	for {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
 
+		if t.incrementListRequestCounter != nil {
+			t.incrementListRequestCounter()
+		}
+		start := time.Now()
+		var page minio.ListBucketV2Result
+		var err error
+		if t.useV1Listing {
+			page, err = t.listObjectsV1Page(prefix, continuationToken, delimiter)
+		} else {
+			page, err = t.s3Client.ListObjectsV2(t.s3URLParts.BucketName, prefix, continuationToken, false, delimiter, s3MaxKeysPerListPage, t.startAfter)
+		}
+		t.listLatencies.record(time.Since(start))
 		if err != nil {
-			return
+			return fmt.Errorf("cannot list objects, %v", err)
+		}
+
+		reachedStop := t.trimPageAtStopKey(&page)
+		if err = handlePage(page); err != nil {
+			return err
+		}
+
+		if !page.IsTruncated || reachedStop {
+			return nil
 		}
+		if page.NextContinuationToken == "" {
+			return fmt.Errorf("cannot list objects, listing of bucket %s was truncated without a continuation token", t.s3URLParts.BucketName)
+		}
+		if t.useV1Listing && page.NextContinuationToken <= continuationToken {
+			// markers are keys, so they must move forward. If they don't, the store would have us list the same page forever
+			return fmt.Errorf("cannot list objects, listing of bucket %s went back to marker %q after marker %q", t.s3URLParts.BucketName, page.NextContinuationToken, continuationToken)
+		}
+		continuationToken = page.NextContinuationToken
 	}
-	return
+}
+
+// listObjectsV1Page lists one page with ListObjects, and returns it in the form of a ListObjectsV2 page, with the marker
+// for the next page as its continuation token
+func (t *s3Traverser) listObjectsV1Page(prefix, marker, delimiter string) (minio.ListBucketV2Result, error) {
+	v1Page, err := t.s3Client.(s3V1ListClient).ListObjects(t.s3URLParts.BucketName, prefix, marker, delimiter, s3MaxKeysPerListPage)
+	if err != nil {
+		return minio.ListBucketV2Result{}, err
+	}
+
+	page := minio.ListBucketV2Result{CommonPrefixes: v1Page.CommonPrefixes, Contents: v1Page.Contents, IsTruncated: v1Page.IsTruncated}
+	if page.IsTruncated {
+		// S3 only returns NextMarker when there's a delimiter. Otherwise, the next page starts after the last key of this one
+		page.NextContinuationToken = v1Page.NextMarker
+		if page.NextContinuationToken == "" && len(page.Contents) > 0 {
+			page.NextContinuationToken = page.Contents[len(page.Contents)-1].Key
+		}
+	}
+	return page, nil
+}
+
+// trimPageAtStopKey removes the keys (and common prefixes) from page that are at or past stopAtKey,
+// and reports whether there were any, in which case there's no point listing further pages
+func (t *s3Traverser) trimPageAtStopKey(page *minio.ListBucketV2Result) (reachedStop bool) {
+	if t.stopAtKey == "" {
+		return false
+	}
+
+	for i, object := range page.Contents {
+		if object.Key >= t.stopAtKey {
+			page.Contents = page.Contents[:i]
+			reachedStop = true
+			break
+		}
+	}
+	for i, commonPrefix := range page.CommonPrefixes {
+		if commonPrefix.Prefix >= t.stopAtKey {
+			page.CommonPrefixes = page.CommonPrefixes[:i]
+			reachedStop = true
+			break
+		}
+	}
+	return reachedStop
+}
+
+// dateKeyBoundary returns the key, under keyPrefix, at which the keys for date begin, given that keys are named with the date
+// formatted by layout (which must sort lexicographically in date order, like "2006-01-02" or "2006/01/02"). For use as stopAtKey,
+// to list only the keys of earlier dates, or as startAfter, to list only those of that date and later
+func dateKeyBoundary(keyPrefix string, date time.Time, layout string) string {
+	return keyPrefix + date.UTC().Format(layout)
+}
+
+// listLatencyRecorder keeps the durations of list requests, to summarise them. It's safe for concurrent use
+type listLatencyRecorder struct {
+	mu        sync.Mutex
+	durations []time.Duration
+
+	// if not nil, called with each duration as it's recorded, e.g. to stream them to a monitor
+	onRecord func(d time.Duration)
+}
+
+// A summary of the list request durations recorded by a listLatencyRecorder
+type listLatencySummary struct {
+	count              int
+	p50, p95, p99, max time.Duration
+}
+
+func (s listLatencySummary) String() string {
+	return fmt.Sprintf("%d list requests: p50 %v, p95 %v, p99 %v, max %v", s.count, s.p50, s.p95, s.p99, s.max)
+}
+
+// record adds a duration. It does nothing if r is nil, so callers needn't check whether latencies are wanted
+func (r *listLatencyRecorder) record(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.durations = append(r.durations, d)
+	r.mu.Unlock()
+
+	if r.onRecord != nil {
+		r.onRecord(d)
+	}
+}
+
+// summary returns the percentiles of the durations recorded so far, using the nearest-rank method
+func (r *listLatencyRecorder) summary() listLatencySummary {
+	r.mu.Lock()
+	sorted := append([]time.Duration(nil), r.durations...)
+	r.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return listLatencySummary{}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) time.Duration {
+		rank := (p*len(sorted) + 99) / 100 // i.e. ceil(p/100 * n)
+		return sorted[rank-1]
+	}
+	return listLatencySummary{
+		count: len(sorted),
+		p50:   percentile(50),
+		p95:   percentile(95),
+		p99:   percentile(99),
+		max:   sorted[len(sorted)-1],
+	}
+}
+
+// inPartition says whether the object with the given key belongs to this traversal's partition
+func (t *s3Traverser) inPartition(key string) bool {
+	return t.partitionFunc == nil || t.partitionFunc(key) == t.partitionIndex
+}
+
+// hashKeyPartition returns a partitionFunc that spreads keys over partitionCount partitions by their FNV-1a hash.
+// It depends only on the key, so separate runs (e.g. on different machines) agree on which partition each key is in
+func hashKeyPartition(partitionCount int) func(key string) int {
+	return func(key string) int {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return int(h.Sum32() % uint32(partitionCount))
+	}
+}
+
+// parseKeyPartition parses a partition given as "index/count", e.g. "0/4" for the first of four partitions
+func parseKeyPartition(s string) (index int, count int, err error) {
+	parts := strings.Split(s, "/")
+	if len(parts) == 2 {
+		index, err = strconv.Atoi(parts[0])
+		if err == nil {
+			count, err = strconv.Atoi(parts[1])
+		}
+		if err == nil && count > 0 && index >= 0 && index < count {
+			return index, count, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid partition %q, expected index/count, with index from 0 to count-1, e.g. 0/4", s)
+}
+
+// planRangedGets splits an enumerated object into consecutive ranges of chunkSize bytes (the last one may be shorter),
+// for downloading it with parallel ranged GETs. Note that minio's GetObjectOptions.SetRange, like the HTTP Range header,
+// takes an inclusive end, i.e. Offset+Length-1. An empty object has no ranges.
+func planRangedGets(object storedObject, chunkSize int64) ([]common.FileRange, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("cannot plan ranges for object %s, because the chunk size %d is not positive", object.relativePath, chunkSize)
+	}
+	if object.size < 0 {
+		return nil, fmt.Errorf("cannot plan ranges for object %s, because its size %d is negative", object.relativePath, object.size)
+	}
+
+	ranges := make([]common.FileRange, 0, (object.size+chunkSize-1)/chunkSize)
+	for offset := int64(0); offset < object.size; offset += chunkSize {
+		length := chunkSize
+		if remaining := object.size - offset; remaining < length {
+			length = remaining
+		}
+		ranges = append(ranges, common.FileRange{Offset: offset, Length: length})
+	}
+	return ranges, nil
+}
+
+// isUnsafeObjectKey says whether key is invalid UTF-8 or contains control characters.
+// S3 allows both, but they break path handling (and logging) at the destination.
+func isUnsafeObjectKey(key string) bool {
+	if !utf8.ValidString(key) {
+		return true
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSizeLimit flags the object, with a warning, if it's bigger than destinationSizeLimit
+func (t *s3Traverser) checkSizeLimit(object *storedObject, key string) {
+	if t.destinationSizeLimit <= 0 || object.size <= t.destinationSizeLimit {
+		return
+	}
+	object.exceedsDestinationSizeLimit = true
+	LogStdoutAndJobLog(fmt.Sprintf("object %q in bucket %s is %d bytes, which is more than the destination's limit of %d bytes", key, t.s3URLParts.BucketName, object.size, t.destinationSizeLimit))
+}
+
+// pendingRestoreProcessor returns a processor that hands objects on to onPendingRestore, instead of processing them as usual
+func (t *s3Traverser) pendingRestoreProcessor(key string) objectProcessor {
+	return func(object storedObject) error {
+		LogStdoutAndJobLog(fmt.Sprintf("skipping object %q in bucket %s, because it is still being restored from archive storage", key, t.s3URLParts.BucketName))
+		t.onPendingRestore(object)
+		return nil
+	}
+}
+
+// needsObjectInfo says whether we must call StatObject for each listed object, to get the details that have been asked for
+func (t *s3Traverser) needsObjectInfo() bool {
+	return t.getProperties || t.getContentEncoding || t.onPendingRestore != nil
+}
+
+// applyOptionalObjectInfo copies the details that the options ask for, from the result of StatObject, into the storedObject
+func (t *s3Traverser) applyOptionalObjectInfo(storedObject *storedObject, oie common.ObjectInfoExtension) {
+	if t.getContentEncoding {
+		storedObject.contentEncoding = oie.ContentEncoding()
+	}
+}
+
+// applyTags fetches the tags of the object with the given key, if they have been asked for, and adds them to the
+// storedObject's metadata, in the form that Azure metadata allows
+func (t *s3Traverser) applyTags(storedObject *storedObject, key string) error {
+	if !t.getTags {
+		return nil
+	}
+
+	tags, err := t.s3Client.(s3TagClient).GetObjectTagging(t.s3URLParts.BucketName, key)
+	if err != nil {
+		return fmt.Errorf("cannot get the tags of object %s: %v", key, err)
+	}
+
+	translated, dropped, err := translateS3Tags(tags, storedObject.Metadata, t.tagPolicy)
+	if err != nil {
+		return fmt.Errorf("cannot copy the tags of object %s: %v", key, err)
+	}
+	if len(dropped) > 0 {
+		LogStdoutAndJobLog(fmt.Sprintf("leaving out tags %s of object %q in bucket %s, because they can't be stored in Azure metadata",
+			strings.Join(dropped, ", "), key, t.s3URLParts.BucketName))
+	}
+
+	if len(translated) > 0 && storedObject.Metadata == nil {
+		storedObject.Metadata = make(common.Metadata, len(translated))
+	}
+	for k, v := range translated {
+		storedObject.Metadata[k] = v
+	}
+	return nil
 }
 
 func newS3Traverser(rawURL *url.URL, ctx context.Context, recursive, getProperties bool, incrementEnumerationCounter func()) (t *s3Traverser, err error) {
-	t = &s3Traverser{rawURL: rawURL, ctx: ctx, recursive: recursive, getProperties: getProperties, incrementEnumerationCounter: incrementEnumerationCounter}
+	return newS3TraverserWithOptions(rawURL, ctx, recursive, getProperties, incrementEnumerationCounter, s3TraverserOptions{})
+}
+
+func newS3TraverserWithOptions(rawURL *url.URL, ctx context.Context, recursive, getProperties bool, incrementEnumerationCounter func(), options s3TraverserOptions) (t *s3Traverser, err error) {
+	t = &s3Traverser{rawURL: rawURL, ctx: ctx, recursive: recursive, getProperties: getProperties, incrementEnumerationCounter: incrementEnumerationCounter, s3TraverserOptions: options}
 
 	// initialize S3 client and URL parts
 	var s3URLParts common.S3URLParts
@@ -195,19 +802,28 @@ func newS3Traverser(rawURL *url.URL, ctx context.Context, recursive, getProperti
 
 	showS3UrlTypeWarning(s3URLParts)
 
-	t.s3Client, err = common.CreateS3Client(
+	t.s3Client, err = newS3TraverserClient(
 		t.ctx,
+		t.s3TraverserOptions,
 		common.CredentialInfo{
 			CredentialType: common.ECredentialType.S3AccessKey(),
 			S3CredentialInfo: common.S3CredentialInfo{
-				Endpoint: t.s3URLParts.Endpoint,
-				Region:   t.s3URLParts.Region,
+				Endpoint:      t.s3URLParts.Endpoint,
+				Region:        t.s3URLParts.Region,
+				RequesterPays: t.requesterPays,
+				AssumeRole:    t.assumeRole,
 			},
-		},
-		common.CredentialOpOptions{
-			LogError: glcm.Error,
 		})
+	if err != nil {
+		return
+	}
 
+	if _, canGetTags := t.s3Client.(s3TagClient); t.getTags && !canGetTags {
+		return nil, errors.New("cannot get object tags, because the S3 client doesn't support reading them")
+	}
+	if _, canListV1 := t.s3Client.(s3V1ListClient); t.useV1Listing && !canListV1 {
+		return nil, errors.New("cannot use marker-based listing, because the S3 client doesn't support it")
+	}
 	return
 }
 
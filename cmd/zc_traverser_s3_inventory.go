@@ -0,0 +1,228 @@
+// Copyright © Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+
+	"github.com/Azure/azure-storage-azcopy/common"
+)
+
+// Enumerates the objects of an S3 bucket by reading an S3 Inventory report, instead of listing the bucket.
+// For buckets with hundreds of millions of objects, that's much faster than ListObjects.
+// The URL given is that of the report's manifest.json. Only the CSV report format is supported.
+type s3InventoryTraverser struct {
+	ctx         context.Context
+	manifestURL s3URLPartsExtension
+	s3Client    s3TraverserClient
+
+	// A generic function to notify that a new stored object has been enumerated
+	incrementEnumerationCounter func()
+}
+
+// The parts of an S3 Inventory manifest.json that we use
+type s3InventoryManifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	FileSchema   string `json:"fileSchema"`
+	Files        []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// One object, as described by a row in an inventory data file
+type s3InventoryRow struct {
+	key          string
+	size         int64
+	lastModified time.Time
+	etag         string
+}
+
+func (t *s3InventoryTraverser) isDirectory(isSource bool) bool {
+	return true // an inventory always describes a whole bucket
+}
+
+func (t *s3InventoryTraverser) traverse(preprocessor objectMorpher, processor objectProcessor, filters []objectFilter) error {
+	manifest, err := t.readManifest()
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(manifest.FileFormat, "CSV") {
+		return fmt.Errorf("S3 inventory format %q is not supported. Only CSV is supported", manifest.FileFormat)
+	}
+
+	// the data files are listed relative to the bucket that holds the manifest
+	for _, file := range manifest.Files {
+		err = t.traverseDataFile(file.Key, manifest, preprocessor, processor, filters)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *s3InventoryTraverser) readManifest() (*s3InventoryManifest, error) {
+	obj, _, err := t.s3Client.(s3GetObjectClient).GetObject(t.manifestURL.BucketName, t.manifestURL.ObjectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get S3 inventory manifest, %v", err)
+	}
+	defer obj.Close()
+
+	manifest := &s3InventoryManifest{}
+	if err = json.NewDecoder(obj).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("cannot parse S3 inventory manifest, %v", err)
+	}
+	return manifest, nil
+}
+
+func (t *s3InventoryTraverser) traverseDataFile(key string, manifest *s3InventoryManifest, preprocessor objectMorpher, processor objectProcessor, filters []objectFilter) error {
+	obj, _, err := t.s3Client.(s3GetObjectClient).GetObject(t.manifestURL.BucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot get S3 inventory data file %s, %v", key, err)
+	}
+	defer obj.Close()
+
+	// data files in CSV format are always gzipped
+	unzipped, err := gzip.NewReader(obj)
+	if err != nil {
+		return fmt.Errorf("cannot read S3 inventory data file %s, %v", key, err)
+	}
+
+	return readS3InventoryRows(unzipped, manifest.FileSchema, func(row s3InventoryRow) error {
+		// GetObject doesn't take a context, so check for cancellation as we go through the rows instead
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		if t.incrementEnumerationCounter != nil {
+			t.incrementEnumerationCounter()
+		}
+
+		objectPath := strings.Split(row.key, "/")
+		storedObject := newStoredObject(
+			preprocessor,
+			objectPath[len(objectPath)-1],
+			row.key,
+			row.lastModified,
+			row.size,
+			nil,
+			blobTypeNA,
+			manifest.SourceBucket)
+		storedObject.etag = row.etag
+
+		return processIfPassedFilters(filters, storedObject, processor)
+	})
+}
+
+// readS3InventoryRows parses CSV inventory data, in which the columns are as named in schema (e.g. "Bucket, Key, Size"),
+// and passes each object to handle. Object keys in the data are URL-encoded.
+func readS3InventoryRows(data io.Reader, schema string, handle func(row s3InventoryRow) error) error {
+	columns := make(map[string]int)
+	for i, name := range strings.Split(schema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	keyColumn, ok := columns["Key"]
+	if !ok {
+		return fmt.Errorf("S3 inventory schema %q has no Key column", schema)
+	}
+
+	reader := csv.NewReader(data)
+	reader.FieldsPerRecord = len(columns)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot parse S3 inventory data, %v", err)
+		}
+
+		row := s3InventoryRow{}
+		if row.key, err = url.QueryUnescape(record[keyColumn]); err != nil {
+			return fmt.Errorf("invalid key %q in S3 inventory data, %v", record[keyColumn], err)
+		}
+		if i, ok := columns["Size"]; ok && record[i] != "" {
+			if row.size, err = strconv.ParseInt(record[i], 10, 64); err != nil {
+				return fmt.Errorf("invalid size for %q in S3 inventory data, %v", row.key, err)
+			}
+		}
+		if i, ok := columns["LastModifiedDate"]; ok && record[i] != "" {
+			if row.lastModified, err = time.Parse(time.RFC3339, record[i]); err != nil {
+				return fmt.Errorf("invalid last modified date for %q in S3 inventory data, %v", row.key, err)
+			}
+		}
+		if i, ok := columns["ETag"]; ok {
+			row.etag = record[i]
+		}
+
+		if err = handle(row); err != nil {
+			return err
+		}
+	}
+}
+
+func newS3InventoryTraverser(manifestURL *url.URL, ctx context.Context, incrementEnumerationCounter func()) (t *s3InventoryTraverser, err error) {
+	return newS3InventoryTraverserWithOptions(manifestURL, ctx, incrementEnumerationCounter, s3TraverserOptions{})
+}
+
+// newS3InventoryTraverserWithOptions is like newS3InventoryTraverser, but takes s3TraverserOptions. Of those, only client is used
+func newS3InventoryTraverserWithOptions(manifestURL *url.URL, ctx context.Context, incrementEnumerationCounter func(), options s3TraverserOptions) (t *s3InventoryTraverser, err error) {
+	t = &s3InventoryTraverser{ctx: ctx, incrementEnumerationCounter: incrementEnumerationCounter}
+
+	s3URLParts, err := common.NewS3URLParts(*manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	t.manifestURL = s3URLPartsExtension{s3URLParts}
+
+	showS3UrlTypeWarning(s3URLParts)
+
+	t.s3Client, err = newS3TraverserClient(
+		t.ctx,
+		options,
+		common.CredentialInfo{
+			CredentialType: common.ECredentialType.S3AccessKey(),
+			S3CredentialInfo: common.S3CredentialInfo{
+				Endpoint: t.manifestURL.Endpoint,
+				Region:   t.manifestURL.Region,
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, canGetObjects := t.s3Client.(s3GetObjectClient); !canGetObjects {
+		return nil, errors.New("cannot read the S3 inventory, because the S3 client doesn't support getting objects")
+	}
+	return
+}
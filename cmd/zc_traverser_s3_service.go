@@ -22,11 +22,15 @@ package cmd
 
 import (
 	"context"
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
-
-	"github.com/minio/minio-go"
+	"time"
 
 	"github.com/Azure/azure-storage-azcopy/common"
 )
@@ -42,10 +46,13 @@ type s3ServiceTraverser struct {
 	getProperties bool
 
 	s3URL    s3URLPartsExtension
-	s3Client *minio.Client
+	s3Client s3TraverserClient
 
 	// a generic function to notify that a new stored object has been enumerated
 	incrementEnumerationCounter func()
+
+	// passed on to the traverser of each bucket
+	s3TraverserOptions
 }
 
 func (t *s3ServiceTraverser) isDirectory(isSource bool) bool {
@@ -56,11 +63,17 @@ func (t *s3ServiceTraverser) listContainers() ([]string, error) {
 	if len(t.cachedBuckets) == 0 {
 		bucketList := make([]string, 0)
 
-		if bucketInfo, err := t.s3Client.ListBuckets(); err == nil {
+		if t.incrementListRequestCounter != nil {
+			t.incrementListRequestCounter()
+		}
+		start := time.Now()
+		bucketInfo, err := t.s3Client.ListBuckets()
+		t.listLatencies.record(time.Since(start))
+		if err == nil {
 			for _, v := range bucketInfo {
 				// Match a pattern for the bucket name and the bucket name only
 				if t.bucketPattern != "" {
-					if ok, err := containerNameMatchesPattern(v.Name, t.bucketPattern); err != nil {
+					if ok, err := bucketNameMatchesPattern(v.Name, t.bucketPattern); err != nil {
 						// Break if the pattern is invalid
 						return nil, err
 					} else if !ok {
@@ -75,6 +88,10 @@ func (t *s3ServiceTraverser) listContainers() ([]string, error) {
 			return nil, err
 		}
 
+		if t.bucketLess != nil {
+			sort.SliceStable(bucketList, func(i, j int) bool { return t.bucketLess(bucketList[i], bucketList[j]) })
+		}
+
 		t.cachedBuckets = bucketList
 		return bucketList, nil
 	} else {
@@ -82,6 +99,95 @@ func (t *s3ServiceTraverser) listContainers() ([]string, error) {
 	}
 }
 
+// MatchingBuckets returns the names of the buckets that match the bucket pattern, without enumerating any objects.
+// The result is a copy, so the caller is free to modify it.
+func (t *s3ServiceTraverser) MatchingBuckets() ([]string, error) {
+	bucketList, err := t.listContainers()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), bucketList...), nil
+}
+
+// alphabeticalBucketOrder is a bucketLess that traverses buckets in alphabetical order
+func alphabeticalBucketOrder(a, b string) bool {
+	return a < b
+}
+
+// bucketPriorityOrder returns a bucketLess that traverses the named buckets first, in the order given,
+// and then the rest alphabetically
+func bucketPriorityOrder(priority []string) func(a, b string) bool {
+	rank := make(map[string]int, len(priority))
+	for i, name := range priority {
+		if _, ok := rank[name]; !ok {
+			rank[name] = i
+		}
+	}
+	return func(a, b string) bool {
+		rankA, aHasPriority := rank[a]
+		rankB, bHasPriority := rank[b]
+		switch {
+		case aHasPriority && bHasPriority:
+			return rankA < rankB
+		case aHasPriority != bHasPriority:
+			return aHasPriority
+		default:
+			return a < b
+		}
+	}
+}
+
+// the columns of the manifest written by manifestProcessor
+var s3ManifestHeader = []string{"bucket", "key", "size", "etag", "lastModified"}
+
+// wrapped by the errors that manifestProcessor returns when it can't write to the manifest. Like any other error from the processor,
+// they stop the traversal, since a manifest with records missing from the middle is worse than none
+var errS3ManifestWriteFailed = errors.New("cannot write the manifest")
+
+// manifestProcessor wraps processor so that each object that it processes without error is recorded in a CSV manifest,
+// written to w, one flushed line at a time. It writes the header straight away.
+// The key is the object's relative path, i.e. its key less the prefix (if any) that the traversal started from
+func manifestProcessor(processor objectProcessor, w io.Writer) (objectProcessor, error) {
+	manifest := csv.NewWriter(w)
+	writeRecord := func(record []string) error {
+		if err := manifest.Write(record); err != nil {
+			return err
+		}
+		manifest.Flush()
+		return manifest.Error()
+	}
+
+	if err := writeRecord(s3ManifestHeader); err != nil {
+		return nil, fmt.Errorf("%w: %v", errS3ManifestWriteFailed, err)
+	}
+	return func(object storedObject) error {
+		if err := processor(object); err != nil {
+			return err
+		}
+
+		err := writeRecord([]string{
+			object.containerName,
+			object.relativePath,
+			strconv.FormatInt(object.size, 10),
+			object.etag,
+			object.lastModifiedTime.UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %s/%s: %v", errS3ManifestWriteFailed, object.containerName, object.relativePath, err)
+		}
+		return nil
+	}, nil
+}
+
+// bucketNameMatchesPattern matches like containerNameMatchesPattern, except that a pattern with no wildcards
+// is compared exactly. So a plain bucket name can only ever match that one bucket, whatever the glob rules may be.
+func bucketNameMatchesPattern(bucketName, pattern string) (bool, error) {
+	if !strings.ContainsAny(pattern, `*?[\`) {
+		return bucketName == pattern, nil
+	}
+	return containerNameMatchesPattern(bucketName, pattern)
+}
+
 func (t *s3ServiceTraverser) traverse(preprocessor objectMorpher, processor objectProcessor, filters []objectFilter) error {
 	bucketList, err := t.listContainers()
 
@@ -89,11 +195,33 @@ func (t *s3ServiceTraverser) traverse(preprocessor objectMorpher, processor obje
 		return err
 	}
 
+	// the byte budget is for the whole traversal, so we enforce it here, rather than giving each bucket its own
+	bucketOptions := t.s3TraverserOptions
+	bucketOptions.startAfter = "" // a key in one bucket means nothing in the others
+	if t.maxBytes > 0 {
+		processor = byteBudgetProcessor(processor, t.maxBytes)
+		bucketOptions.maxBytes = 0
+	}
+	if t.manifest != nil {
+		processor, err = manifestProcessor(processor, t.manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Never traverse the same bucket twice in one call, even if the bucket list (e.g. from overlapping patterns) names it more than once
+	traversedBuckets := make(map[string]bool)
+
 	for _, v := range bucketList {
+		if traversedBuckets[v] {
+			continue
+		}
+		traversedBuckets[v] = true
+
 		tmpS3URL := t.s3URL
 		tmpS3URL.BucketName = v
 		urlResult := tmpS3URL.URL()
-		bucketTraverser, err := newS3Traverser(&urlResult, t.ctx, true, t.getProperties, t.incrementEnumerationCounter)
+		bucketTraverser, err := newS3TraverserWithOptions(&urlResult, t.ctx, true, t.getProperties, t.incrementEnumerationCounter, bucketOptions)
 
 		if err != nil {
 			return err
@@ -101,7 +229,26 @@ func (t *s3ServiceTraverser) traverse(preprocessor objectMorpher, processor obje
 
 		preprocessorForThisChild := preprocessor.FollowedBy(newContainerDecorator(v))
 
-		err = bucketTraverser.traverse(preprocessorForThisChild, processor, filters)
+		var processorErr error // the error, if any, from the processor, that stopped the traversal of this bucket
+		bucketProcessor := func(object storedObject) error {
+			err := processor(object)
+			if err == nil || err == errS3ByteBudgetReached {
+				return err
+			}
+			processorErr = err
+			return err
+		}
+
+		err = bucketTraverser.traverse(preprocessorForThisChild, bucketProcessor, filters)
+
+		if err == errS3ByteBudgetReached {
+			break
+		}
+
+		// Errors from the processor stop the whole traversal. Only errors in listing the bucket itself are logged and skipped, below
+		if processorErr != nil {
+			return processorErr
+		}
 
 		if err != nil {
 			if strings.Contains(err.Error(), "301 response missing Location header") {
@@ -123,7 +270,11 @@ func (t *s3ServiceTraverser) traverse(preprocessor objectMorpher, processor obje
 }
 
 func newS3ServiceTraverser(rawURL *url.URL, ctx context.Context, getProperties bool, incrementEnumerationCounter func()) (t *s3ServiceTraverser, err error) {
-	t = &s3ServiceTraverser{ctx: ctx, incrementEnumerationCounter: incrementEnumerationCounter, getProperties: getProperties}
+	return newS3ServiceTraverserWithOptions(rawURL, ctx, getProperties, incrementEnumerationCounter, s3TraverserOptions{})
+}
+
+func newS3ServiceTraverserWithOptions(rawURL *url.URL, ctx context.Context, getProperties bool, incrementEnumerationCounter func(), options s3TraverserOptions) (t *s3ServiceTraverser, err error) {
+	t = &s3ServiceTraverser{ctx: ctx, incrementEnumerationCounter: incrementEnumerationCounter, getProperties: getProperties, s3TraverserOptions: options}
 
 	var s3URLParts common.S3URLParts
 	s3URLParts, err = common.NewS3URLParts(*rawURL)
@@ -141,16 +292,15 @@ func newS3ServiceTraverser(rawURL *url.URL, ctx context.Context, getProperties b
 
 	t.s3URL = s3URLPartsExtension{s3URLParts}
 
-	t.s3Client, err = common.CreateS3Client(
+	t.s3Client, err = newS3TraverserClient(
 		t.ctx,
+		t.s3TraverserOptions,
 		common.CredentialInfo{
 			CredentialType: common.ECredentialType.S3AccessKey(),
 			S3CredentialInfo: common.S3CredentialInfo{
-				Endpoint: t.s3URL.Endpoint,
+				Endpoint:   t.s3URL.Endpoint,
+				AssumeRole: t.assumeRole,
 			},
-		},
-		common.CredentialOpOptions{
-			LogError: glcm.Error,
 		})
 
 	return
@@ -0,0 +1,220 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	chk "gopkg.in/check.v1"
+
+	"github.com/Azure/azure-storage-azcopy/common"
+)
+
+// unit tests for turning the S3-specific copy flags into S3 traverser options
+type copyS3OptionsSuite struct{}
+
+var _ = chk.Suite(&copyS3OptionsSuite{})
+
+func (s *copyS3OptionsSuite) TestNoS3FlagsGiveDefaultOptions(c *chk.C) {
+	raw := rawCopyCmdArgs{}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.skipUnsafeKeys, chk.Equals, false)
+	c.Assert(options.maxBytes, chk.Equals, int64(0))
+	c.Assert(options.caseCollisionPolicy, chk.Equals, eCaseCollisionPolicy.None())
+	c.Assert(options.partitionFunc, chk.IsNil)
+	c.Assert(options.startAfter, chk.Equals, "")
+	c.Assert(options.stopAtKey, chk.Equals, "")
+	c.Assert(options.onPendingRestore, chk.IsNil)
+	c.Assert(options.bucketLess, chk.IsNil)
+	c.Assert(options.getTags, chk.Equals, false)
+	c.Assert(options.tagPolicy, chk.Equals, eS3TagPolicy.Skip())
+	c.Assert(options.useV1Listing, chk.Equals, false)
+	c.Assert(options.reversePageOrder, chk.Equals, false)
+	c.Assert(options.getContentEncoding, chk.Equals, false)
+}
+
+func (s *copyS3OptionsSuite) TestSkipUnsafeKeys(c *chk.C) {
+	raw := rawCopyCmdArgs{s3SkipUnsafeKeys: true}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.skipUnsafeKeys, chk.Equals, true)
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-skip-unsafe-keys can only be used when the source is S3")
+}
+
+func (s *copyS3OptionsSuite) TestMaxBytes(c *chk.C) {
+	raw := rawCopyCmdArgs{s3MaxBytes: 1000}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.maxBytes, chk.Equals, int64(1000))
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.LocalBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-max-bytes can only be used when the source is S3")
+
+	raw.s3MaxBytes = -1
+	_, err = raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.ErrorMatches, "s3-max-bytes cannot be negative")
+}
+
+func (s *copyS3OptionsSuite) TestCaseCollision(c *chk.C) {
+	raw := rawCopyCmdArgs{s3CaseCollision: "rename"}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.caseCollisionPolicy, chk.Equals, eCaseCollisionPolicy.Rename())
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-case-collision can only be used when the source is S3")
+
+	raw.s3CaseCollision = "lowercase"
+	_, err = raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.ErrorMatches, "unknown case collision policy \"lowercase\".*")
+}
+
+func (s *copyS3OptionsSuite) TestPartition(c *chk.C) {
+	raw := rawCopyCmdArgs{s3Partition: "2/3"}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.partitionIndex, chk.Equals, 2)
+	c.Assert(options.partitionFunc, chk.NotNil)
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-partition can only be used when the source is S3")
+
+	for _, invalid := range []string{"3/3", "-1/3", "0/0", "1", "a/b", "1/2/3"} {
+		raw.s3Partition = invalid
+		_, err = raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+		c.Assert(err, chk.ErrorMatches, "invalid partition.*")
+	}
+}
+
+func (s *copyS3OptionsSuite) TestStartAfter(c *chk.C) {
+	raw := rawCopyCmdArgs{s3StartAfter: "logs/2019-06-01"}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.startAfter, chk.Equals, "logs/2019-06-01")
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-start-after can only be used when the source is S3")
+}
+
+func (s *copyS3OptionsSuite) TestStopAtKey(c *chk.C) {
+	raw := rawCopyCmdArgs{s3StartAfter: "logs/2019-06-01", s3StopAtKey: "logs/2019-07-01"}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.stopAtKey, chk.Equals, "logs/2019-07-01")
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-start-after, s3-stop-at-key can only be used when the source is S3")
+
+	raw.s3StopAtKey = raw.s3StartAfter
+	_, err = raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.ErrorMatches, "s3-stop-at-key must come after s3-start-after.*")
+}
+
+func (s *copyS3OptionsSuite) TestSkipPendingRestore(c *chk.C) {
+	raw := rawCopyCmdArgs{s3SkipPendingRestore: true}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.onPendingRestore, chk.NotNil)
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-skip-pending-restore can only be used when the source is S3")
+}
+
+func (s *copyS3OptionsSuite) TestBucketOrder(c *chk.C) {
+	raw := rawCopyCmdArgs{s3BucketOrder: "gamma, beta"}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.bucketLess("gamma", "beta"), chk.Equals, true)
+	c.Assert(options.bucketLess("beta", "alpha"), chk.Equals, true)
+	c.Assert(options.bucketLess("alpha", "delta"), chk.Equals, true)
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-bucket-order can only be used when the source is S3")
+
+	raw = rawCopyCmdArgs{s3BucketOrder: "gamma,,beta"}
+	_, err = raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.ErrorMatches, "s3-bucket-order cannot contain an empty bucket name")
+}
+
+func (s *copyS3OptionsSuite) TestPreserveTags(c *chk.C) {
+	raw := rawCopyCmdArgs{s3PreserveTags: true, s3InvalidTagHandling: "truncate", s2sPreserveProperties: true}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.getTags, chk.Equals, true)
+	c.Assert(options.tagPolicy, chk.Equals, eS3TagPolicy.Truncate())
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-preserve-tags can only be used when the source is S3")
+
+	raw.s3InvalidTagHandling = "drop"
+	_, err = raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.ErrorMatches, `unknown tag policy "drop", expected Skip, Truncate or Error`)
+
+	raw = rawCopyCmdArgs{s3PreserveTags: true}
+	_, err = raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.ErrorMatches, "s3-preserve-tags cannot be used when s2s-preserve-properties is false")
+
+	raw = rawCopyCmdArgs{s3InvalidTagHandling: "error", s2sPreserveProperties: true}
+	_, err = raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.ErrorMatches, "s3-invalid-tag-handling can only be used with s3-preserve-tags")
+}
+
+func (s *copyS3OptionsSuite) TestV1Listing(c *chk.C) {
+	raw := rawCopyCmdArgs{s3V1Listing: true}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.useV1Listing, chk.Equals, true)
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-v1-listing can only be used when the source is S3")
+}
+
+func (s *copyS3OptionsSuite) TestReversePageOrder(c *chk.C) {
+	raw := rawCopyCmdArgs{s3ReversePageOrder: true}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.reversePageOrder, chk.Equals, true)
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-reverse-page-order can only be used when the source is S3")
+}
+
+func (s *copyS3OptionsSuite) TestContentEncodingFiltersFetchContentEncoding(c *chk.C) {
+	raw := rawCopyCmdArgs{excludeContentEncoding: "gzip"}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.getContentEncoding, chk.Equals, true)
+
+	// the filters aren't only for S3, so they're no reason to refuse other sources here
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *copyS3OptionsSuite) TestManifest(c *chk.C) {
+	raw := rawCopyCmdArgs{s3Manifest: "manifest.csv"}
+	options, err := raw.cookS3SourceOptions(common.EFromTo.S3Blob())
+	c.Assert(err, chk.IsNil)
+	c.Assert(options.manifest, chk.IsNil) // made by the copy enumerator
+
+	_, err = raw.cookS3SourceOptions(common.EFromTo.BlobBlob())
+	c.Assert(err, chk.ErrorMatches, "s3-manifest can only be used when the source is S3")
+}
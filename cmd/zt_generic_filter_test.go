@@ -21,6 +21,8 @@
 package cmd
 
 import (
+	"time"
+
 	chk "gopkg.in/check.v1"
 )
 
@@ -73,3 +75,59 @@ func (s *genericFilterSuite) TestExcludeFilter(c *chk.C) {
 		c.Assert(len(dummyProcessor.record), chk.Equals, 0)
 	}
 }
+
+func (s *genericFilterSuite) TestMinAgeFilter(c *chk.C) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	filter := &minAgeFilter{minAge: 10 * time.Minute, now: func() time.Time { return now }}
+
+	// test the positive cases
+	timesToPass := []time.Time{now.Add(-10 * time.Minute), now.Add(-time.Hour), {}}
+	for _, lmt := range timesToPass {
+		c.Assert(filter.doesPass(storedObject{lastModifiedTime: lmt}), chk.Equals, true)
+	}
+
+	// test the negative cases
+	timesNotToPass := []time.Time{now.Add(-9 * time.Minute), now, now.Add(time.Minute)}
+	for _, lmt := range timesNotToPass {
+		c.Assert(filter.doesPass(storedObject{lastModifiedTime: lmt}), chk.Equals, false)
+	}
+
+	// no filter at all, when there is no min age
+	c.Assert(buildMinAgeFilters(0), chk.HasLen, 0)
+
+	// and copy only uses it when asked to
+	c.Assert((&cookedCopyCmdArgs{}).initModularFilters(), chk.HasLen, 0)
+	filters := (&cookedCopyCmdArgs{minAge: time.Minute}).initModularFilters()
+	c.Assert(filters, chk.HasLen, 1)
+	c.Assert(filters[0].(*minAgeFilter).minAge, chk.Equals, time.Minute)
+}
+
+func (s *genericFilterSuite) TestContentEncodingFilter(c *chk.C) {
+	gzipped := storedObject{contentEncoding: "GZIP"}
+	plain := storedObject{}
+
+	includeFilters := buildContentEncodingFilters([]string{"gzip", "br"}, true)
+	c.Assert(includeFilters, chk.HasLen, 1)
+	c.Assert(includeFilters[0].doesPass(gzipped), chk.Equals, true)
+	c.Assert(includeFilters[0].doesPass(plain), chk.Equals, false)
+
+	excludeFilters := buildContentEncodingFilters([]string{"gzip"}, false)
+	c.Assert(excludeFilters[0].doesPass(gzipped), chk.Equals, false)
+	c.Assert(excludeFilters[0].doesPass(plain), chk.Equals, true)
+
+	// no filter at all, when there are no encodings
+	c.Assert(buildContentEncodingFilters(nil, true), chk.HasLen, 0)
+
+	// and copy uses them when asked to
+	filters := (&cookedCopyCmdArgs{includeContentEncodings: []string{"gzip"}, excludeContentEncodings: []string{"br"}}).initModularFilters()
+	c.Assert(filters, chk.HasLen, 2)
+	c.Assert(filters[0].(*contentEncodingFilter).include, chk.Equals, true)
+	c.Assert(filters[1].(*contentEncodingFilter).include, chk.Equals, false)
+}
+
+func (s *genericFilterSuite) TestOversizedObjectFilter(c *chk.C) {
+	filter := &oversizedObjectFilter{}
+	c.Assert(filter.doesPass(storedObject{size: 10}), chk.Equals, true)
+	c.Assert(filter.doesPass(storedObject{size: 10, exceedsDestinationSizeLimit: true}), chk.Equals, false)
+	c.Assert(filter.count, chk.Equals, 1)
+}
@@ -21,6 +21,7 @@
 package cmd
 
 import (
+	"context"
 	"github.com/Azure/azure-storage-azcopy/common"
 	chk "gopkg.in/check.v1"
 	"os"
@@ -147,3 +148,116 @@ func (s *genericProcessorSuite) TestCopyTransferProcessorSingleFile(c *chk.C) {
 	// assert the right transfers were scheduled
 	validateCopyTransfersAreScheduled(c, false, false, "", "", []string{""}, mockedRPC)
 }
+
+func (s *genericProcessorSuite) TestObjectBatcher(c *chk.C) {
+	batches := make([][]string, 0)
+	batcher := newObjectBatcher(3, 100, func(batch []storedObject) error {
+		names := make([]string, 0)
+		for _, obj := range batch {
+			names = append(names, obj.name)
+		}
+		batches = append(batches, names)
+		return nil
+	})
+
+	objects := []storedObject{
+		// first batch is ended by the count
+		{name: "a", size: 1}, {name: "b", size: 1}, {name: "c", size: 1},
+		// second batch is ended by the size
+		{name: "d", size: 60}, {name: "e", size: 40},
+		// third batch is ended by the flush
+		{name: "f", size: 1},
+	}
+	for _, obj := range objects {
+		c.Assert(batcher.process(obj), chk.IsNil)
+	}
+	c.Assert(batches, chk.HasLen, 2)
+	c.Assert(batcher.flush(), chk.IsNil)
+	c.Assert(batcher.flush(), chk.IsNil) // nothing left, so no empty batch
+
+	c.Assert(batches, chk.DeepEquals, [][]string{{"a", "b", "c"}, {"d", "e"}, {"f"}})
+}
+
+func (s *genericProcessorSuite) TestSmallObjectBundler(c *chk.C) {
+	objects := []storedObject{
+		// first bundle is ended by the count
+		{containerName: "one", relativePath: "a", size: 10}, {containerName: "one", relativePath: "b", size: 10}, {containerName: "one", relativePath: "c", size: 10},
+		// second by the size, since the next object wouldn't fit. The big object in the middle isn't bundled
+		{containerName: "one", relativePath: "d", size: 60}, {containerName: "one", relativePath: "big", size: 1000}, {containerName: "one", relativePath: "e", size: 30},
+		// third by the change of container
+		{containerName: "one", relativePath: "f", size: 20},
+		// and the fourth by the flush
+		{containerName: "two", relativePath: "g", size: 1},
+	}
+
+	bundle := func() ([]objectBundle, []string) {
+		bundles := make([]objectBundle, 0)
+		large := make([]string, 0)
+		bundler := newSmallObjectBundler(100, 3, 100,
+			func(bundle objectBundle) error { bundles = append(bundles, bundle); return nil },
+			func(object storedObject) error { large = append(large, object.relativePath); return nil })
+		for _, obj := range objects {
+			c.Assert(bundler.process(obj), chk.IsNil)
+		}
+		c.Assert(bundler.flush(), chk.IsNil)
+		c.Assert(bundler.flush(), chk.IsNil) // nothing left, so no empty bundle
+		return bundles, large
+	}
+
+	bundles, large := bundle()
+	c.Assert(large, chk.DeepEquals, []string{"big"})
+	c.Assert(bundles, chk.DeepEquals, []objectBundle{
+		{index: 0, containerName: "one", relativePaths: []string{"a", "b", "c"}, totalBytes: 30},
+		{index: 1, containerName: "one", relativePaths: []string{"d", "e"}, totalBytes: 90},
+		{index: 2, containerName: "one", relativePaths: []string{"f"}, totalBytes: 20},
+		{index: 3, containerName: "two", relativePaths: []string{"g"}, totalBytes: 1},
+	})
+
+	// the same objects give the same bundles
+	again, _ := bundle()
+	c.Assert(again, chk.DeepEquals, bundles)
+}
+
+func (s *genericProcessorSuite) TestObjectRateLimiter(c *chk.C) {
+	processor := &dummyProcessor{}
+	limiter := newObjectRateLimiter(context.Background(), 100, 2, processor.process)
+
+	// the first two go straight through, then it's one every 10ms
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		c.Assert(limiter.process(storedObject{name: "a"}), chk.IsNil)
+	}
+	c.Assert(time.Since(start) >= 90*time.Millisecond, chk.Equals, true)
+	c.Assert(processor.record, chk.HasLen, 12)
+}
+
+func (s *genericProcessorSuite) TestObjectRateLimiterUnlimited(c *chk.C) {
+	for _, rate := range []float64{0, -1} {
+		processor := &dummyProcessor{}
+		limiter := newObjectRateLimiter(context.Background(), rate, 1, processor.process)
+
+		// everything goes straight through
+		start := time.Now()
+		for i := 0; i < 1000; i++ {
+			c.Assert(limiter.process(storedObject{name: "a"}), chk.IsNil)
+		}
+		c.Assert(time.Since(start) < time.Second, chk.Equals, true)
+		c.Assert(processor.record, chk.HasLen, 1000)
+	}
+}
+
+func (s *genericProcessorSuite) TestObjectRateLimiterCancellation(c *chk.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	processor := &dummyProcessor{}
+	limiter := newObjectRateLimiter(ctx, 0.001, 1, processor.process)
+
+	c.Assert(limiter.process(storedObject{name: "a"}), chk.IsNil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	// would otherwise wait for about 1000 seconds
+	c.Assert(limiter.process(storedObject{name: "b"}), chk.Equals, context.Canceled)
+	c.Assert(processor.record, chk.HasLen, 1)
+}
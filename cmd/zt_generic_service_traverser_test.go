@@ -384,3 +384,23 @@ func (s *genericTraverserSuite) TestServiceTraverserWithWildcards(c *chk.C) {
 		c.Assert(correspondingLocalFile.name, chk.Equals, storedObject.name)
 	}
 }
+
+func (s *genericTraverserSuite) TestBucketNameMatchesPattern(c *chk.C) {
+	cases := []struct {
+		name     string
+		pattern  string
+		expected bool
+	}{
+		{"my-bucket", "my-bucket", true},
+		{"my-bucket-2", "my-bucket", false},
+		{"my-bucket-2", "my-bucket*", true},
+		{"other", "my-bucket*", false},
+		{"my-bucket", "my-bucke?", true},
+	}
+
+	for _, x := range cases {
+		matched, err := bucketNameMatchesPattern(x.name, x.pattern)
+		c.Assert(err, chk.IsNil)
+		c.Assert(matched, chk.Equals, x.expected)
+	}
+}
@@ -0,0 +1,928 @@
+// Copyright © Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+	chk "gopkg.in/check.v1"
+
+	"github.com/Azure/azure-storage-azcopy/common"
+)
+
+// unit tests for the parts of the S3 traversers that don't need an S3 account
+type s3TraverserHelperSuite struct{}
+
+var _ = chk.Suite(&s3TraverserHelperSuite{})
+
+// fakeS3Client serves canned buckets and objects, in place of S3
+type fakeS3Client struct {
+	objectsByBucket map[string][]minio.ObjectInfo
+	pageSize        int
+
+	// tags, by bucket/key. GetObjectTagging returns no tags for objects that aren't in here
+	tags map[string]map[string]string
+
+	// the content of objects, by bucket/key. GetObject fails for objects that aren't in here
+	content map[string][]byte
+}
+
+func newFakeS3Client(pageSize int) *fakeS3Client {
+	return &fakeS3Client{objectsByBucket: make(map[string][]minio.ObjectInfo), pageSize: pageSize, tags: make(map[string]map[string]string), content: make(map[string][]byte)}
+}
+
+// addObjects adds objects of the given size to the bucket, creating the bucket if necessary. Keys must be added in sorted order.
+func (f *fakeS3Client) addObjects(bucketName string, size int64, keys ...string) {
+	objects := f.objectsByBucket[bucketName]
+	for _, key := range keys {
+		objects = append(objects, minio.ObjectInfo{Key: key, Size: size, StorageClass: "STANDARD", LastModified: time.Now()})
+	}
+	f.objectsByBucket[bucketName] = objects
+}
+
+// setHeaders sets the headers that StatObject returns for an object, which must already have been added
+func (f *fakeS3Client) setHeaders(bucketName, key string, headers http.Header) {
+	for i, o := range f.objectsByBucket[bucketName] {
+		if o.Key == key {
+			f.objectsByBucket[bucketName][i].Metadata = headers
+			return
+		}
+	}
+	panic("no such object: " + bucketName + "/" + key)
+}
+
+func (f *fakeS3Client) ListBuckets() ([]minio.BucketInfo, error) {
+	result := make([]minio.BucketInfo, 0)
+	for name := range f.objectsByBucket {
+		result = append(result, minio.BucketInfo{Name: name})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// ListObjectsV2 pages through the keys that match the prefix (and come after startAfter, if set). The delimiter is ignored,
+// i.e. listings are always recursive. The continuation token is just the index of the first object in the page.
+func (f *fakeS3Client) ListObjectsV2(bucketName, objectPrefix, continuationToken string, fetchOwner bool, delimiter string, maxkeys int, startAfter string) (minio.ListBucketV2Result, error) {
+	objects, ok := f.objectsByBucket[bucketName]
+	if !ok {
+		return minio.ListBucketV2Result{}, errors.New("The specified bucket does not exist")
+	}
+
+	matching := make([]minio.ObjectInfo, 0)
+	for _, o := range objects {
+		if strings.HasPrefix(o.Key, objectPrefix) && o.Key > startAfter {
+			matching = append(matching, o)
+		}
+	}
+
+	start := 0
+	if continuationToken != "" {
+		start, _ = strconv.Atoi(continuationToken)
+	}
+	end := start + f.pageSize
+	if end >= len(matching) {
+		return minio.ListBucketV2Result{Contents: matching[start:]}, nil
+	}
+	return minio.ListBucketV2Result{Contents: matching[start:end], IsTruncated: true, NextContinuationToken: strconv.Itoa(end)}, nil
+}
+
+// ListObjects pages through the keys that match the prefix and come after the marker. Like S3 without a delimiter,
+// it doesn't return NextMarker, so the next page starts after the last key of this one
+func (f *fakeS3Client) ListObjects(bucket, prefix, marker, delimiter string, maxKeys int) (minio.ListBucketResult, error) {
+	page, err := f.ListObjectsV2(bucket, prefix, "", false, delimiter, maxKeys, marker)
+	return minio.ListBucketResult{Contents: page.Contents, IsTruncated: page.IsTruncated}, err
+}
+
+func (f *fakeS3Client) StatObject(bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	for _, o := range f.objectsByBucket[bucketName] {
+		if o.Key == objectName {
+			return o, nil
+		}
+	}
+	return minio.ObjectInfo{}, minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}
+}
+
+func (f *fakeS3Client) GetObject(bucketName, objectName string, opts minio.GetObjectOptions) (io.ReadCloser, minio.ObjectInfo, error) {
+	content, ok := f.content[bucketName+"/"+objectName]
+	if !ok {
+		return nil, minio.ObjectInfo{}, minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), minio.ObjectInfo{Key: objectName, Size: int64(len(content))}, nil
+}
+
+func (f *fakeS3Client) GetObjectTagging(bucketName, objectName string) (map[string]string, error) {
+	if _, err := f.StatObject(bucketName, objectName, minio.StatObjectOptions{}); err != nil {
+		return nil, err
+	}
+	return f.tags[bucketName+"/"+objectName], nil
+}
+
+// coreOnlyS3Client is a client that, like minio.Core, can't read tags
+type coreOnlyS3Client struct {
+	s3TraverserClient
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserWithFakeClient(c *chk.C) {
+	client := newFakeS3Client(2)
+	client.addObjects("matchone", 10, "a", "dir/b", "dir/c")
+	client.addObjects("matchtwo", 20, "d")
+	client.addObjects("nomatch", 30, "e")
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	serviceURL.BucketName = "match*"
+	rawURL := serviceURL.URL()
+
+	listRequests := 0
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {},
+		s3TraverserOptions{client: client, incrementListRequestCounter: func() { listRequests++ }})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+
+	found := make(map[string]int64)
+	for _, o := range processor.record {
+		found[o.containerName+"/"+o.relativePath] = o.size
+	}
+	c.Assert(found, chk.DeepEquals, map[string]int64{"matchone/a": 10, "matchone/dir/b": 10, "matchone/dir/c": 10, "matchtwo/d": 20})
+
+	// one ListBuckets, two pages for matchone, and one page for matchtwo
+	c.Assert(listRequests, chk.Equals, 4)
+}
+
+// duplicateBucketsClient lists every bucket twice, as if overlapping patterns had matched each one
+type duplicateBucketsClient struct {
+	*fakeS3Client
+}
+
+func (d duplicateBucketsClient) ListBuckets() ([]minio.BucketInfo, error) {
+	buckets, err := d.fakeS3Client.ListBuckets()
+	return append(buckets, buckets...), err
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserSkipsRepeatedBuckets(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("one", 10, "a", "b")
+	client.addObjects("two", 10, "c")
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	rawURL := serviceURL.URL()
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {},
+		s3TraverserOptions{client: duplicateBucketsClient{client}})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	traversed := make([]string, 0)
+	for _, o := range processor.record {
+		traversed = append(traversed, o.containerName+"/"+o.relativePath)
+	}
+	c.Assert(traversed, chk.DeepEquals, []string{"one/a", "one/b", "two/c"})
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserMatchingBucketsIsACopy(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("one", 10, "a")
+	client.addObjects("two", 10, "b")
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	rawURL := serviceURL.URL()
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {}, s3TraverserOptions{client: client})
+	c.Assert(err, chk.IsNil)
+
+	matching, err := traverser.MatchingBuckets()
+	c.Assert(err, chk.IsNil)
+	c.Assert(matching, chk.DeepEquals, []string{"one", "two"})
+
+	// changing the result doesn't change the cached list, or what's traversed
+	matching[0] = "changed"
+	again, err := traverser.MatchingBuckets()
+	c.Assert(err, chk.IsNil)
+	c.Assert(again, chk.DeepEquals, []string{"one", "two"})
+	c.Assert(traverser.cachedBuckets, chk.DeepEquals, []string{"one", "two"})
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 2)
+	c.Assert(processor.record[0].containerName, chk.Equals, "one")
+}
+
+// listCountingClient counts the list requests that actually reach the client
+type listCountingClient struct {
+	*fakeS3Client
+	listBucketsCalls int
+	listObjectsCalls int
+}
+
+func (l *listCountingClient) ListBuckets() ([]minio.BucketInfo, error) {
+	l.listBucketsCalls++
+	return l.fakeS3Client.ListBuckets()
+}
+
+func (l *listCountingClient) ListObjectsV2(bucketName, objectPrefix, continuationToken string, fetchOwner bool, delimiter string, maxkeys int, startAfter string) (minio.ListBucketV2Result, error) {
+	l.listObjectsCalls++
+	return l.fakeS3Client.ListObjectsV2(bucketName, objectPrefix, continuationToken, fetchOwner, delimiter, maxkeys, startAfter)
+}
+
+func (s *s3TraverserHelperSuite) TestListRequestCounter(c *chk.C) {
+	fake := newFakeS3Client(2)
+	fake.addObjects("five", 10, "a", "b", "c", "d", "e")
+	fake.addObjects("one", 10, "f")
+	fake.addObjects("empty", 0)
+
+	// one count per page, for a bucket
+	for bucket, pages := range map[string]int{"five": 3, "one": 1, "empty": 1} {
+		client := &listCountingClient{fakeS3Client: fake}
+		rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/" + bucket + "/")
+		c.Assert(err, chk.IsNil)
+		listRequests := 0
+		traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {},
+			s3TraverserOptions{client: client, incrementListRequestCounter: func() { listRequests++ }})
+		c.Assert(err, chk.IsNil)
+		c.Assert(traverser.traverse(noPreProccessor, (&dummyProcessor{}).process, nil), chk.IsNil)
+		c.Assert(listRequests, chk.Equals, pages, chk.Commentf("bucket %s", bucket))
+		c.Assert(client.listObjectsCalls, chk.Equals, pages)
+	}
+
+	// and one more for ListBuckets, for the service
+	client := &listCountingClient{fakeS3Client: fake}
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	rawURL := serviceURL.URL()
+	listRequests := 0
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {},
+		s3TraverserOptions{client: client, incrementListRequestCounter: func() { listRequests++ }})
+	c.Assert(err, chk.IsNil)
+	c.Assert(traverser.traverse(noPreProccessor, (&dummyProcessor{}).process, nil), chk.IsNil)
+	c.Assert(client.listBucketsCalls, chk.Equals, 1)
+	c.Assert(client.listObjectsCalls, chk.Equals, 5)
+	c.Assert(listRequests, chk.Equals, 1+5)
+}
+
+func (s *s3TraverserHelperSuite) TestReadS3InventoryRows(c *chk.C) {
+	data := `"src-bucket","dir/file%20one.txt","123","2019-10-01T12:30:00.000Z","abc"
+"src-bucket","file2","0","2019-10-02T00:00:00.000Z","def"
+`
+	rows := make([]s3InventoryRow, 0)
+	err := readS3InventoryRows(strings.NewReader(data), "Bucket, Key, Size, LastModifiedDate, ETag", func(row s3InventoryRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(rows, chk.HasLen, 2)
+
+	c.Assert(rows[0].key, chk.Equals, "dir/file one.txt")
+	c.Assert(rows[0].size, chk.Equals, int64(123))
+	c.Assert(rows[0].lastModified.Equal(time.Date(2019, 10, 1, 12, 30, 0, 0, time.UTC)), chk.Equals, true)
+	c.Assert(rows[0].etag, chk.Equals, "abc")
+	c.Assert(rows[1].key, chk.Equals, "file2")
+}
+
+func (s *s3TraverserHelperSuite) TestInventoryTraverser(c *chk.C) {
+	data := &bytes.Buffer{}
+	zipped := gzip.NewWriter(data)
+	_, err := zipped.Write([]byte(`"src-bucket","dir/file%20one.txt","123","2019-10-01T12:30:00.000Z","abc"
+"src-bucket","file2","0","2019-10-02T00:00:00.000Z","def"
+`))
+	c.Assert(err, chk.IsNil)
+	c.Assert(zipped.Close(), chk.IsNil)
+
+	client := newFakeS3Client(1000)
+	client.content["inventory/src-bucket/config/manifest.json"] = []byte(`{"sourceBucket": "src-bucket", "fileFormat": "CSV",
+"fileSchema": "Bucket, Key, Size, LastModifiedDate, ETag", "files": [{"key": "src-bucket/config/data/1.csv.gz"}]}`)
+	client.content["inventory/src-bucket/config/data/1.csv.gz"] = data.Bytes()
+
+	manifestURL, err := url.Parse("https://inventory.s3.us-west-2.amazonaws.com/src-bucket/config/manifest.json")
+	c.Assert(err, chk.IsNil)
+	traverser, err := newS3InventoryTraverserWithOptions(manifestURL, context.Background(), func() {}, s3TraverserOptions{client: client})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 2)
+	c.Assert(processor.record[0].containerName, chk.Equals, "src-bucket")
+	c.Assert(processor.record[0].relativePath, chk.Equals, "dir/file one.txt")
+	c.Assert(processor.record[0].size, chk.Equals, int64(123))
+	c.Assert(processor.record[0].etag, chk.Equals, "abc")
+	c.Assert(processor.record[1].relativePath, chk.Equals, "file2")
+	c.Assert(processor.record[1].etag, chk.Equals, "def")
+}
+
+func (s *s3TraverserHelperSuite) TestReadS3InventoryRowsRequiresKey(c *chk.C) {
+	err := readS3InventoryRows(strings.NewReader(""), "Bucket, Size", func(row s3InventoryRow) error { return nil })
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *s3TraverserHelperSuite) TestIsUnsafeObjectKey(c *chk.C) {
+	c.Assert(isUnsafeObjectKey("dir/file.txt"), chk.Equals, false)
+	c.Assert(isUnsafeObjectKey("dir/fïlé 名前.txt"), chk.Equals, false)
+	c.Assert(isUnsafeObjectKey("dir/file\n.txt"), chk.Equals, true)
+	c.Assert(isUnsafeObjectKey("dir/file\x7f.txt"), chk.Equals, true)
+	c.Assert(isUnsafeObjectKey("dir/file\xff.txt"), chk.Equals, true)
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserStopsAtProcessorError(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("one", 10, "a", "bad", "c")
+	client.addObjects("two", 10, "bad", "d")
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	rawURL := serviceURL.URL()
+
+	processed := make([]string, 0)
+	processor := func(object storedObject) error {
+		if object.name == "bad" {
+			return errors.New("cannot process")
+		}
+		processed = append(processed, object.containerName+"/"+object.relativePath)
+		return nil
+	}
+
+	// the traversal stops at the error, and returns it, rather than logging it and moving on to the next bucket
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {}, s3TraverserOptions{client: client})
+	c.Assert(err, chk.IsNil)
+	c.Assert(traverser.traverse(noPreProccessor, processor, nil), chk.ErrorMatches, "cannot process")
+	c.Assert(processed, chk.DeepEquals, []string{"one/a"}) // bucket "two" isn't traversed
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserMaxBytes(c *chk.C) {
+	client := newFakeS3Client(2)
+	client.addObjects("bucket", 40, "a", "b", "c", "d", "e")
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+	listRequests := 0
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:                      client,
+		maxBytes:                    100,
+		incrementListRequestCounter: func() { listRequests++ }})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+
+	// the third object would take us over the budget, so the listing stops there, without fetching the last page
+	c.Assert(processor.record, chk.HasLen, 2)
+	c.Assert(listRequests, chk.Equals, 2)
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserMaxBytesCoversAllBuckets(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("one", 30, "a", "b")
+	client.addObjects("three", 30, "e")
+	client.addObjects("two", 30, "c", "d")
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	rawURL := serviceURL.URL()
+
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {}, s3TraverserOptions{
+		client:   client,
+		maxBytes: 100})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+
+	c.Assert(processor.record, chk.HasLen, 3)
+	for _, o := range processor.record {
+		c.Assert(o.containerName, chk.Not(chk.Equals), "two")
+	}
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserBucketOrder(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("alpha", 10, "a")
+	client.addObjects("beta", 10, "b")
+	client.addObjects("delta", 10, "d")
+	client.addObjects("gamma", 10, "g")
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	rawURL := serviceURL.URL()
+
+	traversedBuckets := func(bucketLess func(a, b string) bool) []string {
+		traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {}, s3TraverserOptions{
+			client:     client,
+			bucketLess: bucketLess})
+		c.Assert(err, chk.IsNil)
+
+		processor := &dummyProcessor{}
+		c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+		result := make([]string, 0)
+		for _, o := range processor.record {
+			result = append(result, o.containerName)
+		}
+
+		// MatchingBuckets reports the same order
+		matching, err := traverser.MatchingBuckets()
+		c.Assert(err, chk.IsNil)
+		c.Assert(matching, chk.DeepEquals, result)
+		return result
+	}
+
+	c.Assert(traversedBuckets(alphabeticalBucketOrder), chk.DeepEquals, []string{"alpha", "beta", "delta", "gamma"})
+	c.Assert(traversedBuckets(func(a, b string) bool { return a > b }), chk.DeepEquals, []string{"gamma", "delta", "beta", "alpha"})
+	c.Assert(traversedBuckets(bucketPriorityOrder([]string{"gamma", "missing", "beta"})), chk.DeepEquals, []string{"gamma", "beta", "alpha", "delta"})
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserCaseCollisions(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("bucket", 10, "File.txt", "dir/a", "file.TXT", "file.txt")
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+
+	expectedPaths := map[caseCollisionPolicy][]string{
+		eCaseCollisionPolicy.None():   {"File.txt", "dir/a", "file.TXT", "file.txt"},
+		eCaseCollisionPolicy.Warn():   {"File.txt", "dir/a", "file.TXT", "file.txt"},
+		eCaseCollisionPolicy.Skip():   {"File.txt", "dir/a"},
+		eCaseCollisionPolicy.Rename(): {"File.txt", "dir/a", "file (2).TXT", "file (3).txt"},
+	}
+	for policy, expected := range expectedPaths {
+		traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{client: client, caseCollisionPolicy: policy})
+		c.Assert(err, chk.IsNil)
+
+		processor := &dummyProcessor{}
+		c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+
+		paths := make([]string, 0)
+		for _, o := range processor.record {
+			paths = append(paths, o.relativePath)
+			c.Assert(o.name, chk.Equals, path.Base(o.relativePath))
+		}
+		c.Assert(paths, chk.DeepEquals, expected, chk.Commentf("policy %d", policy))
+	}
+
+	c.Assert(caseCollisionSuffixed("dir/.profile", 2), chk.Equals, "dir/.profile (2)")
+	c.Assert(caseCollisionSuffixed("dir/archive.tar.gz", 2), chk.Equals, "dir/archive.tar (2).gz")
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserPartitions(c *chk.C) {
+	client := newFakeS3Client(2)
+	keys := []string{"a", "b", "c", "d", "e", "f", "g"}
+	client.addObjects("bucket", 10, keys...)
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+
+	const partitionCount = 3
+	found := make(map[string]int)
+	for index := 0; index < partitionCount; index++ {
+		traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+			client:         client,
+			partitionFunc:  func(key string) int { return int(key[0]) % partitionCount },
+			partitionIndex: index})
+		c.Assert(err, chk.IsNil)
+
+		processor := &dummyProcessor{}
+		c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+		for _, o := range processor.record {
+			c.Assert(int(o.relativePath[0])%partitionCount, chk.Equals, index)
+			found[o.relativePath]++
+		}
+	}
+
+	// between them, the partitions cover every object exactly once
+	c.Assert(found, chk.HasLen, len(keys))
+	for _, count := range found {
+		c.Assert(count, chk.Equals, 1)
+	}
+}
+
+func (s *s3TraverserHelperSuite) TestHashKeyPartition(c *chk.C) {
+	partition := hashKeyPartition(4)
+	counts := make([]int, 4)
+	for i := 0; i < 1000; i++ {
+		key := "dir/object-" + strconv.Itoa(i)
+		p := partition(key)
+		c.Assert(p >= 0 && p < 4, chk.Equals, true)
+		c.Assert(partition(key), chk.Equals, p) // the same key always lands in the same partition
+		counts[p]++
+	}
+
+	// the hash spreads the keys out, rather than putting them all in one partition
+	for _, count := range counts {
+		c.Assert(count > 150, chk.Equals, true)
+	}
+}
+
+func (s *s3TraverserHelperSuite) TestPlanRangedGets(c *chk.C) {
+	ranges, err := planRangedGets(storedObject{size: 250}, 100)
+	c.Assert(err, chk.IsNil)
+	c.Assert(ranges, chk.DeepEquals, []common.FileRange{{Offset: 0, Length: 100}, {Offset: 100, Length: 100}, {Offset: 200, Length: 50}})
+
+	// exact multiple, so no short range at the end
+	ranges, err = planRangedGets(storedObject{size: 200}, 100)
+	c.Assert(err, chk.IsNil)
+	c.Assert(ranges, chk.DeepEquals, []common.FileRange{{Offset: 0, Length: 100}, {Offset: 100, Length: 100}})
+
+	// smaller than one chunk, and empty
+	ranges, err = planRangedGets(storedObject{size: 1}, 100)
+	c.Assert(err, chk.IsNil)
+	c.Assert(ranges, chk.DeepEquals, []common.FileRange{{Offset: 0, Length: 1}})
+	ranges, err = planRangedGets(storedObject{size: 0}, 100)
+	c.Assert(err, chk.IsNil)
+	c.Assert(ranges, chk.HasLen, 0)
+
+	_, err = planRangedGets(storedObject{size: 100}, 0)
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserCursor(c *chk.C) {
+	client := newFakeS3Client(2)
+	client.addObjects("bucket", 10, "a", "b", "c", "d", "e")
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+
+	// the first run stops part way through, because the processor fails
+	cursor := ""
+	options := s3TraverserOptions{client: client, onCursor: func(bucketName, key string) {
+		c.Assert(bucketName, chk.Equals, "bucket")
+		c.Assert(key > cursor, chk.Equals, true)
+		cursor = key
+	}}
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, options)
+	c.Assert(err, chk.IsNil)
+	err = traverser.traverse(noPreProccessor, func(object storedObject) error {
+		if object.name == "c" {
+			return errors.New("cannot process")
+		}
+		return nil
+	}, nil)
+	c.Assert(err, chk.NotNil)
+	c.Assert(cursor, chk.Equals, "b")
+
+	// the next run resumes after the cursor
+	options.startAfter = cursor
+	traverser, err = newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, options)
+	c.Assert(err, chk.IsNil)
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 3)
+	c.Assert(processor.record[0].name, chk.Equals, "c")
+	c.Assert(cursor, chk.Equals, "e")
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserPendingRestore(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("bucket", 10, "done", "pending", "plain")
+	objects := client.objectsByBucket["bucket"]
+	objects[0].Metadata = http.Header{"X-Amz-Restore": []string{`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`}}
+	objects[1].Metadata = http.Header{"X-Amz-Restore": []string{`ongoing-request="true"`}}
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+	pending := make([]string, 0)
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:           client,
+		onPendingRestore: func(object storedObject) { pending = append(pending, object.relativePath) }})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(pending, chk.DeepEquals, []string{"pending"})
+	c.Assert(processor.record, chk.HasLen, 2)
+	for _, o := range processor.record {
+		c.Assert(o.relativePath, chk.Not(chk.Equals), "pending")
+	}
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserGetsTags(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("bucket", 10, "tagged", "untagged")
+	client.tags["bucket/tagged"] = map[string]string{"project": "apollo", "cost-centre": "42"}
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:  client,
+		getTags: true})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 2)
+	c.Assert(processor.record[0].Metadata, chk.DeepEquals, common.Metadata{"project": "apollo"})
+	c.Assert(processor.record[1].Metadata, chk.HasLen, 0)
+
+	// the error policy fails the traversal
+	traverser, err = newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:    client,
+		getTags:   true,
+		tagPolicy: eS3TagPolicy.Error()})
+	c.Assert(err, chk.IsNil)
+	c.Assert(traverser.traverse(noPreProccessor, (&dummyProcessor{}).process, nil), chk.ErrorMatches, `.*tag "cost-centre" contains characters.*`)
+
+	// and clients that can't read tags are refused up front, whatever the other options
+	_, err = newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:  coreOnlyS3Client{client},
+		getTags: true})
+	c.Assert(err, chk.ErrorMatches, "cannot get object tags.*")
+	traverser, err = newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:       coreOnlyS3Client{client},
+		getTags:      true,
+		useV1Listing: true})
+	c.Assert(err, chk.ErrorMatches, "cannot get object tags.*")
+	c.Assert(traverser, chk.IsNil)
+}
+
+func (s *s3TraverserHelperSuite) TestListLatencySummary(c *chk.C) {
+	c.Assert((&listLatencyRecorder{}).summary(), chk.Equals, listLatencySummary{})
+
+	r := &listLatencyRecorder{}
+	for i := 100; i >= 1; i-- {
+		r.record(time.Duration(i) * time.Millisecond)
+	}
+	c.Assert(r.summary(), chk.Equals, listLatencySummary{count: 100, p50: 50 * time.Millisecond, p95: 95 * time.Millisecond, p99: 99 * time.Millisecond, max: 100 * time.Millisecond})
+
+	// with few samples, the high percentiles are the slowest request
+	r = &listLatencyRecorder{}
+	r.record(time.Second)
+	r.record(time.Millisecond)
+	c.Assert(r.summary(), chk.Equals, listLatencySummary{count: 2, p50: time.Millisecond, p95: time.Second, p99: time.Second, max: time.Second})
+
+	var nilRecorder *listLatencyRecorder
+	nilRecorder.record(time.Second) // doesn't panic
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserRecordsListLatencies(c *chk.C) {
+	client := newFakeS3Client(2)
+	client.addObjects("one", 10, "a", "b", "c") // 2 pages
+	client.addObjects("two", 10, "d")           // 1 page
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	rawURL := serviceURL.URL()
+
+	streamed := 0
+	latencies := &listLatencyRecorder{onRecord: func(d time.Duration) { streamed++ }}
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {}, s3TraverserOptions{
+		client:        client,
+		listLatencies: latencies})
+	c.Assert(err, chk.IsNil)
+	c.Assert(traverser.traverse(noPreProccessor, (&dummyProcessor{}).process, nil), chk.IsNil)
+
+	// ListBuckets, and the three pages
+	c.Assert(latencies.summary().count, chk.Equals, 4)
+	c.Assert(streamed, chk.Equals, 4)
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserStopAtKey(c *chk.C) {
+	client := newFakeS3Client(2)
+	client.addObjects("bucket", 10, "logs/2019-05-30/a", "logs/2019-05-31/a", "logs/2019-05-31/b", "logs/2019-06-01/a", "logs/2019-06-02/a")
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/logs/")
+	c.Assert(err, chk.IsNil)
+	june := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	boundary := dateKeyBoundary("logs/", june, "2006-01-02")
+	c.Assert(boundary, chk.Equals, "logs/2019-06-01")
+
+	// listing stops at the boundary, without requesting the pages after it
+	listRequests := 0
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:                      client,
+		stopAtKey:                   boundary,
+		incrementListRequestCounter: func() { listRequests++ }})
+	c.Assert(err, chk.IsNil)
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 3)
+	c.Assert(processor.record[2].relativePath, chk.Equals, "2019-05-31/b")
+	c.Assert(listRequests, chk.Equals, 2)
+
+	// as startAfter, the boundary skips the earlier dates instead
+	traverser, err = newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:     client,
+		startAfter: boundary})
+	c.Assert(err, chk.IsNil)
+	processor = &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 2)
+	c.Assert(processor.record[0].relativePath, chk.Equals, "2019-06-01/a")
+}
+
+// stuckMarkerS3Client returns the same marker for every page, like a broken gateway
+type stuckMarkerS3Client struct {
+	*fakeS3Client
+}
+
+func (s stuckMarkerS3Client) ListObjects(bucket, prefix, marker, delimiter string, maxKeys int) (minio.ListBucketResult, error) {
+	page, err := s.fakeS3Client.ListObjects(bucket, prefix, "", delimiter, maxKeys)
+	page.NextMarker = "a"
+	return page, err
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserV1Listing(c *chk.C) {
+	client := newFakeS3Client(2)
+	client.addObjects("bucket", 10, "a", "b", "c", "d", "e")
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+	listRequests := 0
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:                      client,
+		useV1Listing:                true,
+		startAfter:                  "a",
+		incrementListRequestCounter: func() { listRequests++ }})
+	c.Assert(err, chk.IsNil)
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 4)
+	c.Assert(processor.record[0].name, chk.Equals, "b")
+	c.Assert(processor.record[3].name, chk.Equals, "e")
+	c.Assert(listRequests, chk.Equals, 2)
+
+	// a marker that doesn't move forward is an error, not an endless loop
+	traverser, err = newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:       stuckMarkerS3Client{client},
+		useV1Listing: true})
+	c.Assert(err, chk.IsNil)
+	err = traverser.traverse(noPreProccessor, (&dummyProcessor{}).process, nil)
+	c.Assert(err, chk.ErrorMatches, ".*went back to marker \"a\" after marker \"a\"")
+
+	// the client must be able to make the call
+	_, err = newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:       coreOnlyS3Client{client},
+		useV1Listing: true})
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserReversePageOrder(c *chk.C) {
+	client := newFakeS3Client(3)
+	client.addObjects("bucket", 10, "a", "b", "c", "d", "e")
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+	cursors := make([]string, 0)
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:           client,
+		reversePageOrder: true,
+		onCursor:         func(bucketName, key string) { cursors = append(cursors, key) }})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	names := make([]string, 0)
+	for _, o := range processor.record {
+		names = append(names, o.name)
+	}
+	c.Assert(names, chk.DeepEquals, []string{"c", "b", "a", "e", "d"}) // reversed within each page of 3
+	c.Assert(cursors, chk.DeepEquals, []string{"c", "e"})
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserDestinationSizeLimit(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("bucket", 101, "big")
+	client.addObjects("bucket", 100, "small")
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:               client,
+		destinationSizeLimit: 100})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, nil), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 2)
+	c.Assert(processor.record[0].name, chk.Equals, "big")
+	c.Assert(processor.record[0].exceedsDestinationSizeLimit, chk.Equals, true)
+	c.Assert(processor.record[1].exceedsDestinationSizeLimit, chk.Equals, false)
+
+	c.Assert(maxBlockBlobSize, chk.Equals, int64(50000*100*1024*1024))
+}
+
+func (s *s3TraverserHelperSuite) TestTraverserContentEncoding(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("bucket", 10, "logs.gz", "readme")
+	client.objectsByBucket["bucket"][0].Metadata = http.Header{"Content-Encoding": []string{"gzip"}}
+
+	rawURL, err := url.Parse("https://s3.us-west-2.amazonaws.com/bucket/")
+	c.Assert(err, chk.IsNil)
+	traverser, err := newS3TraverserWithOptions(rawURL, context.Background(), true, false, func() {}, s3TraverserOptions{
+		client:             client,
+		getContentEncoding: true})
+	c.Assert(err, chk.IsNil)
+
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, processor.process, buildContentEncodingFilters([]string{"gzip"}, true)), chk.IsNil)
+	c.Assert(processor.record, chk.HasLen, 1)
+	c.Assert(processor.record[0].name, chk.Equals, "logs.gz")
+	c.Assert(processor.record[0].contentEncoding, chk.Equals, "gzip")
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserManifest(c *chk.C) {
+	client := newFakeS3Client(2)
+	client.addObjects("matchone", 10, "a", "dir/b")
+	client.addObjects("matchtwo", 20, "c")
+	for bucket, objects := range client.objectsByBucket {
+		for i := range objects {
+			objects[i].ETag = "etag-" + bucket + "-" + objects[i].Key
+			objects[i].LastModified = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+		}
+	}
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	serviceURL.BucketName = "match*"
+	rawURL := serviceURL.URL()
+
+	manifest := &strings.Builder{}
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {},
+		s3TraverserOptions{client: client, manifest: manifest})
+	c.Assert(err, chk.IsNil)
+
+	// objects that fail to process are left out
+	processor := &dummyProcessor{}
+	c.Assert(traverser.traverse(noPreProccessor, func(object storedObject) error {
+		if object.relativePath == "c" {
+			return errors.New("cannot process")
+		}
+		return processor.process(object)
+	}, nil), chk.ErrorMatches, "cannot process")
+
+	c.Assert(manifest.String(), chk.Equals, "bucket,key,size,etag,lastModified\n"+
+		"matchone,a,10,etag-matchone-a,2019-06-01T12:00:00Z\n"+
+		"matchone,dir/b,10,etag-matchone-dir/b,2019-06-01T12:00:00Z\n")
+}
+
+// a writer that accepts the first okWrites writes, and fails the rest
+type failingWriter struct {
+	okWrites int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.okWrites <= 0 {
+		return 0, errors.New("disk full")
+	}
+	w.okWrites--
+	return len(p), nil
+}
+
+func (s *s3TraverserHelperSuite) TestServiceTraverserManifestWriteFailure(c *chk.C) {
+	client := newFakeS3Client(1000)
+	client.addObjects("one", 10, "a", "b")
+	client.addObjects("two", 10, "c")
+
+	serviceURL, err := common.NewS3URLParts(url.URL{Scheme: "https", Host: "s3.us-west-2.amazonaws.com", Path: "/"})
+	c.Assert(err, chk.IsNil)
+	rawURL := serviceURL.URL()
+
+	// the header is written, but not the first object. The traversal stops there
+	processor := &dummyProcessor{}
+	traverser, err := newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {}, s3TraverserOptions{
+		client:   client,
+		manifest: &failingWriter{okWrites: 1}})
+	c.Assert(err, chk.IsNil)
+	err = traverser.traverse(noPreProccessor, processor.process, nil)
+	c.Assert(errors.Is(err, errS3ManifestWriteFailed), chk.Equals, true)
+	c.Assert(err, chk.ErrorMatches, "cannot write the manifest: one/a: disk full")
+	c.Assert(processor.record, chk.HasLen, 1)
+
+	// nothing is traversed if the header can't be written
+	processor = &dummyProcessor{}
+	traverser, err = newS3ServiceTraverserWithOptions(&rawURL, context.Background(), false, func() {}, s3TraverserOptions{
+		client:   client,
+		manifest: &failingWriter{}})
+	c.Assert(err, chk.IsNil)
+	err = traverser.traverse(noPreProccessor, processor.process, nil)
+	c.Assert(errors.Is(err, errS3ManifestWriteFailed), chk.Equals, true)
+	c.Assert(processor.record, chk.HasLen, 0)
+}
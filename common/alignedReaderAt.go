@@ -0,0 +1,112 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"io"
+)
+
+// alignedReaderAt rounds the offset and size of each read out to multiples of the alignment, reads that, and trims the result
+// back to what was asked for. Some sources, such as some network file systems, are much faster when reads are aligned.
+// Reads that are already aligned are passed straight through. Others read the aligned middle straight into the caller's buffer,
+// and only the partly-wanted sectors at either end go through small buffers, from alignedReaderAtBufferPool. So there's never a
+// second chunk-sized buffer, outside the slice pool and the CacheLimiter.
+type alignedReaderAt struct {
+	inner     io.ReaderAt
+	alignment int64
+}
+
+// Alignments up to this size are pooled. Bigger ones still work, but each of their end sectors is allocated
+const alignedReaderAtMaxPooledAlignment = 1024 * 1024
+
+var alignedReaderAtBufferPool = NewMultiSizeSlicePool(alignedReaderAtMaxPooledAlignment)
+
+// NewAlignedReaderAt wraps inner, so that all reads from it are aligned. An alignment of 1 or less means no alignment
+func NewAlignedReaderAt(inner io.ReaderAt, alignment int) io.ReaderAt {
+	if alignment <= 1 {
+		return inner
+	}
+	return &alignedReaderAt{inner: inner, alignment: int64(alignment)}
+}
+
+func (a *alignedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	middleStart := off // the aligned part of p, if any, is from middleStart to middleEnd
+	if remainder := off % a.alignment; remainder != 0 {
+		middleStart += a.alignment - remainder
+	}
+	middleEnd := end - end%a.alignment
+
+	if middleStart == off && middleEnd == end {
+		return a.inner.ReadAt(p, off)
+	}
+	if middleStart > middleEnd {
+		return a.readThroughSector(p, off) // p is all within one sector
+	}
+
+	total := 0
+	if off < middleStart {
+		n, err := a.readThroughSector(p[:middleStart-off], off)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	if middleStart < middleEnd {
+		middle := p[middleStart-off : middleEnd-off]
+		n, err := a.inner.ReadAt(middle, middleStart)
+		total += n
+		if n < len(middle) || (err != nil && err != io.EOF) {
+			return total, err
+		}
+	}
+	if middleEnd < end {
+		n, err := a.readThroughSector(p[middleEnd-off:], middleEnd)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// readThroughSector reads the whole sector that p, which must be within one sector, is part of, and copies the part of it that p wants
+func (a *alignedReaderAt) readThroughSector(p []byte, off int64) (int, error) {
+	sectorOff := off - off%a.alignment
+	buffer := alignedReaderAtBufferPool.RentSlice(uint32(a.alignment))
+	defer alignedReaderAtBufferPool.ReturnSlice(buffer)
+
+	n, err := a.inner.ReadAt(buffer, sectorOff)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	// trim off the extra at the start (and the end, if the file didn't end first)
+	start := int(off - sectorOff)
+	if n <= start {
+		return 0, io.EOF
+	}
+	copied := copy(p, buffer[start:n])
+	if copied < len(p) {
+		return copied, io.EOF // the file ended before the end of p
+	}
+	return copied, nil
+}
@@ -22,9 +22,15 @@ package common
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
+	"reflect"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/JeffreyRichter/enum/enum"
 )
 
 type Predicate func() bool
@@ -39,15 +45,76 @@ type CacheLimiter interface {
 	WaitUntilAdd(ctx context.Context, count int64, useRelaxedLimit Predicate) error
 	Remove(count int64)
 	Limit() int64
+	WaitForZero(ctx context.Context) error
 }
 
 type cacheLimiter struct {
 	value int64
 	limit int64
+
+	// closed (and replaced) each time value drops to zero, to wake anything in WaitForZero
+	zeroSignal   chan struct{}
+	zeroSignalMu *sync.Mutex
+
+	// what Remove does if it would take the value below zero
+	underflowGuard UnderflowGuard
+	logger         ILogger
+}
+
+// UnderflowGuard decides what a CacheLimiter does when Remove would take its value below zero. That can only happen
+// if something is removed that was never added (e.g. a buffer that is released twice), and it breaks the limiting,
+// since the bogus headroom lets through more than the limit allows.
+//
+// None (the default) does nothing, so the value goes negative. Panic panics, to pinpoint the bug (e.g. in testing).
+// Clamp stops the value at zero, and logs a warning, so that production jobs keep running with sane accounting.
+var EUnderflowGuard = UnderflowGuard(0)
+
+type UnderflowGuard uint8
+
+func (UnderflowGuard) None() UnderflowGuard  { return UnderflowGuard(0) }
+func (UnderflowGuard) Panic() UnderflowGuard { return UnderflowGuard(1) }
+func (UnderflowGuard) Clamp() UnderflowGuard { return UnderflowGuard(2) }
+
+func (g UnderflowGuard) String() string {
+	return enum.StringInt(g, reflect.TypeOf(g))
+}
+
+// Optional settings for a CacheLimiter. The zero value gives the default behaviour
+type CacheLimiterOptions struct {
+	UnderflowGuard UnderflowGuard
+
+	// where Clamp logs its warnings. May be nil, in which case the value is clamped silently
+	Logger ILogger
 }
 
 func NewCacheLimiter(limit int64) CacheLimiter {
-	return &cacheLimiter{limit: limit}
+	return NewCacheLimiterWithOptions(limit, CacheLimiterOptions{})
+}
+
+func NewCacheLimiterWithOptions(limit int64, options CacheLimiterOptions) CacheLimiter {
+	return &cacheLimiter{
+		limit:          limit,
+		zeroSignal:     make(chan struct{}),
+		zeroSignalMu:   &sync.Mutex{},
+		underflowGuard: options.UnderflowGuard,
+		logger:         options.Logger,
+	}
+}
+
+// add changes the value, and wakes anyone waiting in WaitForZero if the value is now zero
+func (c *cacheLimiter) add(delta int64) int64 {
+	newValue := atomic.AddInt64(&c.value, delta)
+	if newValue == 0 {
+		c.signalZero()
+	}
+	return newValue
+}
+
+func (c *cacheLimiter) signalZero() {
+	c.zeroSignalMu.Lock()
+	close(c.zeroSignal)
+	c.zeroSignal = make(chan struct{})
+	c.zeroSignalMu.Unlock()
 }
 
 // TryAddBytes tries to add a memory allocation within the limit.  Returns true if it could be (and was) added
@@ -69,11 +136,11 @@ func (c *cacheLimiter) TryAdd(count int64, useRelaxedLimit bool) (added bool) {
 		//   relaxed and strict limits is less appropriate. Refactor to make it a configuration param of the instance?
 	}
 
-	if atomic.AddInt64(&c.value, count) <= lim {
+	if c.add(count) <= lim {
 		return true
 	}
 	// else, we are over the limit, so immediately subtract back what we've added, and return false
-	atomic.AddInt64(&c.value, -count)
+	c.add(-count)
 	return false
 }
 
@@ -102,10 +169,58 @@ func (c *cacheLimiter) WaitUntilAdd(ctx context.Context, count int64, useRelaxed
 }
 
 func (c *cacheLimiter) Remove(count int64) {
-	negativeDelta := -count
-	atomic.AddInt64(&c.value, negativeDelta)
+	if c.underflowGuard == EUnderflowGuard.None() {
+		negativeDelta := -count
+		c.add(negativeDelta)
+		return
+	}
+
+	// check and subtract atomically, so that we never even briefly go below zero
+	for {
+		oldValue := atomic.LoadInt64(&c.value)
+		newValue := oldValue - count
+		if newValue < 0 {
+			msg := fmt.Sprintf("cache limiter accounting error: removing %d when the value is only %d", count, oldValue)
+			if c.underflowGuard == EUnderflowGuard.Panic() {
+				panic(msg)
+			}
+			if c.logger != nil {
+				c.logger.Log(pipeline.LogWarning, msg+". Clamping the value to zero")
+			}
+			newValue = 0
+		}
+
+		if atomic.CompareAndSwapInt64(&c.value, oldValue, newValue) {
+			if newValue == 0 {
+				c.signalZero()
+			}
+			return
+		}
+	}
 }
 
 func (c *cacheLimiter) Limit() int64 {
 	return c.limit
 }
+
+// WaitForZero blocks until everything that was added has been removed again, or until ctx is cancelled.
+// E.g. at shutdown, this allows us to wait until all cached data has been released, without polling.
+func (c *cacheLimiter) WaitForZero(ctx context.Context) error {
+	for {
+		// get the signal BEFORE checking the value, so that we can't miss a drop to zero that happens in between
+		c.zeroSignalMu.Lock()
+		signal := c.zeroSignal
+		c.zeroSignalMu.Unlock()
+
+		if atomic.LoadInt64(&c.value) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-signal:
+			// loop around to check again, since something may have been added since the signal was fired
+		}
+	}
+}
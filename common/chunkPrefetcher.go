@@ -0,0 +1,171 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// ChunkPrefetcher prefetches the chunks of one file in the background, staying one chunk ahead of the consumer.
+// So while chunk N is being sent, chunk N+1 is being read from disk, overlapping the disk read with the network send.
+// Each prefetch is still subject to the chunk's CacheLimiter, so the prefetched-byte ceiling is respected.
+//
+// Usage: call Start, then call Next repeatedly until it returns io.EOF, then call Stop.
+// Readers returned by Next belong to the caller, who must Close them. Readers that were never returned are closed by Stop.
+type ChunkPrefetcher struct {
+	source  io.ReaderAt
+	readers []SingleChunkReader
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	results chan chunkPrefetchResult
+	done    chan struct{}
+
+	stopOnce   *sync.Once
+	handedOut  int
+	isStarted  bool
+	finalError error
+}
+
+type chunkPrefetchResult struct {
+	reader SingleChunkReader
+	err    error
+}
+
+// contextPrefetcher is implemented by the readers whose prefetch can be stopped by a context other than their own. Otherwise,
+// Stop would have to wait for a prefetch that's blocked (e.g. waiting for RAM in the CacheLimiter) until the reader's own context was done
+type contextPrefetcher interface {
+	blockingPrefetchWithContext(ctx context.Context, fileReader io.ReaderAt, isRetry bool) error
+}
+
+// contextWithBoth returns a context derived from parent, that is also cancelled when other is done
+func contextWithBoth(parent context.Context, other context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-other.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// NewChunkPrefetcher makes a prefetcher for the given readers, which must be in the order they will be consumed,
+// reading them all from source
+func NewChunkPrefetcher(ctx context.Context, source io.ReaderAt, readers []SingleChunkReader) *ChunkPrefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &ChunkPrefetcher{
+		source:   source,
+		readers:  readers,
+		ctx:      ctx,
+		cancel:   cancel,
+		results:  make(chan chunkPrefetchResult), // unbuffered, so that we never get more than one chunk ahead of the consumer
+		done:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+}
+
+// Start begins prefetching in the background
+func (p *ChunkPrefetcher) Start() {
+	if p.isStarted {
+		return
+	}
+	p.isStarted = true
+	go p.prefetchAll()
+}
+
+func (p *ChunkPrefetcher) prefetchAll() {
+	defer close(p.done)
+	defer close(p.results)
+
+	for i, reader := range p.readers {
+		err := p.prefetch(reader)
+
+		select {
+		case p.results <- chunkPrefetchResult{reader: reader, err: err}:
+			if err != nil {
+				p.closeReaders(i + 1) // the consumer won't get any more, so we must close the rest
+				return
+			}
+		case <-p.ctx.Done():
+			p.closeReaders(i) // including this one, since we never handed it over
+			return
+		}
+	}
+}
+
+// prefetch prefetches the reader's data, stopping early if the prefetcher is stopped, if the reader supports that
+func (p *ChunkPrefetcher) prefetch(reader SingleChunkReader) error {
+	if r, ok := reader.(contextPrefetcher); ok {
+		return r.blockingPrefetchWithContext(p.ctx, p.source, false)
+	}
+	return reader.BlockingPrefetch(p.source, false)
+}
+
+func (p *ChunkPrefetcher) closeReaders(startIndex int) {
+	for _, reader := range p.readers[startIndex:] {
+		_ = reader.Close()
+	}
+}
+
+// Next returns the next chunk reader, once its data has been prefetched.
+// It returns io.EOF when there are no more readers, or the prefetch error if the prefetch failed. In that case, the reader
+// is returned too, so the caller can close it; and no further readers will be returned.
+func (p *ChunkPrefetcher) Next() (SingleChunkReader, error) {
+	if p.finalError != nil {
+		return nil, p.finalError
+	}
+
+	select {
+	case result, ok := <-p.results:
+		if !ok {
+			p.finalError = io.EOF
+			if p.handedOut < len(p.readers) && p.ctx.Err() != nil {
+				p.finalError = p.ctx.Err() // we were stopped or cancelled part way through
+			}
+			return nil, p.finalError
+		}
+		p.handedOut++
+		if result.err != nil {
+			p.finalError = result.err
+		}
+		return result.reader, result.err
+	case <-p.ctx.Done():
+		p.finalError = p.ctx.Err()
+		return nil, p.finalError
+	}
+}
+
+// Stop ends any background prefetching, including a prefetch that's in progress, and waits until the background goroutine has finished.
+// Any readers that were not returned by Next are closed.
+func (p *ChunkPrefetcher) Stop() {
+	p.stopOnce.Do(func() {
+		p.cancel()
+		if p.isStarted {
+			<-p.done
+		} else {
+			p.closeReaders(0)
+		}
+	})
+}
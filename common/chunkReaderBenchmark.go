@@ -0,0 +1,132 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// ChunkReaderFactory makes the reader for one chunk, for MeasureChunkReaderThroughput. It's the place to choose
+// the reader variant, and its options, slice pool and cache limiter
+type ChunkReaderFactory func(ctx context.Context, sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64) SingleChunkReader
+
+// SingleChunkReaderFactory returns a ChunkReaderFactory for ordinary (fully prefetched) chunk readers, with the given options.
+// Buffers come from a pool sized for chunkSize, and are limited to limitBytes in total
+func SingleChunkReaderFactory(chunkSize int64, limitBytes int64, options SingleChunkReaderOptions) ChunkReaderFactory {
+	pool := NewMultiSizeSlicePool(RecommendedMaxSliceLength(uint32Checked(chunkSize)))
+	limiter := NewCacheLimiter(limitBytes)
+	return func(ctx context.Context, sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64) SingleChunkReader {
+		return NewSingleChunkReaderWithOptions(ctx, sourceFactory, chunkId, length, silentChunkStatusLogger{}, silentLogger{}, pool, limiter, options)
+	}
+}
+
+// The results of one run of MeasureChunkReaderThroughput
+type ChunkReaderThroughput struct {
+	Chunks  int
+	Bytes   int64
+	Elapsed time.Duration
+
+	// heap allocations made during the run, by everything in the process (so keep other work to a minimum while measuring)
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+// MBPerSecond returns the throughput in megabytes (of 1024*1024 bytes) per second
+func (t ChunkReaderThroughput) MBPerSecond() float64 {
+	if t.Elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Bytes) / (1024 * 1024) / t.Elapsed.Seconds()
+}
+
+func (t ChunkReaderThroughput) String() string {
+	return fmt.Sprintf("%d chunks, %d bytes in %v (%.1f MB/s), %d allocs of %d bytes", t.Chunks, t.Bytes, t.Elapsed, t.MBPerSecond(), t.Allocs, t.AllocBytes)
+}
+
+// MeasureChunkReaderThroughput reads chunkCount chunks of chunkSize bytes from the file at filePath, using readers from newReader,
+// in the same way as an upload does: prefetch each chunk, read it to the end, and close it. The chunks are read in order,
+// and wrap around to the start of the file if they get to the end, so a small file can be used for a long run (although
+// the OS will then serve it from its cache). It's for comparing reader variants, and their settings, on real hardware.
+// E.g. call it from a Go benchmark, with a file made by the benchmark's setup.
+func MeasureChunkReaderThroughput(filePath string, chunkSize int64, chunkCount int, newReader ChunkReaderFactory) (ChunkReaderThroughput, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return ChunkReaderThroughput{}, err
+	}
+	if chunkSize <= 0 || info.Size() < chunkSize {
+		return ChunkReaderThroughput{}, fmt.Errorf("cannot read chunks of %d bytes from %s, which is %d bytes", chunkSize, filePath, info.Size())
+	}
+	chunksInFile := info.Size() / chunkSize
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ChunkReaderThroughput{}, err
+	}
+	defer file.Close()
+	sourceFactory := func() (CloseableReaderAt, error) { return os.Open(filePath) }
+
+	ctx := context.Background()
+	result := ChunkReaderThroughput{Chunks: chunkCount}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for i := 0; i < chunkCount; i++ {
+		chunkId := NewChunkID(filePath, (int64(i)%chunksInFile)*chunkSize, chunkSize)
+		reader := newReader(ctx, sourceFactory, chunkId, chunkSize)
+		if err = reader.BlockingPrefetch(file, false); err != nil {
+			reader.Close()
+			return ChunkReaderThroughput{}, err
+		}
+		n, err := io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return ChunkReaderThroughput{}, err
+		}
+		result.Bytes += n
+	}
+
+	result.Elapsed = time.Since(start)
+	runtime.ReadMemStats(&after)
+	result.Allocs = after.Mallocs - before.Mallocs
+	result.AllocBytes = after.TotalAlloc - before.TotalAlloc
+	return result, nil
+}
+
+// loggers that log nothing, for measuring without the cost of logging
+type silentChunkStatusLogger struct{}
+
+func (silentChunkStatusLogger) LogChunkStatus(id ChunkID, reason WaitReason) {}
+func (silentChunkStatusLogger) IsWaitingOnFinalBodyReads() bool              { return false }
+
+type silentLogger struct{}
+
+func (silentLogger) ShouldLog(level pipeline.LogLevel) bool  { return false }
+func (silentLogger) Log(level pipeline.LogLevel, msg string) {}
+func (silentLogger) Panic(err error)                         { panic(err) }
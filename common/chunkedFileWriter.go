@@ -157,9 +157,13 @@ func (w *chunkedFileWriter) EnqueueChunk(ctx context.Context, id ChunkID, chunkS
 	}
 
 	// read into a buffer
-	buffer := w.slicePool.RentSlice(uint32(chunkSize))
+	buffer, err := rentSliceChecked(w.slicePool, chunkSize)
+	if err != nil {
+		close(readDone)
+		return err
+	}
 	readStart := time.Now()
-	_, err := io.ReadFull(chunkContents, buffer)
+	_, err = io.ReadFull(chunkContents, buffer)
 	close(readDone)
 	if err != nil {
 		return err
@@ -0,0 +1,95 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// coalescingReaderAt turns many small ReadAt calls, for adjacent parts of the same file, into fewer large ones.
+// When a read is not already covered by what it has buffered, it reads readSize bytes from that point on,
+// so that the following chunks (which are usually prefetched in file order) can be served from RAM.
+// That replaces lots of small reads with one big sequential one, which is much faster on (e.g.) HDDs.
+// Buffered data is only used for up to maxAge, so that we don't hang on to stale data when the
+// reads for the following chunks don't come soon (or at all).
+// Reads that are as big as readSize, or bigger, are passed straight through.
+// Note that the buffer is outside the accounting of the CacheLimiter, so keep readSize modest.
+type coalescingReaderAt struct {
+	inner    io.ReaderAt
+	readSize int
+	maxAge   time.Duration
+
+	mu           *sync.Mutex
+	buffer       []byte
+	bufferOffset int64 // offset in file of buffer[0]
+	bufferLen    int   // number of valid bytes in buffer
+	filledAt     time.Time
+}
+
+// NewCoalescingReaderAt wraps inner, so that multiple chunk readers can prefetch from it with fewer, larger, reads
+func NewCoalescingReaderAt(inner io.ReaderAt, readSize int, maxAge time.Duration) io.ReaderAt {
+	return &coalescingReaderAt{
+		inner:    inner,
+		readSize: readSize,
+		maxAge:   maxAge,
+		mu:       &sync.Mutex{},
+	}
+}
+
+func (c *coalescingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) >= c.readSize {
+		return c.inner.ReadAt(p, off)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.covers(off, len(p)) {
+		if c.buffer == nil {
+			c.buffer = make([]byte, c.readSize)
+		}
+		n, err := c.inner.ReadAt(c.buffer, off)
+		if err != nil && err != io.EOF {
+			c.bufferLen = 0
+			return 0, err
+		}
+		c.bufferOffset = off
+		c.bufferLen = n
+		c.filledAt = time.Now()
+	}
+
+	start := int(off - c.bufferOffset)
+	n := copy(p, c.buffer[start:c.bufferLen])
+	if n < len(p) {
+		return n, io.EOF // the file ended before the end of p
+	}
+	return n, nil
+}
+
+// covers says whether the whole of the requested range is in the buffer, and fresh enough to use
+func (c *coalescingReaderAt) covers(off int64, length int) bool {
+	return c.bufferLen > 0 &&
+		off >= c.bufferOffset &&
+		off+int64(length) <= c.bufferOffset+int64(c.bufferLen) &&
+		time.Since(c.filledAt) <= c.maxAge
+}
@@ -0,0 +1,187 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"hash"
+	"io"
+)
+
+// concatChunkReader is a SingleChunkReader for a chunk that consists of an in-memory header, followed by a region of a file.
+// E.g. for uploads where a computed header must be prepended to the file's data, without staging the combination in a temp file.
+// The file region is read by an ordinary singleChunkReader, so it's prefetched, re-read on retries, and accounted for in the
+// CacheLimiter, as usual. The header is always in RAM, and is not counted by the CacheLimiter.
+type concatChunkReader struct {
+	header []byte
+	body   SingleChunkReader
+
+	// position for Seek/Read, in the chunk as a whole
+	positionInChunk int64
+
+	// cached result of ChunkMD5
+	md5 []byte
+}
+
+// NewConcatChunkReader makes a reader for header followed by the length bytes of the file that start at chunkId's offset.
+// The header must not be modified while the reader is in use.
+func NewConcatChunkReader(ctx context.Context, header []byte, sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64, chunkLogger ChunkStatusLogger, generalLogger ILogger, slicePool ByteSlicePooler, cacheLimiter CacheLimiter) SingleChunkReader {
+	return &concatChunkReader{
+		header: header,
+		body:   NewSingleChunkReader(ctx, sourceFactory, chunkId, length, chunkLogger, generalLogger, slicePool, cacheLimiter),
+	}
+}
+
+func (cr *concatChunkReader) headerLength() int64 {
+	return int64(len(cr.header))
+}
+
+func (cr *concatChunkReader) BlockingPrefetch(fileReader io.ReaderAt, isRetry bool) error {
+	return cr.body.BlockingPrefetch(fileReader, isRetry)
+}
+
+func (cr *concatChunkReader) PrefetchAsync(fileReader io.ReaderAt, isRetry bool) <-chan error {
+	return cr.body.PrefetchAsync(fileReader, isRetry)
+}
+
+func (cr *concatChunkReader) Seek(offset int64, whence int) (int64, error) {
+	newPosition := cr.positionInChunk
+
+	switch whence {
+	case io.SeekStart:
+		newPosition = offset
+	case io.SeekCurrent:
+		newPosition += offset
+	case io.SeekEnd:
+		newPosition = cr.Length() - offset
+	}
+
+	if newPosition < 0 {
+		return 0, errors.New("cannot seek to before beginning")
+	}
+	if newPosition > cr.Length() {
+		newPosition = cr.Length()
+	}
+
+	// keep the body's position in step, so that it's in the right place when reads get past the header
+	if err := cr.syncBodyPosition(newPosition); err != nil {
+		return 0, err
+	}
+	cr.positionInChunk = newPosition
+	return cr.positionInChunk, nil
+}
+
+// syncBodyPosition seeks the body to the place that corresponds to the given position in the chunk as a whole
+func (cr *concatChunkReader) syncBodyPosition(positionInChunk int64) error {
+	positionInBody := positionInChunk - cr.headerLength()
+	if positionInBody < 0 {
+		positionInBody = 0
+	}
+	_, err := cr.body.Seek(positionInBody, io.SeekStart)
+	return err
+}
+
+func (cr *concatChunkReader) Read(p []byte) (n int, err error) {
+	if cr.positionInChunk >= cr.Length() {
+		return 0, io.EOF
+	}
+
+	// the header. We don't go on into the body in the same call, since short reads are fine
+	if cr.positionInChunk < cr.headerLength() {
+		n = copy(p, cr.header[cr.positionInChunk:])
+		cr.positionInChunk += int64(n)
+		if cr.positionInChunk >= cr.Length() {
+			return n, io.EOF // there's no body
+		}
+		return n, nil
+	}
+
+	// the body, which frees its buffer at EOF, like any other chunk
+	n, err = cr.body.Read(p)
+	cr.positionInChunk += int64(n)
+	return n, err
+}
+
+func (cr *concatChunkReader) ReadVectored(bufs [][]byte) (int, error) {
+	return readVectored(cr.Read, bufs)
+}
+
+func (cr *concatChunkReader) Close() error {
+	return cr.body.Close()
+}
+
+func (cr *concatChunkReader) GetPrologueState() PrologueState {
+	const mimeRecognitionLen = 512
+	leadingBytes := make([]byte, 0, mimeRecognitionLen)
+	leadingBytes = append(leadingBytes, cr.header...)
+	if len(leadingBytes) >= mimeRecognitionLen {
+		return PrologueState{LeadingBytes: leadingBytes[:mimeRecognitionLen]}
+	}
+
+	bodyLeadingBytes := cr.body.GetPrologueState().LeadingBytes
+	leadingBytes = append(leadingBytes, bodyLeadingBytes...)
+	if len(leadingBytes) > mimeRecognitionLen {
+		leadingBytes = leadingBytes[:mimeRecognitionLen]
+	}
+
+	// the body rewinds itself after sniffing, which may not be where we are
+	_ = cr.syncBodyPosition(cr.positionInChunk)
+	return PrologueState{LeadingBytes: leadingBytes}
+}
+
+func (cr *concatChunkReader) HasPrefetchedEntirelyZeros() bool {
+	for _, b := range cr.header {
+		if b != 0 {
+			return false
+		}
+	}
+	return cr.body.HasPrefetchedEntirelyZeros()
+}
+
+func (cr *concatChunkReader) Length() int64 {
+	return cr.headerLength() + cr.body.Length()
+}
+
+func (cr *concatChunkReader) WriteBufferTo(h hash.Hash) {
+	_, err := h.Write(cr.header)
+	if err != nil {
+		panic("documentation of hash.Hash.Write says it will never return an error")
+	}
+	cr.body.WriteBufferTo(h)
+}
+
+func (cr *concatChunkReader) ChunkMD5() ([]byte, error) {
+	if cr.md5 != nil {
+		return cr.md5, nil
+	}
+
+	// the body's own hash is no use to us, but getting it makes sure the body is prefetched. (Nothing else asks the body
+	// for its hash, so it hasn't cached one already, and so it really does check its buffer, and re-read it if necessary)
+	if _, err := cr.body.ChunkMD5(); err != nil {
+		return nil, err
+	}
+	h := md5.New()
+	cr.WriteBufferTo(h)
+	cr.md5 = h.Sum(nil)
+	return cr.md5, nil
+}
@@ -208,7 +208,11 @@ func CreateS3Credential(ctx context.Context, credInfo CredentialInfo, options Cr
 		}
 
 		// create and return s3 credential
-		return credentials.NewStaticV4(accessKeyID, secretAccessKey, sessionToken), nil // S3 uses V4 signature
+		credential := credentials.NewStaticV4(accessKeyID, secretAccessKey, sessionToken) // S3 uses V4 signature
+		if credInfo.S3CredentialInfo.AssumeRole.RoleARN != "" {
+			return newS3AssumeRoleCredential(credential, credInfo.S3CredentialInfo.AssumeRole), nil
+		}
+		return credential, nil
 	default:
 		options.panicError(fmt.Errorf("invalid state, credential type %v is not supported", credInfo.CredentialType))
 	}
@@ -246,7 +250,16 @@ func CreateS3Client(ctx context.Context, credInfo CredentialInfo, option Credent
 		return nil, err
 	}
 
-	return minio.NewWithCredentials(credInfo.S3CredentialInfo.Endpoint, credential, true, credInfo.S3CredentialInfo.Region)
+	client, err := minio.NewWithCredentials(credInfo.S3CredentialInfo.Endpoint, credential, true, credInfo.S3CredentialInfo.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	if credInfo.S3CredentialInfo.RequesterPays {
+		client.SetCustomTransport(&s3RequesterPaysTransport{credential: credential, inner: minio.DefaultTransport})
+	}
+
+	return client, nil
 }
 
 type S3ClientFactory struct {
@@ -21,6 +21,7 @@
 package common
 
 import (
+	"crypto/md5"
 	"errors"
 	"hash"
 	"io"
@@ -34,6 +35,10 @@ func (cr *emptyChunkReader) BlockingPrefetch(fileReader io.ReaderAt, isRetry boo
 	return nil
 }
 
+func (cr *emptyChunkReader) PrefetchAsync(fileReader io.ReaderAt, isRetry bool) <-chan error {
+	return completedPrefetch(nil)
+}
+
 func (cr *emptyChunkReader) Seek(offset int64, whence int) (int64, error) {
 	if whence == io.SeekEnd && offset > 0 || offset < 0 {
 		return 0, errors.New("cannot seek to before beginning")
@@ -45,6 +50,10 @@ func (cr *emptyChunkReader) Read(p []byte) (n int, err error) {
 	return 0, io.EOF
 }
 
+func (cr *emptyChunkReader) ReadVectored(bufs [][]byte) (int, error) {
+	return 0, io.EOF
+}
+
 func (cr *emptyChunkReader) Close() error {
 	return nil
 }
@@ -64,3 +73,8 @@ func (cr *emptyChunkReader) Length() int64 {
 func (cr *emptyChunkReader) WriteBufferTo(h hash.Hash) {
 	return // no content to write
 }
+
+func (cr *emptyChunkReader) ChunkMD5() ([]byte, error) {
+	hash := md5.Sum(nil)
+	return hash[:], nil
+}
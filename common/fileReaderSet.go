@@ -0,0 +1,167 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+)
+
+// FileReaderSet opens a file once, and hands out SingleChunkReaders for ranges of it, all sharing the one file handle.
+// That's safe, since the readers only use ReadAt, which has no shared file position. The handle is closed once the set,
+// and every reader from it, has been closed, in whatever order that happens. So callers don't need to track which
+// readers are still in use (e.g. by retries) before closing the file themselves.
+//
+// Prefetch the readers from the set itself, e.g. reader.BlockingPrefetch(set, false). Retries re-read from the shared handle too.
+type FileReaderSet struct {
+	ctx           context.Context
+	file          *os.File
+	filePath      string
+	fileSize      int64
+	chunkLogger   ChunkStatusLogger
+	generalLogger ILogger
+	slicePool     ByteSlicePooler
+	cacheLimiter  CacheLimiter
+	options       SingleChunkReaderOptions
+
+	mu        *sync.Mutex
+	openCount int // readers that have not yet been closed, plus one for the set itself, until it's closed
+	isClosed  bool
+}
+
+var errFileReaderSetClosed = errors.New("file reader set has been closed")
+
+// NewFileReaderSet opens the file at filePath, for handing out readers with the given settings
+func NewFileReaderSet(ctx context.Context, filePath string, chunkLogger ChunkStatusLogger, generalLogger ILogger, slicePool ByteSlicePooler, cacheLimiter CacheLimiter, options SingleChunkReaderOptions) (*FileReaderSet, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FileReaderSet{
+		ctx:           ctx,
+		file:          file,
+		filePath:      filePath,
+		fileSize:      info.Size(),
+		chunkLogger:   chunkLogger,
+		generalLogger: generalLogger,
+		slicePool:     slicePool,
+		cacheLimiter:  cacheLimiter,
+		options:       options,
+		mu:            &sync.Mutex{},
+		openCount:     1,
+	}, nil
+}
+
+// FileSize is the size of the file, as it was when the set was made
+func (s *FileReaderSet) FileSize() int64 {
+	return s.fileSize
+}
+
+// ReadAt reads from the shared file handle. It's there so that the set can be passed to the readers' BlockingPrefetch
+func (s *FileReaderSet) ReadAt(p []byte, off int64) (int, error) {
+	return s.file.ReadAt(p, off)
+}
+
+// NewReader returns a reader for length bytes of the file, starting at offset. The caller must Close it.
+// It returns an error if the range runs past the end of the file, or if the set has already been closed.
+func (s *FileReaderSet) NewReader(offset int64, length int64) (SingleChunkReader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed {
+		return nil, errFileReaderSetClosed
+	}
+	sourceFactory := func() (CloseableReaderAt, error) { return sharedFileHandle{s}, nil }
+	reader, err := NewSizeCheckedSingleChunkReader(s.ctx, sourceFactory, NewChunkID(s.filePath, offset, length), length, s.fileSize,
+		s.chunkLogger, s.generalLogger, s.slicePool, s.cacheLimiter, s.options)
+	if err != nil {
+		return nil, err
+	}
+
+	s.openCount++
+	return &fileReaderSetMember{SingleChunkReader: reader, set: s, closeOnce: &sync.Once{}}, nil
+}
+
+// Close stops the set from handing out more readers. The file is closed straight away if no readers are open,
+// or otherwise when the last of them is closed.
+func (s *FileReaderSet) Close() error {
+	s.mu.Lock()
+	if s.isClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.isClosed = true
+	s.mu.Unlock()
+
+	return s.release()
+}
+
+// release gives up one reference to the file, closing it if that was the last one
+func (s *FileReaderSet) release() error {
+	s.mu.Lock()
+	s.openCount--
+	isLast := s.openCount == 0
+	s.mu.Unlock()
+
+	if isLast {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// sharedFileHandle is the source that readers from a FileReaderSet re-read from on retries.
+// Closing it does nothing, since the handle belongs to the set
+type sharedFileHandle struct {
+	set *FileReaderSet
+}
+
+func (h sharedFileHandle) ReadAt(p []byte, off int64) (int, error) {
+	return h.set.ReadAt(p, off)
+}
+
+func (h sharedFileHandle) Close() error {
+	return nil
+}
+
+// fileReaderSetMember is a reader handed out by a FileReaderSet, which gives up its reference to the file when it's closed
+type fileReaderSetMember struct {
+	SingleChunkReader
+	set       *FileReaderSet
+	closeOnce *sync.Once
+}
+
+func (r *fileReaderSetMember) Close() error {
+	err := r.SingleChunkReader.Close()
+	r.closeOnce.Do(func() {
+		if releaseErr := r.set.release(); err == nil {
+			err = releaseErr
+		}
+	})
+	return err
+}
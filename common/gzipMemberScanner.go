@@ -0,0 +1,95 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+)
+
+// A contiguous region of a file
+type FileRange struct {
+	Offset int64
+	Length int64
+}
+
+// FindGzipMemberRanges finds where each member of a (possibly multi-member) gzip file begins and ends.
+// The returned ranges are in file order and cover the whole file, so they can be used as chunk boundaries
+// (e.g. with NewChunkID and NewSingleChunkReader) to make every chunk an independently-decompressible gzip member.
+// The compressed length of a member isn't recorded anywhere in the gzip format, so each member is decompressed
+// (and the output discarded) to find its end. But the whole file never needs to be held, or decompressed, at once.
+func FindGzipMemberRanges(source io.Reader) ([]FileRange, error) {
+	cr := &countingByteReader{r: bufio.NewReader(source)}
+	ranges := make([]FileRange, 0)
+	var zr *gzip.Reader
+
+	for {
+		// stop cleanly if there's nothing after the previous member
+		if _, err := cr.r.Peek(1); err == io.EOF {
+			return ranges, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		start := cr.count
+		var err error
+		if zr == nil {
+			zr, err = gzip.NewReader(cr)
+		} else {
+			err = zr.Reset(cr)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// read just this member, so that cr.count stops exactly at its end
+		zr.Multistream(false)
+		if _, err = io.Copy(ioutil.Discard, zr); err != nil {
+			return nil, err
+		}
+
+		ranges = append(ranges, FileRange{Offset: start, Length: cr.count - start})
+	}
+}
+
+// countingByteReader tracks exactly how many bytes have been consumed from it.
+// Because it's an io.ByteReader, gzip and flate use it directly rather than wrapping it
+// in a buffer of their own, so they never read ahead of the data they actually consume.
+type countingByteReader struct {
+	r     *bufio.Reader
+	count int64
+}
+
+func (c *countingByteReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.count++
+	}
+	return b, err
+}
@@ -0,0 +1,89 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"errors"
+	"hash"
+	"io"
+)
+
+// HashingReadSeeker passes data through from an underlying ReadSeeker (e.g. a SingleChunkReader), hashing it as it goes.
+// E.g. with a CRC64, for a streaming checksum of a chunk that is never held in RAM all at once.
+//
+// The sending pipeline seeks back to the start to retry a chunk, and then reads it all again. So seeking to the start
+// resets the hash, and the hash is recomputed on the re-read, rather than being double counted. Reads from anywhere except
+// where the hash is up to (e.g. after seeking part way in) leave the hash incomplete, and Sum returns an error until the
+// whole chunk has been read again from the start.
+type HashingReadSeeker struct {
+	inner io.ReadSeeker
+	h     hash.Hash
+
+	position   int64 // where the next Read will read from
+	hashedUpTo int64 // the hash covers the bytes before this offset
+	gap        bool  // true if something was read without being hashed, so the hash can't be completed on this pass
+	complete   bool  // true if the hash covers everything, from the start to EOF
+}
+
+var ErrHashIncomplete = errors.New("hash does not cover all the data, since it was not read in one pass from the start to the end")
+
+func NewHashingReadSeeker(inner io.ReadSeeker, h hash.Hash) *HashingReadSeeker {
+	return &HashingReadSeeker{inner: inner, h: h}
+}
+
+func (r *HashingReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.inner.Read(p)
+	if r.position == r.hashedUpTo && !r.gap {
+		r.h.Write(p[:n])
+		r.hashedUpTo += int64(n)
+		if err == io.EOF {
+			r.complete = true
+		}
+	} else if n > 0 {
+		r.gap = true
+	}
+	r.position += int64(n)
+	return n, err
+}
+
+func (r *HashingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	newPosition, err := r.inner.Seek(offset, whence)
+	if err != nil {
+		return newPosition, err
+	}
+	r.position = newPosition
+	if newPosition == 0 {
+		// starting a new pass, e.g. for a retry
+		r.h.Reset()
+		r.hashedUpTo = 0
+		r.gap = false
+		r.complete = false
+	}
+	return newPosition, nil
+}
+
+// Sum returns the hash of all the data, if it has been read from start to end (i.e. to io.EOF) since the last seek to the start
+func (r *HashingReadSeeker) Sum() ([]byte, error) {
+	if !r.complete {
+		return nil, ErrHashIncomplete
+	}
+	return r.h.Sum(nil), nil
+}
@@ -0,0 +1,105 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrRangeNotSupported is returned when the server ignores our Range header and sends the whole object instead.
+// We don't try to cope with that, because it would mean downloading the entire object for every chunk.
+var ErrRangeNotSupported = errors.New("the server does not support HTTP range requests")
+
+// NewHTTPRangeReaderAt returns a reader that reads the object at the given URL with ranged GETs, one per ReadAt call.
+// Nothing is buffered, so callers should read in reasonably large pieces (e.g. whole chunks).
+// If client is nil, http.DefaultClient is used.
+func NewHTTPRangeReaderAt(ctx context.Context, client *http.Client, url string) CloseableReaderAt {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpRangeReaderAt{ctx: ctx, client: client, url: url}
+}
+
+// NewHTTPRangeChunkReader returns a chunk reader for the given range of the object at url,
+// so that chunks can be sent from a remote HTTP source without staging them on local disk
+func NewHTTPRangeChunkReader(ctx context.Context, client *http.Client, url string, chunkId ChunkID, length int64, chunkLogger ChunkStatusLogger, generalLogger ILogger, slicePool ByteSlicePooler, cacheLimiter CacheLimiter) SingleChunkReader {
+	sourceFactory := func() (CloseableReaderAt, error) {
+		return NewHTTPRangeReaderAt(ctx, client, url), nil
+	}
+	return NewSingleChunkReader(ctx, sourceFactory, chunkId, length, chunkLogger, generalLogger, slicePool, cacheLimiter)
+}
+
+type httpRangeReaderAt struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+}
+
+func (r *httpRangeReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(r.ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// what we want
+	case http.StatusRequestedRangeNotSatisfiable:
+		// offset is at or past the end of the object
+		return 0, io.EOF
+	case http.StatusOK:
+		return 0, ErrRangeNotSupported
+	default:
+		return 0, fmt.Errorf("unexpected status %d (%s) reading range at offset %d of %s", resp.StatusCode, resp.Status, off, r.url)
+	}
+
+	var start int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != off {
+		return 0, fmt.Errorf("server returned the wrong range (Content-Range '%s') when reading offset %d of %s", resp.Header.Get("Content-Range"), off, r.url)
+	}
+
+	n, err = io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		// short body means we reached the end of the object, which io.ReaderAt reports as io.EOF
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *httpRangeReaderAt) Close() error {
+	return nil // nothing held open between reads
+}
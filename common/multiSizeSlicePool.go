@@ -21,7 +21,14 @@
 package common
 
 import (
+	"fmt"
 	"math/bits"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/JeffreyRichter/enum/enum"
 )
 
 // A pool of byte slices
@@ -32,6 +39,126 @@ type ByteSlicePooler interface {
 	Prune()
 }
 
+// A ByteSlicePooler that pools by size, with extra methods for inspecting and managing its slots
+type MultiSizeSlicePooler interface {
+	ByteSlicePooler
+
+	// Describe returns a snapshot of the layout and occupancy of each slot, in slot order
+	Describe() []SlotDescription
+
+	// String formats the result of Describe, one line per slot
+	String() string
+
+	// StatsAndReset returns the activity counts of each slot, in slot order, and sets them back to zero.
+	// Each counter is read and zeroed atomically, so no activity is ever lost or double counted between intervals.
+	StatsAndReset() []SlicePoolStats
+
+	// PoolStats returns the activity counts of each slot, in slot order, since the pool was made. Unlike StatsAndReset,
+	// it doesn't reset anything, so it can be called from anywhere (e.g. a debugging endpoint) without upsetting whatever is
+	// calling StatsAndReset. Use TotalSlicePoolStats to add up the slots
+	PoolStats() []SlicePoolStats
+
+	// RentSliceRoundedUp rents a slice with len 0 and all the capacity of the slot that minSize rounds up to (i.e. the next power of 2),
+	// and returns that capacity too. It's for callers that build variable-length content by appending, so that they know up front how much
+	// they can append without reallocating. In a pool that rounds down, the capacity may be more than the power of 2, if a bigger slice
+	// was pooled in the slot. Like RentSlice, it panics if minSize exceeds the pool's MaxRentSize (see TryRentSlice).
+	RentSliceRoundedUp(minSize uint32) (buf []byte, capacity int)
+
+	// RentSliceZeroed is like RentSlice, except that the returned slice is guaranteed to read as all zeros, up to its len.
+	// Use it when the buffer may only be partly filled before it's used, e.g. for encryption or logging, so that old data
+	// from the slice's previous use can't leak out. Like RentSlice, it panics if desiredLength exceeds the pool's MaxRentSize (see TryRentSlice).
+	RentSliceZeroed(desiredLength uint32) []byte
+
+	// TryRentSlice is like RentSlice, except that it returns an error if desiredLength exceeds the pool's MaxRentSize. The other rent methods
+	// can't return an error, so they panic instead. So callers that rent a size that comes from configuration, or from the data, should use this
+	// (see rentSliceChecked).
+	TryRentSlice(desiredLength uint32) ([]byte, error)
+
+	// LargestRentSize returns the largest length that has been asked for, so far, from RentSlice or TryRentSlice
+	LargestRentSize() uint32
+
+	// DrainIdle empties every slot that nothing has been rented from, or returned to, for at least idleFor.
+	// It returns the number of slices that were released. Call it periodically, so that memory held in slots for sizes
+	// that are no longer in use can be reclaimed.
+	DrainIdle(idleFor time.Duration) int
+
+	// Drain empties every slot, however recently it was used, so that the GC can reclaim all the pooled memory, e.g. when a big job
+	// has finished and the process carries on. It returns the number of slices that were released. It's safe to call while
+	// rents and returns are going on, although the slots may then not be empty by the time it returns.
+	Drain() int
+
+	// SwapSlice returns old to the pool and rents a slice of desiredSize, in one call. If old would be pooled in the
+	// slot that the rent would come from, and is big enough, it's handed straight back, without going through the pool at all.
+	// old may be nil (or empty), in which case it's just a rent.
+	// Like RentSlice, it panics if desiredSize exceeds the pool's MaxRentSize (see TryRentSlice).
+	SwapSlice(old []byte, desiredSize uint32) []byte
+
+	// WouldPool says whether a slice of the given capacity, if returned now, would be kept by the pool, rather than dropped
+	// because its slot is full (or because there is no slot for it, or, in a pool that rounds up, because it's not the exact capacity of its slot).
+	// It's only a hint, since other goroutines may rent or return in the meantime.
+	WouldPool(capacity uint32) bool
+
+	// RebuildSlot replaces the given slot's store of pooled slices with a new, empty, one, and leaves the old one, and the slices in it,
+	// for the GC. E.g. to recover if slices of the wrong capacity have got into the slot. Rents and returns may carry on while it runs:
+	// any that were already using the old store finish with it, so a slice returned at that moment may be dropped.
+	// It panics if slotIndex is out of range.
+	RebuildSlot(slotIndex int)
+
+	// Snapshot returns how many slices, and bytes of capacity, are pooled in each slot. Unlike Describe, which uses the
+	// lengths of the slots' channels, it reads counters that are kept alongside them, so it's exact, as of when each slot is read,
+	// apart from rents and returns that are in progress at that moment. It doesn't lock, so the slots are read one after another,
+	// but in quick succession.
+	Snapshot() SlicePoolSnapshot
+}
+
+// Counts of the activity in one slot of a pool
+type SlicePoolStats struct {
+	Hits   int64 // rents that were served from the pool
+	Misses int64 // rents that had to allocate a new slice
+	Drops  int64 // returns that were thrown away, because the slot was full
+}
+
+// TotalSlicePoolStats adds up the counts of all the slots in stats, e.g. as returned by PoolStats
+func TotalSlicePoolStats(stats []SlicePoolStats) SlicePoolStats {
+	total := SlicePoolStats{}
+	for _, slotStats := range stats {
+		total.Hits += slotStats.Hits
+		total.Misses += slotStats.Misses
+		total.Drops += slotStats.Drops
+	}
+	return total
+}
+
+// The occupancy of a pool, from MultiSizeSlicePooler.Snapshot
+type SlicePoolSnapshot struct {
+	Taken time.Time
+
+	// by slot index
+	PooledCounts []int64
+	PooledBytes  []int64
+}
+
+// TotalPooledBytes is the total capacity of all the slices in the pool, i.e. the RAM that it's holding on to
+func (s SlicePoolSnapshot) TotalPooledBytes() int64 {
+	total := int64(0)
+	for _, b := range s.PooledBytes {
+		total += b
+	}
+	return total
+}
+
+// The layout and current occupancy of one slot in a MultiSizeSlicePooler
+type SlotDescription struct {
+	Index int
+
+	// The cap of the slices in this slot. When rounding down, this is the minimum, and slices may have up to double this
+	SliceCapacity int
+
+	// How many slices are currently pooled in the slot, and how many it can hold
+	PooledCount    int
+	MaxPooledCount int
+}
+
 // Pools byte slices of a single size.
 // We are not using sync.Pool because it reserves the right
 // to ignore is contents and pretend to be empty. That's OK if
@@ -44,30 +171,104 @@ type ByteSlicePooler interface {
 // can be better for low-contention cases - which is what we believe ours to be:
 // https://github.com/golang/go/issues/22950
 type simpleSlicePool struct {
+	// The int64s that are accessed atomically must come first, so that they are 64-bit aligned on 32-bit platforms.
+	// See the bugs section of https://golang.org/pkg/sync/atomic/
+
+	// activity counters, since the pool was made. Must be accessed atomically
+	hits   int64
+	misses int64
+	drops  int64
+
+	// the values of the activity counters that StatsAndReset last reported, so that it can report the changes since then.
+	// Must be accessed atomically
+	reportedHits   int64
+	reportedMisses int64
+	reportedDrops  int64
+
+	// time of the last rent or return, in UnixNano. Must be accessed atomically
+	lastAccess int64
+
+	// holds a *slotStore, which RebuildSlot may replace at any time. So read it with store(), rather than directly
+	s atomic.Value
+}
+
+// slotStore holds the pooled slices of a slot, with counts that are kept alongside the channel, since len() of a channel
+// that's in concurrent use is only approximate. A returned slice is counted before it goes into the channel, and a rented one
+// after it comes out, so the counts are never less than what's in the channel, and only more by rents and returns that are in progress.
+// The counts belong to the store, so that returns that finish with an old store, after RebuildSlot, can't upset the new one's.
+type slotStore struct {
+	// these come first, so that they are 64-bit aligned on 32-bit platforms, as sync/atomic requires
+	pooledCount int64 // Must be accessed atomically
+	pooledBytes int64 // total cap of the pooled slices. Must be accessed atomically
+
 	c chan []byte
 }
 
 func newSimpleSlicePool(maxCapacity int) *simpleSlicePool {
-	return &simpleSlicePool{
-		c: make(chan []byte, maxCapacity),
+	p := &simpleSlicePool{
+		lastAccess: time.Now().UnixNano(),
 	}
+	p.s.Store(&slotStore{c: make(chan []byte, maxCapacity)})
+	return p
+}
+
+func (p *simpleSlicePool) store() *slotStore {
+	return p.s.Load().(*slotStore)
+}
+
+func (p *simpleSlicePool) channel() chan []byte {
+	return p.store().c
+}
+
+// rebuild swaps in a new, empty, store of the same capacity
+func (p *simpleSlicePool) rebuild() {
+	p.s.Store(&slotStore{c: make(chan []byte, cap(p.channel()))})
+}
+
+// touch records that the pool is in use. We do this on rents and returns, rather than in Get and Put,
+// since Prune and DrainIdle call Get too, and they must not make the slot look busy.
+func (p *simpleSlicePool) touch() {
+	atomic.StoreInt64(&p.lastAccess, time.Now().UnixNano())
+}
+
+func (p *simpleSlicePool) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastAccess))
 }
 
 func (p *simpleSlicePool) Get() []byte {
+	store := p.store()
 	select {
-	case existingItem := <-p.c:
+	case existingItem := <-store.c:
+		atomic.AddInt64(&store.pooledCount, -1)
+		atomic.AddInt64(&store.pooledBytes, -int64(cap(existingItem)))
 		return existingItem
 	default:
 		return nil
 	}
 }
 
+// drain empties the pool, and returns how many slices it released. It takes no more than the capacity of the pool,
+// so that it can't go on forever if slices are being returned as fast as it takes them
+func (p *simpleSlicePool) drain() int {
+	drained := 0
+	for drained < cap(p.channel()) && p.Get() != nil {
+		drained++
+	}
+	return drained
+}
+
 func (p *simpleSlicePool) Put(b []byte) {
+	store := p.store()
+	atomic.AddInt64(&store.pooledCount, 1)
+	atomic.AddInt64(&store.pooledBytes, int64(cap(b)))
 	select {
-	case p.c <- b:
+	case store.c <- b:
 		return
 	default:
-		// just throw b away and let it get GC'd if p.c is full
+		// just throw b away and let it get GC'd if the channel is full
+		atomic.AddInt64(&store.pooledCount, -1)
+		atomic.AddInt64(&store.pooledBytes, -int64(cap(b)))
+		atomic.AddInt64(&p.drops, 1)
 	}
 }
 
@@ -80,17 +281,115 @@ type multiSizeSlicePool struct {
 	// It is safe for multiple readers to read this, once we have populated it
 	// See https://groups.google.com/forum/#!topic/golang-nuts/nL8z96SXcDs
 	poolsBySize []*simpleSlicePool
+
+	// how lengths that are not exact powers of 2 are mapped to slots
+	rounding SlotRounding
+
+	// largest length that may be rented, or zero for no limit
+	maxRentSize uint32
+
+	// largest length asked for so far. Must be accessed atomically
+	largestRent uint32
+
+	// see SlicePoolOptions.OnRejectedReturn
+	onRejectedReturn func(slice []byte)
+}
+
+// SlotRounding decides which slot is used for a length that is not an exact power of 2.
+//
+// Up (the default) puts the length in the slot above it, and allocates the full power-of-2 capacity of that slot.
+// Every slice in a slot then has the same capacity, so any pooled slice can serve any request for that slot.
+// The cost is RAM: a length just above a power of 2 (e.g. 4 MB + 1 byte) gets nearly double the capacity it needs.
+//
+// Down puts the length in the slot below it, and allocates exactly the requested length.  No RAM is wasted on
+// unused capacity, but the slices in a slot no longer all have the same capacity, so a pooled slice can only be reused
+// if its cap is big enough for the request. If it's not, a new slice is allocated and the pooled one is put back.
+// So reuse is less reliable, particularly when sizes within one slot vary a lot.
+// Use Down when the sizes in use cluster just above powers of 2, and each size tends to be used repeatedly.
+var ESlotRounding = SlotRounding(0)
+
+type SlotRounding uint8
+
+func (SlotRounding) Up() SlotRounding   { return SlotRounding(0) }
+func (SlotRounding) Down() SlotRounding { return SlotRounding(1) }
+
+func (r SlotRounding) String() string {
+	return enum.StringInt(r, reflect.TypeOf(r))
+}
+
+// Optional settings for a multiSizeSlicePool. The zero value gives the default behaviour
+type SlicePoolOptions struct {
+	Rounding SlotRounding
+
+	// If greater than zero, TryRentSlice refuses any rent larger than this. It's a safety rail against misconfiguration (e.g. a giant block size),
+	// since one huge allocation can take down the whole process. The other rent methods can't return an error, so they panic.
+	// The chunk readers all rent through TryRentSlice, so an over-sized chunk fails the transfer, not the process.
+	MaxRentSize uint32
+
+	// If greater than zero, the pool has at most this many slots, however big maxSliceLength is. Slices too big for the
+	// top slot are still rented and returned as usual, but they are not pooled: each rent allocates, and each return drops the slice
+	MaxSlots int
+
+	// If not nil, this is called with each slice that ReturnSlice rejects, e.g. to log the caller's mistake. When rounding up,
+	// ReturnSlice drops any slice whose cap is not exactly the capacity of a slot, rather than pooling it in the slot above,
+	// where the next rent would get less capacity than the slot promises. (Rounding down expects slices of varied capacity,
+	// and checks them on rent.) Dropped slices are counted in the stats, whether or not this is set
+	OnRejectedReturn func(slice []byte)
+
+	// If not nil, this is called once for each slot, when the pool is made, to choose the most slices that the slot may hold.
+	// It gets the slot index and the capacity of the slices in the slot, so that e.g. slots of big slices can be held to a few buffers,
+	// while slots of small ones are generous. A result of zero or less means the slot pools nothing. When nil, the default counts are used
+	SlotCapacity func(slotIndex int, maxCapInSlot int) int
+}
+
+// RecommendedMaxSliceLength returns the maxSliceLength to use for a pool that will hold buffers of blockSize bytes.
+// Slots hold powers of two, so the top slot must be the smallest power of two that is at least as big as the block size.
+// A smaller maxSliceLength means full blocks can't be pooled at all, and a larger one just adds a slot that is never used.
+func RecommendedMaxSliceLength(blockSize uint32) uint32 {
+	if blockSize <= 1 {
+		return 1
+	}
+	if blockSize > 1<<31 {
+		return 1 << 31 // biggest power of two that fits. Blocks this big are far beyond anything the services accept anyway
+	}
+	return 1 << uint(32-bits.LeadingZeros32(blockSize-1))
+}
+
+// Create new slice pool capable of pooling slices up to maxSliceLength in size.
+// When pooling transfer buffers, use RecommendedMaxSliceLength to get maxSliceLength from the block size.
+func NewMultiSizeSlicePool(maxSliceLength uint32) MultiSizeSlicePooler {
+	return NewMultiSizeSlicePoolWithOptions(maxSliceLength, SlicePoolOptions{})
+}
+
+// Create new slice pool capable of pooling slices up to maxSliceLength in size, where capFn decides how many slices each slot may hold.
+// See SlicePoolOptions.SlotCapacity
+func NewMultiSizeSlicePoolWithCapacity(maxSliceLength uint32, capFn func(slotIndex int, maxCapInSlot int) int) MultiSizeSlicePooler {
+	return NewMultiSizeSlicePoolWithOptions(maxSliceLength, SlicePoolOptions{SlotCapacity: capFn})
 }
 
-// Create new slice pool capable of pooling slices up to maxSliceLength in size
-func NewMultiSizeSlicePool(maxSliceLength uint32) ByteSlicePooler {
-	maxSlotIndex, _ := getSlotInfo(maxSliceLength)
-	poolsBySize := make([]*simpleSlicePool, maxSlotIndex+1)
+// Create new slice pool capable of pooling slices up to maxSliceLength in size, with non-default settings
+func NewMultiSizeSlicePoolWithOptions(maxSliceLength uint32, options SlicePoolOptions) MultiSizeSlicePooler {
+	mp := &multiSizeSlicePool{
+		rounding:         options.Rounding,
+		maxRentSize:      options.MaxRentSize,
+		onRejectedReturn: options.OnRejectedReturn,
+	}
+	maxSlotIndex, _ := mp.getSlotInfo(maxSliceLength)
+	if options.MaxSlots > 0 && maxSlotIndex >= options.MaxSlots {
+		maxSlotIndex = options.MaxSlots - 1
+	}
+	mp.poolsBySize = make([]*simpleSlicePool, maxSlotIndex+1)
 	for i := 0; i <= maxSlotIndex; i++ {
 		maxCount := getMaxSliceCountInPool(i)
-		poolsBySize[i] = newSimpleSlicePool(maxCount)
+		if options.SlotCapacity != nil {
+			maxCount = options.SlotCapacity(i, 1<<uint(i))
+			if maxCount < 0 {
+				maxCount = 0
+			}
+		}
+		mp.poolsBySize[i] = newSimpleSlicePool(maxCount)
 	}
-	return &multiSizeSlicePool{poolsBySize: poolsBySize}
+	return mp
 }
 
 var indexOf32KSlot, _ = getSlotInfo(32 * 1024)
@@ -127,6 +426,25 @@ func getSlotInfo(exactSliceLength uint32) (slotIndex int, maxCapInSlot int) {
 	return
 }
 
+// For a given len(slice), this returns the slot index to use when rounding down.
+// With rounding down, slices in a slot have a cap of at least minCapInSlot, and less than double that.
+func getSlotInfoRoundedDown(exactSliceLength uint32) (slotIndex int, minCapInSlot int) {
+	if exactSliceLength <= 0 {
+		panic("exact slice length must be greater than zero")
+	}
+	slotIndex = 31 - bits.LeadingZeros32(exactSliceLength) // base-2 logarithm, rounded down
+	minCapInSlot = 1 << uint(slotIndex)
+	return
+}
+
+// getSlotInfo returns the slot index for the given length, using the rounding strategy of this pool
+func (mp *multiSizeSlicePool) getSlotInfo(exactSliceLength uint32) (slotIndex int, capInSlot int) {
+	if mp.rounding == ESlotRounding.Down() {
+		return getSlotInfoRoundedDown(exactSliceLength)
+	}
+	return getSlotInfo(exactSliceLength)
+}
+
 func holdsSmallSlices(slotIndex int) bool {
 	return slotIndex <= indexOf32KSlot
 }
@@ -145,15 +463,121 @@ func getMaxSliceCountInPool(slotIndex int) int {
 	}
 }
 
+// When true, every rented slice is checked for the requested length and sufficient capacity.
+// Off by default, since it's only there to make bookkeeping regressions loud in testing.
+var debugCheckRentedSlices = false
+
 // RentSlice borrows a slice from the pool (or creates a new one if none of suitable capacity is available)
 // Note that the returned slice may contain non-zero data - i.e. old data from the previous time it was used.
 // That's safe IFF you are going to do the likes of io.ReadFull to read into it, since you know that all of the
 // old bytes will be overwritten in that case.
 func (mp *multiSizeSlicePool) RentSlice(desiredSize uint32) []byte {
+	mp.checkRentSizeOrPanic(desiredSize)
+	return mp.rentSlice(desiredSize)
+}
+
+// RentSliceZeroed borrows a slice, just as RentSlice does, and then zeroes it. RentSlice doesn't promise to clear what comes
+// from the pool, so we do it here, whatever rentSlice does, rather than rely on it.
+func (mp *multiSizeSlicePool) RentSliceZeroed(desiredSize uint32) []byte {
+	mp.checkRentSizeOrPanic(desiredSize)
+	result := mp.rentSlice(desiredSize)
+	for i := range result {
+		result[i] = 0
+	}
+	return result
+}
+
+func (mp *multiSizeSlicePool) RentSliceRoundedUp(minSize uint32) (buf []byte, capacity int) {
+	mp.checkRentSizeOrPanic(minSize)
+	if minSize > 1<<31 {
+		buf = mp.rentSlice(minSize) // the next power of 2 doesn't fit in a uint32, and nothing so big is pooled anyway
+	} else {
+		_, maxCapInSlot := getSlotInfo(minSize)
+		buf = mp.rentSlice(uint32(maxCapInSlot)) // an exact power of 2, so it's in the same slot whichever way we round
+	}
+	return buf[:0], cap(buf)
+}
+
+func (mp *multiSizeSlicePool) TryRentSlice(desiredSize uint32) ([]byte, error) {
+	if err := mp.checkRentSize(desiredSize); err != nil {
+		return nil, err
+	}
+	return mp.rentSlice(desiredSize), nil
+}
+
+func (mp *multiSizeSlicePool) LargestRentSize() uint32 {
+	return atomic.LoadUint32(&mp.largestRent)
+}
+
+// rentSliceChecked rents length bytes from pool, through TryRentSlice if the pool has it, so that an over-sized rent
+// comes back as an error rather than a panic. A nil pool just allocates
+func rentSliceChecked(pool ByteSlicePooler, length int64) ([]byte, error) {
+	if pool == nil {
+		return make([]byte, length), nil
+	}
+	if tryPool, ok := pool.(interface {
+		TryRentSlice(desiredLength uint32) ([]byte, error)
+	}); ok {
+		return tryPool.TryRentSlice(uint32Checked(length))
+	}
+	return pool.RentSlice(uint32Checked(length)), nil
+}
+
+// checkRentSizeOrPanic is checkRentSize, for the rent methods that can't return an error. An over-sized rent panics,
+// so that the limit holds in production too. Callers that can't rule out an over-sized rent use TryRentSlice instead
+func (mp *multiSizeSlicePool) checkRentSizeOrPanic(desiredSize uint32) {
+	if err := mp.checkRentSize(desiredSize); err != nil {
+		panic(err.Error())
+	}
+}
+
+// checkRentSize records desiredSize, for LargestRentSize, and checks it against the maximum
+func (mp *multiSizeSlicePool) checkRentSize(desiredSize uint32) error {
+	for {
+		largest := atomic.LoadUint32(&mp.largestRent)
+		if desiredSize <= largest || atomic.CompareAndSwapUint32(&mp.largestRent, largest, desiredSize) {
+			break
+		}
+	}
+
+	if mp.maxRentSize > 0 && desiredSize > mp.maxRentSize {
+		return fmt.Errorf("cannot rent a slice of %d bytes, because the maximum allowed is %d bytes", desiredSize, mp.maxRentSize)
+	}
+	return nil
+}
+
+func (mp *multiSizeSlicePool) rentSlice(desiredSize uint32) []byte {
+	var result []byte
+	if mp.rounding == ESlotRounding.Down() {
+		result = mp.rentSliceRoundedDown(desiredSize)
+	} else {
+		result = mp.rentSliceRoundedUp(desiredSize)
+	}
+
+	if debugCheckRentedSlices {
+		checkRentedSlice(result, desiredSize)
+	}
+	return result
+}
+
+// checkRentedSlice panics if slice can't safely be used as a buffer of desiredSize bytes.
+// E.g. a too-short slice, handed to io.ReadFull, would silently under-read
+func checkRentedSlice(slice []byte, desiredSize uint32) {
+	if uint32(len(slice)) != desiredSize || uint32(cap(slice)) < desiredSize {
+		panic(fmt.Sprintf("slice pool bookkeeping error: asked for %d bytes, got a slice with len %d and cap %d", desiredSize, len(slice), cap(slice)))
+	}
+}
+
+func (mp *multiSizeSlicePool) rentSliceRoundedUp(desiredSize uint32) []byte {
+
 	slotIndex, maxCapInSlot := getSlotInfo(desiredSize)
 
 	// get the pool that most closely corresponds to the desired size
-	pool := mp.poolsBySize[slotIndex]
+	pool := mp.poolInSlot(slotIndex)
+	if pool == nil {
+		return make([]byte, desiredSize) // too big to pool
+	}
+	pool.touch()
 
 	// try to get a pooled slice
 	if typedSlice := pool.Get(); typedSlice != nil {
@@ -168,24 +592,146 @@ func (mp *multiSizeSlicePool) RentSlice(desiredSize uint32) []byte {
 
 		// here we set len to the exact desired size that was requested
 		typedSlice = typedSlice[0:desiredSize]
+		atomic.AddInt64(&pool.hits, 1)
 		return typedSlice
 	}
 
 	// make a new slice if nothing pooled
+	atomic.AddInt64(&pool.misses, 1)
 	return make([]byte, desiredSize, maxCapInSlot)
 }
 
+// rentSliceRoundedDown is RentSlice for pools that round down. Pooled slices in the slot may be too small
+// for this request, in which case we leave them for someone else and allocate exactly what was asked for.
+func (mp *multiSizeSlicePool) rentSliceRoundedDown(desiredSize uint32) []byte {
+	slotIndex, _ := getSlotInfoRoundedDown(desiredSize)
+	pool := mp.poolInSlot(slotIndex)
+	if pool == nil {
+		return make([]byte, desiredSize) // too big to pool
+	}
+	pool.touch()
+
+	if typedSlice := pool.Get(); typedSlice != nil {
+		if cap(typedSlice) >= int(desiredSize) {
+			typedSlice = typedSlice[0:cap(typedSlice)]
+			for i := range typedSlice {
+				typedSlice[i] = 0
+			}
+			atomic.AddInt64(&pool.hits, 1)
+			return typedSlice[0:desiredSize]
+		}
+		// too small for us, but may suit a smaller request in the same slot
+		pool.Put(typedSlice)
+	}
+
+	atomic.AddInt64(&pool.misses, 1)
+	return make([]byte, desiredSize)
+}
+
+func (mp *multiSizeSlicePool) SwapSlice(old []byte, desiredSize uint32) []byte {
+	mp.checkRentSizeOrPanic(desiredSize)
+
+	if !mp.canReuseDirectly(old, desiredSize) {
+		if cap(old) > 0 { // there's nothing to return if old is nil (e.g. on the first call), and no slot for it anyway
+			mp.ReturnSlice(old)
+		}
+		return mp.rentSlice(desiredSize)
+	}
+
+	// count it as a hit in the slot it would have round-tripped through
+	slotIndex, _ := mp.getSlotInfo(uint32(cap(old)))
+	pool := mp.poolsBySize[slotIndex]
+	pool.touch()
+	atomic.AddInt64(&pool.hits, 1)
+
+	// clear it, just as a rent from the pool would
+	result := old[0:cap(old)]
+	for i := range result {
+		result[i] = 0
+	}
+	result = result[0:desiredSize]
+
+	if debugCheckRentedSlices {
+		checkRentedSlice(result, desiredSize)
+	}
+	return result
+}
+
+// canReuseDirectly says whether old could have come back out of the pool for a rent of desiredSize,
+// if it had been returned first. I.e. it would be returned to the same slot that the rent would use, and it's big enough
+func (mp *multiSizeSlicePool) canReuseDirectly(old []byte, desiredSize uint32) bool {
+	if cap(old) == 0 {
+		return false
+	}
+	returnSlotIndex, _ := mp.getSlotInfo(uint32(cap(old)))
+	rentSlotIndex, capInSlot := mp.getSlotInfo(desiredSize)
+	if returnSlotIndex != rentSlotIndex || mp.poolInSlot(rentSlotIndex) == nil {
+		return false
+	}
+
+	if mp.rounding == ESlotRounding.Down() {
+		return cap(old) >= int(desiredSize)
+	}
+	// when rounding up, pooled slices always have the full capacity of their slot
+	return cap(old) == capInSlot
+}
+
 // returns the slice to its pool
 func (mp *multiSizeSlicePool) ReturnSlice(slice []byte) {
-	slotIndex, _ := getSlotInfo(uint32(cap(slice))) // be sure to use capacity, not length, here
+	slotIndex, capInSlot := mp.getSlotInfo(uint32(cap(slice))) // be sure to use capacity, not length, here
 
 	// get the pool that most closely corresponds to the desired size
-	pool := mp.poolsBySize[slotIndex]
+	pool := mp.poolInSlot(slotIndex)
+	if pool == nil {
+		return // too big to pool, so just leave it for the GC
+	}
+
+	// A slice the caller made themselves may have any cap. If it's not the exact cap of its slot, it must not be pooled there,
+	// since a later rent would slice it up to the slot's capacity, and panic
+	if mp.rounding == ESlotRounding.Up() && cap(slice) != capInSlot {
+		atomic.AddInt64(&pool.drops, 1)
+		if mp.onRejectedReturn != nil {
+			mp.onRejectedReturn(slice)
+		}
+		return
+	}
 
 	// put the slice back into the pool
+	pool.touch()
 	pool.Put(slice)
 }
 
+// poolInSlot returns the pool for the given slot, or nil if the slot index is beyond the top slot
+func (mp *multiSizeSlicePool) poolInSlot(slotIndex int) *simpleSlicePool {
+	if slotIndex >= len(mp.poolsBySize) {
+		return nil
+	}
+	return mp.poolsBySize[slotIndex]
+}
+
+func (mp *multiSizeSlicePool) WouldPool(capacity uint32) bool {
+	if capacity == 0 {
+		return false
+	}
+	slotIndex, capInSlot := mp.getSlotInfo(capacity)
+	pool := mp.poolInSlot(slotIndex)
+	if pool == nil {
+		return false
+	}
+	if mp.rounding == ESlotRounding.Up() && int(capacity) != capInSlot {
+		return false // ReturnSlice would drop it, as above
+	}
+	c := pool.channel()
+	return len(c) < cap(c)
+}
+
+func (mp *multiSizeSlicePool) RebuildSlot(slotIndex int) {
+	if slotIndex < 0 || slotIndex >= len(mp.poolsBySize) {
+		panic(fmt.Sprintf("cannot rebuild slot %d, since the pool only has slots 0 to %d", slotIndex, len(mp.poolsBySize)-1))
+	}
+	mp.poolsBySize[slotIndex].rebuild()
+}
+
 // Prune inactive stuff in all the big slots if due (don't worry about the little ones, they don't eat much RAM)
 // Why do this? Because for the large slot sizes its hard to deal with slots that are full and IDLE.
 // I.e. we were using them, but now we're working with other files in the same job that have different chunk sizes,
@@ -206,3 +752,98 @@ func (mp *multiSizeSlicePool) Prune() {
 		}
 	}
 }
+
+func (mp *multiSizeSlicePool) Describe() []SlotDescription {
+	result := make([]SlotDescription, len(mp.poolsBySize))
+	for index, pool := range mp.poolsBySize {
+		c := pool.channel()
+		result[index] = SlotDescription{
+			Index:          index,
+			SliceCapacity:  1 << uint(index),
+			PooledCount:    len(c),
+			MaxPooledCount: cap(c),
+		}
+	}
+	return result
+}
+
+func (mp *multiSizeSlicePool) Snapshot() SlicePoolSnapshot {
+	result := SlicePoolSnapshot{
+		Taken:        time.Now(),
+		PooledCounts: make([]int64, len(mp.poolsBySize)),
+		PooledBytes:  make([]int64, len(mp.poolsBySize)),
+	}
+	for index, pool := range mp.poolsBySize {
+		store := pool.store()
+		result.PooledCounts[index] = atomic.LoadInt64(&store.pooledCount)
+		result.PooledBytes[index] = atomic.LoadInt64(&store.pooledBytes)
+	}
+	return result
+}
+
+func (mp *multiSizeSlicePool) String() string {
+	sb := strings.Builder{}
+	for _, d := range mp.Describe() {
+		sb.WriteString(fmt.Sprintf("slot %d: %d byte slices, %d of %d pooled\n", d.Index, d.SliceCapacity, d.PooledCount, d.MaxPooledCount))
+	}
+	return sb.String()
+}
+
+func (mp *multiSizeSlicePool) StatsAndReset() []SlicePoolStats {
+	result := make([]SlicePoolStats, len(mp.poolsBySize))
+	for index, pool := range mp.poolsBySize {
+		result[index] = SlicePoolStats{
+			Hits:   takeCountSinceReported(&pool.hits, &pool.reportedHits),
+			Misses: takeCountSinceReported(&pool.misses, &pool.reportedMisses),
+			Drops:  takeCountSinceReported(&pool.drops, &pool.reportedDrops),
+		}
+	}
+	return result
+}
+
+// takeCountSinceReported returns how much counter has gone up since it was last reported, and records its current value as reported.
+// The counter itself is never reset, since PoolStats needs the total
+func takeCountSinceReported(counter *int64, reported *int64) int64 {
+	for {
+		lastReported := atomic.LoadInt64(reported)
+		current := atomic.LoadInt64(counter)
+		if current < lastReported {
+			continue // another caller has just reported a later value than the one we read, so read again
+		}
+		if atomic.CompareAndSwapInt64(reported, lastReported, current) {
+			return current - lastReported
+		}
+	}
+}
+
+func (mp *multiSizeSlicePool) PoolStats() []SlicePoolStats {
+	result := make([]SlicePoolStats, len(mp.poolsBySize))
+	for index, pool := range mp.poolsBySize {
+		result[index] = SlicePoolStats{
+			Hits:   atomic.LoadInt64(&pool.hits),
+			Misses: atomic.LoadInt64(&pool.misses),
+			Drops:  atomic.LoadInt64(&pool.drops),
+		}
+	}
+	return result
+}
+
+func (mp *multiSizeSlicePool) DrainIdle(idleFor time.Duration) int {
+	drained := 0
+	cutoff := time.Now().Add(-idleFor)
+	for _, pool := range mp.poolsBySize {
+		if pool.idleSince().After(cutoff) {
+			continue
+		}
+		drained += pool.drain()
+	}
+	return drained
+}
+
+func (mp *multiSizeSlicePool) Drain() int {
+	drained := 0
+	for _, pool := range mp.poolsBySize {
+		drained += pool.drain()
+	}
+	return drained
+}
@@ -0,0 +1,216 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// PipelinedReader reads a region of an io.ReaderAt sequentially, one window at a time. While Read serves the current window,
+// a background goroutine reads the next one, so a sequential consumer (e.g. a streaming upload) doesn't stall on I/O
+// between windows. Each window in RAM is counted by the CacheLimiter. If the budget is used up, there's no prefetch,
+// and the next window is read when it's needed instead (under the relaxed limit, as for retries), so the reader slows down,
+// rather than stopping. If a window can't be read, Read returns the error, and the next Read tries that window again.
+// Close stops the background read, and releases everything.
+//
+// Like other readers, it's for use by one goroutine at a time.
+type PipelinedReader struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	source       io.ReaderAt
+	fileName     string          // for error messages
+	slicePool    ByteSlicePooler // may be nil
+	cacheLimiter CacheLimiter
+	windowSize   int64
+
+	nextOffset int64 // where the next window that's not yet being read starts
+	end        int64
+
+	current           []byte
+	positionInCurrent int
+
+	pending    chan pipelinedWindow // receives the next window, if a prefetch of it is in progress
+	prefetches *sync.WaitGroup
+	isClosed   bool
+}
+
+type pipelinedWindow struct {
+	offset int64
+	data   []byte
+	err    error
+}
+
+// NewPipelinedReader makes a reader for length bytes of source (which is named fileName, in errors), starting at offset, which reads
+// windowSize bytes at a time. Pass a nil slicePool to allocate the windows without pooling. The first window is prefetched straight away.
+func NewPipelinedReader(ctx context.Context, source io.ReaderAt, fileName string, offset int64, length int64, windowSize int64, slicePool ByteSlicePooler, cacheLimiter CacheLimiter) *PipelinedReader {
+	if windowSize <= 0 {
+		panic("window size must be greater than zero")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &PipelinedReader{
+		ctx:          ctx,
+		cancel:       cancel,
+		source:       source,
+		fileName:     fileName,
+		slicePool:    slicePool,
+		cacheLimiter: cacheLimiter,
+		windowSize:   windowSize,
+		nextOffset:   offset,
+		end:          offset + length,
+		prefetches:   &sync.WaitGroup{},
+	}
+	r.startPrefetch()
+	return r
+}
+
+func (r *PipelinedReader) Read(p []byte) (int, error) {
+	if r.isClosed {
+		return 0, ErrClosedReader
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for r.positionInCurrent >= len(r.current) {
+		r.releaseCurrent()
+		if r.pending == nil && r.nextOffset >= r.end {
+			return 0, io.EOF
+		}
+		if err := r.advance(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.current[r.positionInCurrent:])
+	r.positionInCurrent += n
+	return n, nil
+}
+
+// advance makes the next window the current one, waiting for its prefetch if there is one, or reading it now if not,
+// and then starts the prefetch of the window after it
+func (r *PipelinedReader) advance() error {
+	var window pipelinedWindow
+	if r.pending != nil {
+		window = <-r.pending
+		r.pending = nil
+	} else {
+		length := r.nextWindowLength()
+		err := r.cacheLimiter.WaitUntilAdd(r.ctx, length, func() bool { return true })
+		if err != nil {
+			return err
+		}
+		offset := r.nextOffset
+		r.nextOffset += length
+		window = r.readWindow(offset, length)
+	}
+	if window.err != nil {
+		// nextOffset has already moved past the failed window, and nothing after it is being read, so go back,
+		// so that the next Read tries this window again, rather than carrying on without it
+		r.nextOffset = window.offset
+		return window.err
+	}
+
+	r.current = window.data
+	r.positionInCurrent = 0
+	r.startPrefetch()
+	return nil
+}
+
+// startPrefetch starts reading the next window in the background, if there is one, and the CacheLimiter has room for it
+func (r *PipelinedReader) startPrefetch() {
+	if r.nextOffset >= r.end {
+		return
+	}
+	length := r.nextWindowLength()
+	if !r.cacheLimiter.TryAdd(length, false) {
+		return // no room, so advance will read it when it's needed
+	}
+
+	offset := r.nextOffset
+	r.nextOffset += length
+	pending := make(chan pipelinedWindow, 1)
+	r.pending = pending
+	r.prefetches.Add(1)
+	go func() {
+		defer r.prefetches.Done()
+		pending <- r.readWindow(offset, length)
+	}()
+}
+
+func (r *PipelinedReader) nextWindowLength() int64 {
+	if remaining := r.end - r.nextOffset; remaining < r.windowSize {
+		return remaining
+	}
+	return r.windowSize
+}
+
+// readWindow reads length bytes from offset, which must already have been added to the CacheLimiter.
+// If the read fails, it releases the buffer and the count itself
+func (r *PipelinedReader) readWindow(offset int64, length int64) pipelinedWindow {
+	buffer, err := rentSliceChecked(r.slicePool, length)
+	if err != nil {
+		r.cacheLimiter.Remove(length)
+		return pipelinedWindow{offset: offset, err: err}
+	}
+
+	n, err := readAtRetryingEAGAIN(r.ctx, r.source, buffer, offset)
+	err = checkFullRead(r.fileName, offset, length, n, err)
+	if err != nil {
+		r.releaseWindow(buffer)
+		return pipelinedWindow{offset: offset, err: err}
+	}
+	return pipelinedWindow{offset: offset, data: buffer}
+}
+
+func (r *PipelinedReader) releaseWindow(buffer []byte) {
+	r.cacheLimiter.Remove(int64(len(buffer)))
+	if r.slicePool != nil {
+		r.slicePool.ReturnSlice(buffer)
+	}
+}
+
+func (r *PipelinedReader) releaseCurrent() {
+	if r.current != nil {
+		r.releaseWindow(r.current)
+		r.current = nil
+	}
+}
+
+// Close stops any prefetch (waiting for a read that's already under way to finish), and releases the windows that are in RAM
+func (r *PipelinedReader) Close() error {
+	if r.isClosed {
+		return nil
+	}
+	r.isClosed = true
+
+	r.cancel()
+	r.prefetches.Wait()
+	if r.pending != nil {
+		if window := <-r.pending; window.err == nil {
+			r.releaseWindow(window.data)
+		}
+		r.pending = nil
+	}
+	r.releaseCurrent()
+	return nil
+}
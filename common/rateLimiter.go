@@ -0,0 +1,104 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which something (e.g. bytes read from disk) is used.
+// One instance may be shared by any number of users, e.g. by every chunk reader in the process, across all jobs,
+// so that they stay within one budget between them.
+type RateLimiter interface {
+	// WaitN blocks until n more units may be used, or until ctx is done, in which case it returns ctx's error.
+	// It's safe for concurrent use. n may be bigger than the burst size, in which case the wait is long enough to pay for all n
+	WaitN(ctx context.Context, n int) error
+}
+
+// tokenBucketRateLimiter is a RateLimiter that refills at unitsPerSecond, up to burst units.
+// Each WaitN takes its units straight away, going into debt if there aren't enough, and then waits for the debt to be paid off.
+// So waiters are served in the order they arrive, and a big request can't be starved by a stream of small ones
+type tokenBucketRateLimiter struct {
+	unitsPerSecond float64
+	burst          float64
+
+	mu         *sync.Mutex
+	tokens     float64 // negative when in debt
+	lastRefill time.Time
+}
+
+// NewRateLimiter makes a RateLimiter that allows unitsPerSecond on average, and bursts of up to burst units after a lull
+func NewRateLimiter(unitsPerSecond float64, burst int) RateLimiter {
+	if unitsPerSecond <= 0 {
+		panic("rate must be greater than zero")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucketRateLimiter{
+		unitsPerSecond: unitsPerSecond,
+		burst:          float64(burst),
+		mu:             &sync.Mutex{},
+		tokens:         float64(burst), // so that we don't start slowly
+		lastRefill:     time.Now(),
+	}
+}
+
+func (l *tokenBucketRateLimiter) WaitN(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	l.refill()
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mu.Unlock()
+
+	if debt <= 0 {
+		return nil
+	}
+	wait := time.Duration(debt / l.unitsPerSecond * float64(time.Second))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give back what we took, since we won't use it. Anyone who queued behind us meanwhile will still wait a little longer than necessary
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// refill adds the tokens that have accrued since the last refill, up to the burst size. Call it with mu held
+func (l *tokenBucketRateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.lastRefill).Seconds() * l.unitsPerSecond
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.lastRefill = now
+}
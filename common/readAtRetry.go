@@ -0,0 +1,63 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// How long we'll keep retrying reads that fail with EAGAIN, before giving up
+const eagainRetryTimeout = 30 * time.Second
+
+// readAtRetryingEAGAIN is like ReadAt, except that EAGAIN (which non-blocking special files may return when they
+// have no data ready yet) is treated as transient. We poll, with a growing delay, until the read completes,
+// ctx is cancelled, or eagainRetryTimeout passes. Any other error is returned immediately.
+func readAtRetryingEAGAIN(ctx context.Context, reader io.ReaderAt, p []byte, off int64) (int, error) {
+	const maxDelay = 500 * time.Millisecond
+	delay := 5 * time.Millisecond
+	deadline := time.Now().Add(eagainRetryTimeout)
+	total := 0
+
+	for {
+		n, err := reader.ReadAt(p[total:], off+int64(total))
+		total += n
+		if err == nil || !errors.Is(err, syscall.EAGAIN) {
+			return total, err
+		}
+		if time.Now().After(deadline) {
+			return total, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"sync/atomic"
+)
+
+// the number of histogram buckets. Sizes are uint32s, so they round up to at most 1<<32
+const rentHistogramBucketCount = 33
+
+// One bucket of a rent size histogram
+type RentSizeBucket struct {
+	// the power of 2 that the sizes in this bucket round up to, i.e. the slice capacity of the matching slot, in a pool
+	// that rounds up. The bucket holds the sizes greater than half of this, and up to this
+	SizeClass uint64
+
+	Count int64
+}
+
+// RentHistogramSlicePool wraps a MultiSizeSlicePooler, and counts the sizes that are asked for from RentSlice,
+// RentSliceZeroed, TryRentSlice, RentSliceRoundedUp and SwapSlice, in one bucket per slot. It's for capacity planning, e.g. to choose the maxSliceLength,
+// and the slot capacities, from the sizes that a real job uses. Otherwise, it behaves exactly like the pool it wraps.
+type RentHistogramSlicePool struct {
+	MultiSizeSlicePooler
+
+	// rent counts, by slot index (when rounding up). Must be accessed atomically
+	counts [rentHistogramBucketCount]int64
+}
+
+func NewRentHistogramSlicePool(inner MultiSizeSlicePooler) *RentHistogramSlicePool {
+	return &RentHistogramSlicePool{MultiSizeSlicePooler: inner}
+}
+
+func (p *RentHistogramSlicePool) record(desiredSize uint32) {
+	if desiredSize == 0 {
+		return // the inner pool will panic anyway
+	}
+	slotIndex, _ := getSlotInfo(desiredSize)
+	atomic.AddInt64(&p.counts[slotIndex], 1)
+}
+
+func (p *RentHistogramSlicePool) RentSlice(desiredSize uint32) []byte {
+	p.record(desiredSize)
+	return p.MultiSizeSlicePooler.RentSlice(desiredSize)
+}
+
+func (p *RentHistogramSlicePool) RentSliceZeroed(desiredSize uint32) []byte {
+	p.record(desiredSize)
+	return p.MultiSizeSlicePooler.RentSliceZeroed(desiredSize)
+}
+
+func (p *RentHistogramSlicePool) RentSliceRoundedUp(minSize uint32) ([]byte, int) {
+	p.record(minSize)
+	return p.MultiSizeSlicePooler.RentSliceRoundedUp(minSize)
+}
+
+func (p *RentHistogramSlicePool) TryRentSlice(desiredSize uint32) ([]byte, error) {
+	p.record(desiredSize)
+	return p.MultiSizeSlicePooler.TryRentSlice(desiredSize)
+}
+
+func (p *RentHistogramSlicePool) SwapSlice(old []byte, desiredSize uint32) []byte {
+	p.record(desiredSize)
+	return p.MultiSizeSlicePooler.SwapSlice(old, desiredSize)
+}
+
+// RentSizeHistogram returns the buckets that have had at least one rent, smallest first.
+// The counts are cumulative, since the pool was created
+func (p *RentHistogramSlicePool) RentSizeHistogram() []RentSizeBucket {
+	result := make([]RentSizeBucket, 0)
+	for slotIndex := range p.counts {
+		if count := atomic.LoadInt64(&p.counts[slotIndex]); count > 0 {
+			result = append(result, RentSizeBucket{SizeClass: 1 << uint(slotIndex), Count: count})
+		}
+	}
+	return result
+}
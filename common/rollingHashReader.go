@@ -0,0 +1,115 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"crypto/sha256"
+	"hash"
+	"hash/adler32"
+	"io"
+)
+
+// RollingHashReader passes data through from an underlying reader (e.g. a SingleChunkReader), while computing
+// hashes for deduplication:
+//   - a rolling hash over the last windowSize bytes, as in rsync. Offsets where the rolling hash matches
+//     the boundary mask are recorded, as candidate boundaries for content-defined chunking.
+//     Since the hash only depends on the window, boundaries move with the content when data is inserted or removed earlier on.
+//   - a weak (Adler-32) and strong (SHA-256) hash of everything read, so a whole chunk can be looked up cheaply and then confirmed.
+type RollingHashReader struct {
+	inner        io.Reader
+	windowSize   int
+	boundaryMask uint32
+
+	window   []byte // circular buffer of the last windowSize bytes
+	a, b     uint32 // the two halves of the rolling sum
+	count    int64  // total bytes read
+	weak     hash.Hash32
+	strong   hash.Hash
+	boundary []int64
+}
+
+// NewRollingHashReader wraps inner. A boundary is recorded after each byte at which the hash of the window, ANDed with
+// boundaryMask, is zero. So the mask sets the average distance between boundaries (e.g. 1<<20 - 1 for about 1 MB).
+func NewRollingHashReader(inner io.Reader, windowSize int, boundaryMask uint32) *RollingHashReader {
+	if windowSize <= 0 {
+		panic("rolling hash window size must be greater than zero")
+	}
+	return &RollingHashReader{
+		inner:        inner,
+		windowSize:   windowSize,
+		boundaryMask: boundaryMask,
+		window:       make([]byte, windowSize),
+		weak:         adler32.New(),
+		strong:       sha256.New(),
+	}
+}
+
+func (r *RollingHashReader) Read(p []byte) (int, error) {
+	n, err := r.inner.Read(p)
+	data := p[:n]
+	r.weak.Write(data)
+	r.strong.Write(data)
+
+	for _, in := range data {
+		r.roll(in)
+		if r.count >= int64(r.windowSize) && r.RollingSum()&r.boundaryMask == 0 {
+			r.boundary = append(r.boundary, r.count)
+		}
+	}
+	return n, err
+}
+
+// roll adds a byte to the window, and removes the oldest one, once the window is full
+func (r *RollingHashReader) roll(in byte) {
+	const mod = 1 << 16
+	pos := int(r.count % int64(r.windowSize))
+	if r.count < int64(r.windowSize) {
+		r.a = (r.a + uint32(in)) % mod
+		r.b = (r.b + r.a) % mod
+	} else {
+		out := uint32(r.window[pos])
+		r.a = (r.a + mod - out + uint32(in)) % mod
+		outContribution := (uint32(r.windowSize) * out) % mod // out's weight in b is the window size, since it's been in the window for that many rolls
+		r.b = (r.b + mod - outContribution + r.a) % mod
+	}
+	r.window[pos] = in
+	r.count++
+}
+
+// RollingSum returns the rolling hash of the last windowSize bytes read (or of all the bytes, if fewer have been read)
+func (r *RollingHashReader) RollingSum() uint32 {
+	return r.a | r.b<<16
+}
+
+// Boundaries returns the offsets, from the start of the data, just after each byte at which the rolling hash matched the mask
+func (r *RollingHashReader) Boundaries() []int64 {
+	return append([]int64(nil), r.boundary...)
+}
+
+// WeakSum returns the Adler-32 checksum of all the data read so far
+func (r *RollingHashReader) WeakSum() uint32 {
+	return r.weak.Sum32()
+}
+
+// StrongSum returns the SHA-256 hash of all the data read so far
+func (r *RollingHashReader) StrongSum() []byte {
+	return r.strong.Sum(nil)
+}
@@ -80,6 +80,12 @@ type CredentialInfo struct {
 type S3CredentialInfo struct {
 	Endpoint string
 	Region   string
+
+	// Accept the charges for requests to requester-pays buckets. Without this, S3 rejects our requests to such buckets
+	RequesterPays bool
+
+	// If set, the credentials from the environment are only used to assume this role, and S3 is accessed as the role
+	AssumeRole S3AssumeRoleInfo
 }
 
 type CopyJobPartOrderErrorType string
@@ -0,0 +1,211 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/pkg/credentials"
+)
+
+// The role to assume, to get the credentials for S3. E.g. to work in a partner's AWS account.
+// The zero value means no role is assumed, and the base credentials are used directly.
+type S3AssumeRoleInfo struct {
+	RoleARN     string
+	ExternalID  string // optional. Required by roles that are set up for third party access
+	SessionName string // optional. Identifies our session in the partner's CloudTrail logs
+}
+
+const (
+	defaultS3AssumeRoleSessionName = "azcopy"
+	s3AssumeRoleDuration           = time.Hour
+
+	// refresh this long before the assumed credentials expire, so that a request in flight never uses expired credentials
+	s3AssumeRoleRefreshWindow = 5 * time.Minute
+
+	defaultSTSEndpoint = "https://sts.amazonaws.com"
+	defaultSTSRegion   = "us-east-1" // region used for signing requests to the global STS endpoint
+)
+
+// s3AssumeRoleProvider is a minio credentials provider that gets temporary credentials from STS AssumeRole,
+// using a set of base credentials. minio calls Retrieve again whenever IsExpired is true,
+// so long-running operations get fresh credentials before the current ones expire.
+type s3AssumeRoleProvider struct {
+	credentials.Expiry
+
+	base        *credentials.Credentials
+	role        S3AssumeRoleInfo
+	stsEndpoint string
+	stsRegion   string
+	client      *http.Client
+}
+
+func newS3AssumeRoleCredential(base *credentials.Credentials, role S3AssumeRoleInfo) *credentials.Credentials {
+	return credentials.New(&s3AssumeRoleProvider{
+		base:        base,
+		role:        role,
+		stsEndpoint: defaultSTSEndpoint,
+		stsRegion:   defaultSTSRegion,
+		client:      http.DefaultClient,
+	})
+}
+
+type assumeRoleResponse struct {
+	Result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"Credentials"`
+	} `xml:"AssumeRoleResult"`
+}
+
+func (p *s3AssumeRoleProvider) Retrieve() (credentials.Value, error) {
+	baseValue, err := p.base.Get()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	sessionName := p.role.SessionName
+	if sessionName == "" {
+		sessionName = defaultS3AssumeRoleSessionName
+	}
+	form := url.Values{}
+	form.Set("Action", "AssumeRole")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", p.role.RoleARN)
+	form.Set("RoleSessionName", sessionName)
+	form.Set("DurationSeconds", fmt.Sprintf("%d", int(s3AssumeRoleDuration.Seconds())))
+	if p.role.ExternalID != "" {
+		form.Set("ExternalId", p.role.ExternalID)
+	}
+	body := form.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, p.stsEndpoint, strings.NewReader(body))
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequestV4(req, []byte(body), baseValue, p.stsRegion, "sts", time.Now().UTC())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return credentials.Value{}, fmt.Errorf("cannot assume role %s: %s %s", p.role.RoleARN, resp.Status, string(respBody))
+	}
+
+	var result assumeRoleResponse
+	if err = xml.Unmarshal(respBody, &result); err != nil {
+		return credentials.Value{}, fmt.Errorf("cannot assume role %s, the response could not be parsed: %v", p.role.RoleARN, err)
+	}
+	c := result.Result.Credentials
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return credentials.Value{}, errors.New("cannot assume role " + p.role.RoleARN + ", the response did not contain credentials")
+	}
+
+	p.SetExpiration(c.Expiration, s3AssumeRoleRefreshWindow)
+	return credentials.Value{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// signAWSRequestV4 adds an AWS Signature Version 4 to req, for the given service.
+// We need our own, because minio's signer only signs for S3.
+// The host, x-amz-date, and (if present) content-type and x-amz-security-token headers are signed.
+func signAWSRequestV4(req *http.Request, body []byte, cred credentials.Value, region, service string, t time.Time) {
+	const algorithm = "AWS4-HMAC-SHA256"
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if cred.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cred.SessionToken)
+	}
+
+	// canonical headers, sorted by lower-case name
+	headers := map[string]string{"host": req.URL.Host}
+	for _, name := range []string{"Content-Type", "X-Amz-Date", "X-Amz-Security-Token"} {
+		if value := req.Header.Get(name); value != "" {
+			headers[strings.ToLower(name)] = strings.TrimSpace(value)
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+cred.SecretAccessKey), date), region), service), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, cred.AccessKeyID, scope, signedHeaders, signature))
+}
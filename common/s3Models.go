@@ -64,6 +64,12 @@ func (oie *ObjectInfoExtension) ContentMD5() []byte {
 	return b
 }
 
+// RestoreInProgress says whether header x-amz-restore shows that the object is being restored from an archive storage class
+// (e.g. Glacier). Such objects can't be read until the restore finishes. Once it has, the header says ongoing-request="false".
+func (oie *ObjectInfoExtension) RestoreInProgress() bool {
+	return strings.Contains(oie.ObjectInfo.Metadata.Get("X-Amz-Restore"), `ongoing-request="true"`)
+}
+
 const s3MetadataPrefix = "x-amz-meta-"
 
 const s3MetadataPrefixLen = len(s3MetadataPrefix)
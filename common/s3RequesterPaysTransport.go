@@ -0,0 +1,75 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/minio/minio-go/pkg/s3signer"
+)
+
+// s3RequesterPaysTransport adds the x-amz-request-payer header to every request, so that we can use requester-pays buckets.
+// S3 requires all x-amz-* headers to be signed, but minio-go gives us no way to add headers to
+// some requests (e.g. listings) before it signs them. So we add the header here and then re-sign the request,
+// with the same credentials, and for the same region as the original signature.
+type s3RequesterPaysTransport struct {
+	credential *credentials.Credentials
+	inner      http.RoundTripper
+}
+
+func (t *s3RequesterPaysTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it is given
+	r := req.Clone(req.Context())
+	r.Header.Set("X-Amz-Request-Payer", "requester")
+
+	if region, ok := getSignedRegion(r.Header.Get("Authorization")); ok {
+		v, err := t.credential.Get()
+		if err != nil {
+			return nil, err
+		}
+		r = s3signer.SignV4(*r, v.AccessKeyID, v.SecretAccessKey, v.SessionToken, region)
+	}
+
+	return t.inner.RoundTrip(r)
+}
+
+// getSignedRegion extracts the region from the credential scope of a V4 authorization header.
+// E.g. "AWS4-HMAC-SHA256 Credential=AKID/20190801/us-east-1/s3/aws4_request, SignedHeaders=..., Signature=..."
+func getSignedRegion(authorization string) (string, bool) {
+	const credentialPrefix = "Credential="
+	start := strings.Index(authorization, credentialPrefix)
+	if start < 0 {
+		return "", false // anonymous, or not V4
+	}
+	scope := authorization[start+len(credentialPrefix):]
+	if end := strings.Index(scope, ","); end >= 0 {
+		scope = scope[:end]
+	}
+
+	// scope is access key / date / region / service / terminator
+	parts := strings.Split(scope, "/")
+	if len(parts) != 5 {
+		return "", false
+	}
+	return parts[2], true
+}
@@ -0,0 +1,156 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"crypto/md5"
+	"hash"
+	"io"
+)
+
+// SequentialFileReader reads a file strictly in order, one chunk at a time, re-using ONE buffer for every chunk.
+// It's intended for low-memory, single-threaded uploads, where it avoids all per-chunk pool traffic.
+//
+// WARNING: it is NOT safe for parallel use, or for anything that needs to retry old chunks. Each call to Next
+// overwrites the data seen by the reader returned from the previous call. So only use it when each chunk is completely
+// sent (including any retries) before Next is called again.
+type SequentialFileReader struct {
+	file       io.ReaderAt
+	fileName   string
+	fileSize   int64
+	chunkSize  int64
+	slicePool  ByteSlicePooler // may be nil
+	buffer     []byte
+	nextOffset int64
+}
+
+// NewSequentialFileReader makes a reader for the file, in chunks of chunkSize. Pass a nil slicePool to allocate the buffer
+// without pooling, as for NewSingleChunkReader.
+func NewSequentialFileReader(file io.ReaderAt, fileName string, fileSize int64, chunkSize int64, slicePool ByteSlicePooler) *SequentialFileReader {
+	if chunkSize <= 0 {
+		panic("chunk size must be greater than zero")
+	}
+	return &SequentialFileReader{
+		file:      file,
+		fileName:  fileName,
+		fileSize:  fileSize,
+		chunkSize: chunkSize,
+		slicePool: slicePool,
+	}
+}
+
+// Next reads the next chunk of the file, and returns a reader for it.  Returns io.EOF when there are no more chunks.
+// The returned reader is only valid until the next call to Next (or Close).
+func (r *SequentialFileReader) Next() (ChunkID, SingleChunkReader, error) {
+	if r.nextOffset >= r.fileSize {
+		return ChunkID{}, nil, io.EOF
+	}
+
+	length := r.chunkSize
+	if remaining := r.fileSize - r.nextOffset; remaining < length {
+		length = remaining // last chunk is short
+	}
+
+	if r.buffer == nil {
+		buffer, err := rentSliceChecked(r.slicePool, r.chunkSize)
+		if err != nil {
+			return ChunkID{}, nil, err
+		}
+		r.buffer = buffer
+	}
+	chunkData := r.buffer[:length]
+
+	n, err := r.file.ReadAt(chunkData, r.nextOffset)
+	if err = checkFullRead(r.fileName, r.nextOffset, length, n, err); err != nil {
+		return ChunkID{}, nil, err
+	}
+
+	id := NewChunkID(r.fileName, r.nextOffset, length)
+	r.nextOffset += length
+	return id, &sequentialChunkView{Reader: bytes.NewReader(chunkData), data: chunkData}, nil
+}
+
+// Close returns the shared buffer to the pool, if there is one. All readers returned by Next become invalid.
+func (r *SequentialFileReader) Close() error {
+	if r.buffer != nil && r.slicePool != nil {
+		r.slicePool.ReturnSlice(r.buffer)
+	}
+	r.buffer = nil
+	return nil
+}
+
+// sequentialChunkView is a SingleChunkReader over one chunk in the shared buffer of a SequentialFileReader.
+// Its data is always already in RAM, so there's nothing to prefetch, and nothing to free when it's closed.
+type sequentialChunkView struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (v *sequentialChunkView) BlockingPrefetch(fileReader io.ReaderAt, isRetry bool) error {
+	return nil // already read
+}
+
+func (v *sequentialChunkView) PrefetchAsync(fileReader io.ReaderAt, isRetry bool) <-chan error {
+	return completedPrefetch(nil) // already read
+}
+
+func (v *sequentialChunkView) ReadVectored(bufs [][]byte) (int, error) {
+	return readVectored(v.Read, bufs)
+}
+
+func (v *sequentialChunkView) Close() error {
+	return nil // the buffer belongs to the SequentialFileReader
+}
+
+func (v *sequentialChunkView) GetPrologueState() PrologueState {
+	const mimeRecgonitionLen = 512
+	leadingBytes := v.data
+	if len(leadingBytes) > mimeRecgonitionLen {
+		leadingBytes = leadingBytes[:mimeRecgonitionLen]
+	}
+	return PrologueState{LeadingBytes: append([]byte(nil), leadingBytes...)}
+}
+
+func (v *sequentialChunkView) Length() int64 {
+	return int64(len(v.data))
+}
+
+func (v *sequentialChunkView) HasPrefetchedEntirelyZeros() bool {
+	for _, b := range v.data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *sequentialChunkView) WriteBufferTo(h hash.Hash) {
+	_, err := h.Write(v.data)
+	if err != nil {
+		panic("documentation of hash.Hash.Write says it will never return an error")
+	}
+}
+
+func (v *sequentialChunkView) ChunkMD5() ([]byte, error) {
+	hash := md5.Sum(v.data)
+	return hash[:], nil
+}
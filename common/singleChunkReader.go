@@ -21,14 +21,19 @@
 package common
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"errors"
+	"fmt"
 	"github.com/Azure/azure-pipeline-go/pipeline"
 	"hash"
 	"io"
 	"math"
 	"runtime"
 	"sync"
+
+	"golang.org/x/sync/semaphore"
 )
 
 // Reader of ONE chunk of a file. Maybe used to re-read multiple times (e.g. if
@@ -41,7 +46,8 @@ import (
 // indicates we were going too fast for the service anyway.
 type SingleChunkReader interface {
 
-	// ReadSeeker is used to read the contents of the chunk, and because the sending pipeline seeks at various times
+	// ReadSeeker is used to read the contents of the chunk, and because the sending pipeline seeks at various times.
+	// Seeking never does I/O, and never discards prefetched data, so Seek(0, io.SeekEnd) is a cheap way to get the length
 	io.ReadSeeker
 
 	// Closer is needed to clean up resources
@@ -50,6 +56,11 @@ type SingleChunkReader interface {
 	// BlockingPrefetch tries to read the full contents of the chunk into RAM.
 	BlockingPrefetch(fileReader io.ReaderAt, isRetry bool) error
 
+	// PrefetchAsync is BlockingPrefetch in the background. It returns straight away, with a channel that receives the result
+	// when the prefetch is done, so that a scheduler can start many prefetches and then wait on them selectively.
+	// fileReader must stay open until then. Other methods (except Close) called in the meantime wait for the prefetch to finish
+	PrefetchAsync(fileReader io.ReaderAt, isRetry bool) <-chan error
+
 	// GetPrologueState is used to grab enough of the initial bytes to do MIME-type detection.  Expected to be called only
 	// on the first chunk in each file (since there's no point in calling it on others)
 	// There is deliberately no error return value from the Prologue.
@@ -69,6 +80,62 @@ type SingleChunkReader interface {
 	// WriteBufferTo writes the entire contents of the prefetched buffer to h
 	// Panics if the internal buffer has not been prefetched (or if its been discarded after a complete Read)
 	WriteBufferTo(h hash.Hash)
+
+	// ChunkMD5 returns the MD5 hash of exactly the bytes that Read returns for this chunk (from the start, through to EOF).
+	// E.g. for use as the Content-MD5 of a Put Block. It is computed on first use, prefetching if necessary, and then cached.
+	ChunkMD5() ([]byte, error)
+
+	// ReadVectored is like Read, except that it fills each of bufs in turn, in one call. E.g. for senders that use vectored I/O,
+	// so that they don't have to copy the data into one big buffer first. It only stops short of filling them all
+	// if it gets to the end of the chunk (in which case it returns io.EOF, like Read) or there's an error
+	ReadVectored(bufs [][]byte) (int, error)
+}
+
+// A SingleChunkReader that can be reused for another chunk, so that callers that handle huge numbers of chunks can keep the
+// readers in a sync.Pool, rather than allocating one per chunk. Readers from NewSingleChunkReader implement it, unless the chunk is empty
+// or read in windows
+type ResettableChunkReader interface {
+	SingleChunkReader
+
+	// Reset discards the reader's buffer, if any (taking it out of the CacheLimiter's count, as Close would), and makes it a reader
+	// for the new chunk, with the same settings as before, except for SingleChunkReaderOptions.ExpectedMD5, which is cleared
+	// since it belonged to the old chunk. It works on closed readers too. Like the other methods, it waits for a prefetch that's
+	// in progress. It returns an error if length is not greater than zero, since empty chunks have a reader type of their own
+	Reset(sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64) error
+}
+
+// Returned by the reader's methods after Close, if SingleChunkReaderOptions.StrictClose is set
+var ErrClosedReader = errors.New("chunk reader has been closed")
+
+// ShortReadError is returned when a chunk reader gets fewer bytes from the file than the chunk needs. That usually means the file
+// has been truncated since the transfer started, although it's also what happens if a chunk reader is made for a range past the end of the file.
+// It wraps io.ErrUnexpectedEOF, so errors.Is(err, io.ErrUnexpectedEOF) tells it apart from other I/O failures
+type ShortReadError struct {
+	FileName       string
+	Offset         int64
+	ExpectedLength int64
+	BytesRead      int64
+}
+
+func (e *ShortReadError) Error() string {
+	return fmt.Sprintf("short read from %s: expected %d bytes at offset %d, but got %d. The file may have been truncated since the transfer started",
+		e.FileName, e.ExpectedLength, e.Offset, e.BytesRead)
+}
+
+func (e *ShortReadError) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// checkFullRead returns the error for a read, from offset, that was meant to get expectedLength bytes. ReaderAt may report io.EOF
+// along with the last bytes of the file, which is fine if we got everything. If we didn't, that's a ShortReadError
+func checkFullRead(fileName string, offset int64, expectedLength int64, bytesRead int, err error) error {
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil && int64(bytesRead) != expectedLength {
+		err = &ShortReadError{FileName: fileName, Offset: offset, ExpectedLength: expectedLength, BytesRead: int64(bytesRead)}
+	}
+	return err
 }
 
 // Simple aggregation of existing io interfaces
@@ -85,12 +152,18 @@ type singleChunkReader struct {
 	// (Yes, ideally contexts are not stored in structs, but we need it inside Read, and there's no way for it to be passed in there)
 	ctx context.Context
 
-	// pool of byte slices (to avoid constant GC)
+	// pool of byte slices (to avoid constant GC). May be nil, in which case buffers are simply allocated and left for the GC
 	slicePool ByteSlicePooler
 
 	// used to track the count of bytes that are (potentially) in RAM
 	cacheLimiter CacheLimiter
 
+	// optionally, used to limit the number of chunks that are prefetched at once. May be nil
+	chunkCountLimiter *semaphore.Weighted
+
+	// whether we hold a unit of chunkCountLimiter, for the buffer. A retry may not have one (see blockingPrefetch)
+	holdsChunkCount bool
+
 	// for logging chunk state transitions
 	chunkLogger ChunkStatusLogger
 
@@ -103,9 +176,18 @@ type singleChunkReader struct {
 	// chunkId includes this chunk's start position (offset) in file
 	chunkId ChunkID
 
-	// number of bytes in this chunk
+	// number of bytes in this chunk, including any padding
 	length int64
 
+	// number of bytes in this chunk that come from the file. The rest, if any, is zero padding
+	dataLength int64
+
+	// see SingleChunkReaderOptions.ReadAlignment
+	readAlignment int
+
+	// see SingleChunkReaderOptions.PadToLength
+	padToLength int64
+
 	// position for Seek/Read
 	positionInChunk int64
 
@@ -121,24 +203,169 @@ type singleChunkReader struct {
 	muClose *sync.Mutex
 
 	isClosed bool
+
+	// see SingleChunkReaderOptions.StrictClose
+	strictClose bool
+
+	// see SingleChunkReaderOptions.Transform
+	transform func(p []byte)
+
+	// see SingleChunkReaderOptions.ExpectedMD5
+	expectedMD5 []byte
+
+	// see SingleChunkReaderOptions.ReadRateLimiter
+	readRateLimiter RateLimiter
+
+	// see SingleChunkReaderOptions.HashOnPrefetch
+	hashOnPrefetch bool
+
+	// see SingleChunkReaderOptions.KeepBufferForRetry
+	keepBufferForRetry bool
+
+	// cached result of ChunkMD5
+	md5 []byte
+}
+
+// Optional behaviours of a singleChunkReader. The zero value gives the default behaviour.
+type SingleChunkReaderOptions struct {
+	// If not nil, each chunk takes one unit of this semaphore while its data is prefetched,
+	// so that the number of prefetched chunks is limited as well as their total size. Unlike the CacheLimiter for the bytes,
+	// there's no relaxed limit, so the count is exact. Except that retries don't wait for a unit, to avoid deadlock,
+	// so they may go over it.
+	ChunkCountLimiter *semaphore.Weighted
+
+	// If greater than the chunk's length, the chunk is padded with zeros up to this length. E.g. for the final chunk, when the
+	// destination requires fixed-size blocks. Length then reports the padded length, so callers that need to tell the
+	// real data from the padding should use the length that they passed in when making the reader.
+	PadToLength int64
+
+	// If greater than 1, reads from the file are rounded out to multiples of this many bytes, and the extra is discarded.
+	// For sources that are much faster with aligned reads, such as some network file systems
+	ReadAlignment int
+
+	// If true, Read, Seek, BlockingPrefetch and ChunkMD5 return ErrClosedReader once the reader has been closed.
+	// By default, Seek carries on as usual, and the others go back to the file (since Close released the buffer) before
+	// failing with a less specific error. That makes use-after-close bugs in callers slow, and hard to recognise
+	StrictClose bool
+
+	// If not nil, applied to the file's data as soon as it has been read into the prefetch buffer. It must change the bytes in place,
+	// without reference to their position, e.g. XOR obfuscation. Read, ChunkMD5, GetPrologueState etc. all see the transformed data.
+	// Each byte is transformed exactly once per read from the file, so seeking back, for a retry, never transforms it twice.
+	// Padding (see PadToLength) is not transformed
+	Transform func(p []byte)
+
+	// If not nil, each prefetch checks that the MD5 of the chunk (as ChunkMD5 would return it) is this, and fails if it's not.
+	// E.g. when resending a chunk after a failure, with the MD5 from the earlier attempt, so that a chunk whose source
+	// has changed since then is never sent under its old identity
+	ExpectedMD5 []byte
+
+	// If not nil, each read from the file waits until this allows the bytes to be read. Share one limiter between many readers
+	// (e.g. all those in the process, across every job) to keep their combined disk read rate within one budget.
+	// Retries wait too, since they go back to the file
+	ReadRateLimiter RateLimiter
+
+	// If greater than zero, and less than the chunk's length, the chunk is read this many bytes at a time, rather than all at once.
+	// The prefetch reads just the first window, and each window after that is read in the background while the one before it is read.
+	// So no more than two windows are in RAM (and counted by the CacheLimiter) at once, which saves a lot of RAM with big blocks, e.g. 100 MB.
+	// The reader then has no buffer for WriteBufferTo, and HasPrefetchedEntirelyZeros is always false. Windowing needs nothing else to be
+	// done to the whole chunk, so it's not used if Transform, ExpectedMD5, PadToLength, ReadAlignment, ReadRateLimiter or ChunkCountLimiter is set
+	PrefetchWindowSize int64
+
+	// If true, each prefetch works out the chunk's MD5 (for ChunkMD5) while the data is fresh from the file, rather than leaving it
+	// until it's asked for. E.g. for callers that will always need it, so that it's done on the prefetching goroutine, rather than on the
+	// sending one. Once worked out, the MD5 is kept, so prefetches for retries don't hash the chunk again. Windowed readers (see
+	// PrefetchWindowSize) always hash the chunk as it's read, so this makes no difference to them
+	HashOnPrefetch bool
+
+	// If true, Read keeps the prefetched data when it gets to the end of the chunk, rather than releasing it, so that a retry,
+	// which seeks back to the start, is served from RAM instead of reading the file again. The data is then only released by Close
+	// (or Reset), so the chunk stays in the CacheLimiter's count until the sender is done with it. Since this keeps the whole chunk,
+	// it turns windowing (see PrefetchWindowSize) off
+	KeepBufferForRetry bool
 }
 
+// canWindow says whether the options allow a chunk of the given length to be read in windows
+func (o SingleChunkReaderOptions) canWindow(length int64) bool {
+	return o.PrefetchWindowSize > 0 && o.PrefetchWindowSize < length &&
+		o.Transform == nil && o.ExpectedMD5 == nil && o.PadToLength <= length && o.ReadAlignment <= 1 &&
+		o.ReadRateLimiter == nil && o.ChunkCountLimiter == nil && !o.KeepBufferForRetry
+}
+
+// NewSingleChunkReader makes a reader for the given chunk. Pass a nil slicePool to allocate the prefetch buffer
+// without pooling (e.g. where no pool is available).
 func NewSingleChunkReader(ctx context.Context, sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64, chunkLogger ChunkStatusLogger, generalLogger ILogger, slicePool ByteSlicePooler, cacheLimiter CacheLimiter) SingleChunkReader {
+	return NewSingleChunkReaderWithOptions(ctx, sourceFactory, chunkId, length, chunkLogger, generalLogger, slicePool, cacheLimiter, SingleChunkReaderOptions{})
+}
+
+func NewSingleChunkReaderWithOptions(ctx context.Context, sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64, chunkLogger ChunkStatusLogger, generalLogger ILogger, slicePool ByteSlicePooler, cacheLimiter CacheLimiter, options SingleChunkReaderOptions) SingleChunkReader {
 	if length <= 0 {
 		return &emptyChunkReader{}
 	}
-	return &singleChunkReader{
-		muMaster:      &sync.Mutex{},
-		muClose:       &sync.Mutex{},
-		ctx:           ctx,
-		chunkLogger:   chunkLogger,
-		generalLogger: generalLogger,
-		slicePool:     slicePool,
-		cacheLimiter:  cacheLimiter,
-		sourceFactory: sourceFactory,
-		chunkId:       chunkId,
-		length:        length,
+	if options.canWindow(length) {
+		return newWindowedChunkReader(ctx, sourceFactory, chunkId, length, options.PrefetchWindowSize, chunkLogger, generalLogger, slicePool, cacheLimiter, options.StrictClose)
+	}
+	reader := &singleChunkReader{
+		muMaster:           &sync.Mutex{},
+		muClose:            &sync.Mutex{},
+		ctx:                ctx,
+		chunkLogger:        chunkLogger,
+		generalLogger:      generalLogger,
+		slicePool:          slicePool,
+		cacheLimiter:       cacheLimiter,
+		chunkCountLimiter:  options.ChunkCountLimiter,
+		sourceFactory:      sourceFactory,
+		chunkId:            chunkId,
+		readAlignment:      options.ReadAlignment,
+		strictClose:        options.StrictClose,
+		transform:          options.Transform,
+		expectedMD5:        options.ExpectedMD5,
+		readRateLimiter:    options.ReadRateLimiter,
+		hashOnPrefetch:     options.HashOnPrefetch,
+		keepBufferForRetry: options.KeepBufferForRetry,
+		padToLength:        options.PadToLength,
+	}
+	reader.setLength(length)
+	return reader
+}
+
+// setLength sets the length of the chunk, padding it if necessary
+func (cr *singleChunkReader) setLength(length int64) {
+	cr.length = length
+	cr.dataLength = length
+	if cr.padToLength > length {
+		cr.length = cr.padToLength
+	}
+}
+
+func (cr *singleChunkReader) Reset(sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64) error {
+	if length <= 0 {
+		return fmt.Errorf("cannot reset the reader for chunk %s, since its length is %d", chunkId.Name, length)
+	}
+
+	cr.use()
+	defer cr.unuse()
+
+	cr.closeBuffer()
+	cr.sourceFactory = sourceFactory
+	cr.chunkId = chunkId
+	cr.setLength(length)
+	cr.positionInChunk = 0
+	cr.expectedMD5 = nil
+	cr.md5 = nil
+	cr.isClosed = false
+	return nil
+}
+
+// NewSizeCheckedSingleChunkReader is NewSingleChunkReaderWithOptions for callers that know the size of the whole file.
+// It returns an error, straight away, if the chunk would run past the end of the file, since that means the chunk
+// boundaries were computed wrongly (or the file has shrunk since enumeration). Without this check, the problem
+// would only come to light later, as a short read in BlockingPrefetch.
+func NewSizeCheckedSingleChunkReader(ctx context.Context, sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64, fileSize int64, chunkLogger ChunkStatusLogger, generalLogger ILogger, slicePool ByteSlicePooler, cacheLimiter CacheLimiter, options SingleChunkReaderOptions) (SingleChunkReader, error) {
+	offset := chunkId.OffsetInFile()
+	if offset < 0 || length < 0 || offset+length > fileSize {
+		return nil, fmt.Errorf("chunk %s, of %d bytes at offset %d, does not fit in the file, which is %d bytes", chunkId.Name, length, offset, fileSize)
 	}
+	return NewSingleChunkReaderWithOptions(ctx, sourceFactory, chunkId, length, chunkLogger, generalLogger, slicePool, cacheLimiter, options), nil
 }
 
 func (cr *singleChunkReader) use() {
@@ -151,6 +378,14 @@ func (cr *singleChunkReader) unuse() {
 	cr.muMaster.Unlock()
 }
 
+// checkNotClosed returns ErrClosedReader if the reader has been closed, and closing is strict. Call it with muClose held
+func (cr *singleChunkReader) checkNotClosed() error {
+	if cr.strictClose && cr.isClosed {
+		return ErrClosedReader
+	}
+	return nil
+}
+
 func (cr *singleChunkReader) HasPrefetchedEntirelyZeros() bool {
 	cr.use()
 	defer cr.unuse()
@@ -177,14 +412,54 @@ func (cr *singleChunkReader) BlockingPrefetch(fileReader io.ReaderAt, isRetry bo
 	cr.use()
 	defer cr.unuse()
 
-	return cr.blockingPrefetch(fileReader, isRetry)
+	if err := cr.checkNotClosed(); err != nil {
+		return err
+	}
+	return cr.blockingPrefetch(cr.ctx, fileReader, isRetry)
+}
+
+// blockingPrefetchWithContext is BlockingPrefetch, stopping early if ctx is done, as well as if the reader's own context is
+func (cr *singleChunkReader) blockingPrefetchWithContext(ctx context.Context, fileReader io.ReaderAt, isRetry bool) error {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return err
+	}
+	ctx, cancel := contextWithBoth(cr.ctx, ctx)
+	defer cancel()
+	return cr.blockingPrefetch(ctx, fileReader, isRetry)
+}
+
+func (cr *singleChunkReader) PrefetchAsync(fileReader io.ReaderAt, isRetry bool) <-chan error {
+	result := make(chan error, 1)
+
+	// Lock here, rather than in the goroutine, so that anything called after we return waits for the prefetch.
+	// Otherwise, a Read could get in first, find nothing prefetched, and go to the file itself
+	cr.use()
+	go func() {
+		err := cr.checkNotClosed()
+		if err == nil {
+			err = cr.blockingPrefetch(cr.ctx, fileReader, isRetry)
+		}
+		cr.unuse()
+		result <- err
+	}()
+	return result
+}
+
+// completedPrefetch returns a PrefetchAsync result that is already available, for readers whose prefetches don't block
+func completedPrefetch(err error) <-chan error {
+	result := make(chan error, 1)
+	result <- err
+	return result
 }
 
 // Prefetch the data in this chunk, using a file reader that is provided to us.
 // (Allowing the caller to provide the reader to us allows a sequential read approach, since caller can control the order sequentially (in the initial, non-retry, scenario)
 // We use io.ReaderAt, rather than io.Reader, just for maintainablity/ensuring correctness. (Since just using Reader requires the caller to
 // follow certain assumptions about positioning the file pointer at the right place before calling us, but using ReaderAt does not).
-func (cr *singleChunkReader) blockingPrefetch(fileReader io.ReaderAt, isRetry bool) error {
+func (cr *singleChunkReader) blockingPrefetch(ctx context.Context, fileReader io.ReaderAt, isRetry bool) error {
 	if cr.buffer != nil {
 		return nil // already prefetched
 	}
@@ -194,29 +469,49 @@ func (cr *singleChunkReader) blockingPrefetch(fileReader io.ReaderAt, isRetry bo
 	// here doing retries, but no RAM _will_ become available because its
 	// all used by queued chunkfuncs (that can't be processed because all goroutines are active).
 	cr.chunkLogger.LogChunkStatus(cr.chunkId, EWaitReason.RAMToSchedule())
-	err := cr.cacheLimiter.WaitUntilAdd(cr.ctx, cr.length, func() bool { return isRetry })
+	err := cr.cacheLimiter.WaitUntilAdd(ctx, cr.length, func() bool { return isRetry })
 	if err != nil {
 		return err
 	}
+	if cr.chunkCountLimiter != nil {
+		// same deadlock reasoning applies to the count of chunks. There's no relaxed limit to use, so a retry just goes
+		// ahead without a unit, if there isn't one free
+		if isRetry {
+			cr.holdsChunkCount = cr.chunkCountLimiter.TryAcquire(1)
+		} else {
+			err = cr.chunkCountLimiter.Acquire(ctx, 1)
+			if err != nil {
+				cr.cacheLimiter.Remove(cr.length)
+				return err
+			}
+			cr.holdsChunkCount = true
+		}
+	}
 
 	// prepare to read
 	cr.chunkLogger.LogChunkStatus(cr.chunkId, EWaitReason.DiskIO())
-	targetBuffer := cr.slicePool.RentSlice(uint32Checked(cr.length))
+	targetBuffer, err := cr.rentSlice()
+	if err != nil {
+		cr.releaseLimits(cr.length)
+		return err
+	}
 
 	// read WITHOUT holding the "close" lock.  While we don't have the lock, we mutate ONLY local variables, no instance state.
 	// (Don't release the other lock, muMaster, since that's unnecessary would make it harder to reason about behaviour - e.g. is something other than Close happening?)
 	cr.muClose.Unlock()
-	n, readErr := fileReader.ReadAt(targetBuffer, cr.chunkId.OffsetInFile())
+	n, readErr := 0, cr.waitForReadRate(ctx)
+	if readErr == nil {
+		n, readErr = readAtRetryingEAGAIN(ctx, NewAlignedReaderAt(fileReader, cr.readAlignment), targetBuffer[:cr.dataLength], cr.chunkId.OffsetInFile())
+		readErr = checkFullRead(cr.chunkId.Name, cr.chunkId.OffsetInFile(), cr.dataLength, n, readErr)
+	}
 	cr.muClose.Lock()
 
 	// now that we have the lock again, see if any error means we can't continue
 	if readErr == nil {
 		if cr.isClosed {
 			readErr = errors.New("closed while reading")
-		} else if cr.ctx.Err() != nil {
-			readErr = cr.ctx.Err() // context cancelled
-		} else if int64(n) != cr.length {
-			readErr = errors.New("bytes read not equal to expected length. Chunk reader must be constructed so that it won't read past end of file")
+		} else if ctx.Err() != nil {
+			readErr = ctx.Err() // context cancelled
 		}
 	}
 	// return the revised error, if any
@@ -225,11 +520,40 @@ func (cr *singleChunkReader) blockingPrefetch(fileReader io.ReaderAt, isRetry bo
 		return readErr
 	}
 
+	// Zero the padding, if any, after the data. Don't rely on the pool to do it, since any ByteSlicePooler may be used,
+	// and not all of them zero the slices that they rent out
+	padding := targetBuffer[cr.dataLength:]
+	for i := range padding {
+		padding[i] = 0
+	}
+
 	// We can continue, so use the data we have read
+	if cr.transform != nil {
+		cr.transform(targetBuffer[:cr.dataLength])
+	}
+	if cr.expectedMD5 != nil {
+		hash := md5.Sum(targetBuffer)
+		if !bytes.Equal(hash[:], cr.expectedMD5) {
+			cr.returnSlice(targetBuffer)
+			return fmt.Errorf("chunk %s has changed: its MD5 is %x, but %x was expected", cr.chunkId.Name, hash, cr.expectedMD5)
+		}
+		cr.md5 = hash[:] // saves ChunkMD5 from hashing it again
+	} else if cr.hashOnPrefetch && cr.md5 == nil {
+		hash := md5.Sum(targetBuffer)
+		cr.md5 = hash[:]
+	}
 	cr.buffer = targetBuffer
 	return nil
 }
 
+// waitForReadRate waits until the ReadRateLimiter, if any, allows us to read the chunk's data from the file
+func (cr *singleChunkReader) waitForReadRate(ctx context.Context) error {
+	if cr.readRateLimiter == nil {
+		return nil
+	}
+	return cr.readRateLimiter.WaitN(ctx, int(cr.dataLength))
+}
+
 func (cr *singleChunkReader) retryBlockingPrefetchIfNecessary() error {
 	if cr.buffer != nil {
 		return nil // nothing to do
@@ -244,7 +568,7 @@ func (cr *singleChunkReader) retryBlockingPrefetchIfNecessary() error {
 
 	// no need to seek first, because its a ReaderAt
 	const isRetry = true // retries are the only time we need to redo the prefetch
-	return cr.blockingPrefetch(sourceFile, isRetry)
+	return cr.blockingPrefetch(cr.ctx, sourceFile, isRetry)
 }
 
 // Seeks within this chunk
@@ -253,6 +577,10 @@ func (cr *singleChunkReader) Seek(offset int64, whence int) (int64, error) {
 	cr.use()
 	defer cr.unuse()
 
+	if err := cr.checkNotClosed(); err != nil {
+		return 0, err
+	}
+
 	newPosition := cr.positionInChunk
 
 	switch whence {
@@ -280,10 +608,41 @@ func (cr *singleChunkReader) Read(p []byte) (n int, err error) {
 	cr.use()
 	defer cr.unuse()
 
+	if err := cr.checkNotClosed(); err != nil {
+		return 0, err
+	}
+
 	// This is a normal read, so free the prefetch buffer when hit EOF (i.e. end of this chunk).
 	// We do so on the assumption that if we've read to the end we don't need the prefetched data any longer.
 	// (If later, there's a retry that forces seek back to start and re-read, we'll automatically trigger a re-fetch at that time)
-	return cr.doRead(p, true)
+	// Unless we've been told to keep it for retries, in which case Close frees it
+	return cr.doRead(p, !cr.keepBufferForRetry)
+}
+
+func (cr *singleChunkReader) ReadVectored(bufs [][]byte) (n int, err error) {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return 0, err
+	}
+	return readVectored(func(p []byte) (int, error) { return cr.doRead(p, !cr.keepBufferForRetry) }, bufs)
+}
+
+// readVectored implements ReadVectored, for any reader's read function
+func readVectored(read func(p []byte) (int, error), bufs [][]byte) (n int, err error) {
+	for _, buf := range bufs {
+		for len(buf) > 0 {
+			var bytesRead int
+			bytesRead, err = read(buf)
+			n += bytesRead
+			buf = buf[bytesRead:]
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
 }
 
 func (cr *singleChunkReader) doRead(p []byte, freeBufferOnEof bool) (n int, err error) {
@@ -337,9 +696,24 @@ func (cr *singleChunkReader) closeBuffer() {
 	cr.buffer = nil
 }
 
+func (cr *singleChunkReader) rentSlice() ([]byte, error) {
+	return rentSliceChecked(cr.slicePool, cr.length)
+}
+
 func (cr *singleChunkReader) returnSlice(slice []byte) {
-	cr.slicePool.ReturnSlice(slice)
-	cr.cacheLimiter.Remove(int64(len(slice)))
+	if cr.slicePool != nil {
+		cr.slicePool.ReturnSlice(slice)
+	}
+	cr.releaseLimits(int64(len(slice)))
+}
+
+// releaseLimits gives back what blockingPrefetch took from the cacheLimiter and the chunkCountLimiter
+func (cr *singleChunkReader) releaseLimits(length int64) {
+	cr.cacheLimiter.Remove(length)
+	if cr.holdsChunkCount {
+		cr.chunkCountLimiter.Release(1)
+		cr.holdsChunkCount = false
+	}
 }
 
 func (cr *singleChunkReader) Length() int64 {
@@ -412,6 +786,27 @@ func (cr *singleChunkReader) WriteBufferTo(h hash.Hash) {
 	}
 }
 
+func (cr *singleChunkReader) ChunkMD5() ([]byte, error) {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return nil, err
+	}
+	if cr.md5 != nil {
+		return cr.md5, nil
+	}
+
+	// Hash the whole buffer, regardless of the current position, since the hash is of the whole chunk
+	err := cr.retryBlockingPrefetchIfNecessary()
+	if err != nil {
+		return nil, err
+	}
+	hash := md5.Sum(cr.buffer)
+	cr.md5 = hash[:]
+	return cr.md5, nil
+}
+
 func stack() []byte {
 	buf := make([]byte, 2048)
 	for {
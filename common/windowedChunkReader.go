@@ -0,0 +1,566 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// windowedChunkReader is the SingleChunkReader for chunks that are read a window at a time (see SingleChunkReaderOptions.PrefetchWindowSize),
+// so that a big chunk (e.g. a 100 MB block) doesn't have to be in RAM all at once. The prefetch reads only the first window, from the
+// caller's file reader, as for other chunks, and then starts a PipelinedReader, on a file handle of our own, which reads the next in the background
+// while Read serves the first. So there are at most two windows in RAM, and in the CacheLimiter, at a time: the one being read, and the one after it.
+//
+// Reads that go back to data that has been released (e.g. retries, which seek back to the start) read it again, as they do for other chunks.
+// Like the other readers, it's for use by one goroutine at a time, except that Close may be called while a Read is in progress.
+// As in singleChunkReader, Close takes only muClose, which isn't held during blocking I/O, so it can interrupt a Read that is stuck.
+type windowedChunkReader struct {
+	ctx           context.Context
+	sourceFactory ChunkReaderSourceFactory
+	chunkId       ChunkID
+	length        int64
+	windowSize    int64
+	slicePool     ByteSlicePooler // may be nil
+	cacheLimiter  CacheLimiter
+	chunkLogger   ChunkStatusLogger
+	generalLogger ILogger
+	strictClose   bool
+
+	// position for Seek/Read
+	positionInChunk int64
+
+	// the first window of the chunk, once prefetched. Released when the reader moves on from it
+	head []byte
+
+	// our own handle on the file, for the PipelinedReader and ChunkMD5. Opened by the prefetch, or when first needed after that
+	source CloseableReaderAt
+
+	// reads the rest of the chunk, after the head. pipeNext is the position in the chunk that it will return next.
+	// cancelPipe cancels the context that the pipe was made with
+	pipe       *PipelinedReader
+	pipeNext   int64
+	cancelPipe context.CancelFunc
+
+	// hashes the chunk as it's read, if it's read in order, so that ChunkMD5 usually doesn't have to read it again.
+	// hashedUpTo is the position in the chunk that the hasher has got to
+	hasher     hash.Hash
+	hashedUpTo int64
+
+	// cached result of ChunkMD5
+	md5 []byte
+
+	// muMaster locks everything for single-threaded use, except Close, which takes only muClose (as in singleChunkReader).
+	// muClose is released during blocking I/O (see beginIO), so that Close can interrupt it
+	muMaster *sync.Mutex
+	muClose  *sync.Mutex
+	isClosed bool
+
+	// busy is true while blocking I/O is in progress without muClose. cancelIO interrupts it. closeCount is how many times
+	// Close has been called, so that the I/O can tell, when it's done, whether Close was called in the meantime
+	busy       bool
+	cancelIO   context.CancelFunc
+	closeCount int
+}
+
+func newWindowedChunkReader(ctx context.Context, sourceFactory ChunkReaderSourceFactory, chunkId ChunkID, length int64, windowSize int64, chunkLogger ChunkStatusLogger, generalLogger ILogger, slicePool ByteSlicePooler, cacheLimiter CacheLimiter, strictClose bool) *windowedChunkReader {
+	return &windowedChunkReader{
+		ctx:           ctx,
+		sourceFactory: sourceFactory,
+		chunkId:       chunkId,
+		length:        length,
+		windowSize:    windowSize,
+		slicePool:     slicePool,
+		cacheLimiter:  cacheLimiter,
+		chunkLogger:   chunkLogger,
+		generalLogger: generalLogger,
+		strictClose:   strictClose,
+		hasher:        md5.New(),
+		muMaster:      &sync.Mutex{},
+		muClose:       &sync.Mutex{},
+	}
+}
+
+// use locks the reader, for anything other than Close
+func (cr *windowedChunkReader) use() {
+	cr.muMaster.Lock()
+	cr.muClose.Lock()
+}
+
+func (cr *windowedChunkReader) unuse() {
+	cr.muClose.Unlock()
+	cr.muMaster.Unlock()
+}
+
+// beginIO releases muClose, so that Close can interrupt the blocking I/O that the caller is about to do, by calling cancel.
+// Until endIO, the caller may touch only local variables, the fields that never change, and the pipe and source, which Close leaves alone while we're busy
+func (cr *windowedChunkReader) beginIO(cancel context.CancelFunc) (closeCount int) {
+	cr.busy = true
+	cr.cancelIO = cancel
+	closeCount = cr.closeCount
+	cr.muClose.Unlock()
+	return closeCount
+}
+
+// endIO takes muClose back, after beginIO. If Close was called in the meantime, it releases what Close had to leave alone, and returns an error
+func (cr *windowedChunkReader) endIO(closeCount int) error {
+	cr.muClose.Lock()
+	cr.busy = false
+	cr.cancelIO = nil
+	if cr.closeCount != closeCount {
+		cr.releaseAll()
+		return errors.New("closed while reading")
+	}
+	return nil
+}
+
+// checkNotClosed returns ErrClosedReader if the reader has been closed, and closing is strict. Call it with muClose held
+func (cr *windowedChunkReader) checkNotClosed() error {
+	if cr.strictClose && cr.isClosed {
+		return ErrClosedReader
+	}
+	return nil
+}
+
+func (cr *windowedChunkReader) headLength() int64 {
+	if cr.length < cr.windowSize {
+		return cr.length
+	}
+	return cr.windowSize
+}
+
+func (cr *windowedChunkReader) BlockingPrefetch(fileReader io.ReaderAt, isRetry bool) error {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return err
+	}
+	return cr.blockingPrefetch(cr.ctx, fileReader, isRetry)
+}
+
+// blockingPrefetchWithContext is BlockingPrefetch, stopping early if ctx is done, as well as if the reader's own context is
+func (cr *windowedChunkReader) blockingPrefetchWithContext(ctx context.Context, fileReader io.ReaderAt, isRetry bool) error {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return err
+	}
+	ctx, cancel := contextWithBoth(cr.ctx, ctx)
+	defer cancel()
+	return cr.blockingPrefetch(ctx, fileReader, isRetry)
+}
+
+func (cr *windowedChunkReader) PrefetchAsync(fileReader io.ReaderAt, isRetry bool) <-chan error {
+	result := make(chan error, 1)
+
+	// Lock here, rather than in the goroutine, so that anything called after we return waits for the prefetch (as in singleChunkReader)
+	cr.use()
+	go func() {
+		err := cr.checkNotClosed()
+		if err == nil {
+			err = cr.blockingPrefetch(cr.ctx, fileReader, isRetry)
+		}
+		cr.unuse()
+		result <- err
+	}()
+	return result
+}
+
+// blockingPrefetch reads the head of the chunk, and then starts the pipe, so that the window after it is read while the head is served.
+// The same deadlock reasoning applies to the RAM limit as in singleChunkReader, so retries use the relaxed limit
+func (cr *windowedChunkReader) blockingPrefetch(ctx context.Context, fileReader io.ReaderAt, isRetry bool) error {
+	if cr.head != nil {
+		return nil // already prefetched
+	}
+
+	headLength := cr.headLength()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	closeCount := cr.beginIO(cancel)
+	buffer, err := cr.readHeadFrom(ctx, fileReader, headLength, isRetry)
+	if closeErr := cr.endIO(closeCount); closeErr != nil && err == nil {
+		cr.returnSlice(buffer)
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	cr.head = buffer
+
+	if cr.pipe == nil || cr.pipeNext != headLength {
+		cr.closePipe()
+		_ = cr.startPipe(headLength) // if our own handle can't be opened now, readPipe will try again, and report the error
+	}
+	return nil
+}
+
+// readHeadFrom reads the head into a new buffer, which it adds to the CacheLimiter. It runs between beginIO and endIO, so it touches no mutable state
+func (cr *windowedChunkReader) readHeadFrom(ctx context.Context, fileReader io.ReaderAt, headLength int64, isRetry bool) ([]byte, error) {
+	cr.chunkLogger.LogChunkStatus(cr.chunkId, EWaitReason.RAMToSchedule())
+	err := cr.cacheLimiter.WaitUntilAdd(ctx, headLength, func() bool { return isRetry })
+	if err != nil {
+		return nil, err
+	}
+
+	cr.chunkLogger.LogChunkStatus(cr.chunkId, EWaitReason.DiskIO())
+	buffer, err := cr.rentSlice(headLength)
+	if err != nil {
+		cr.cacheLimiter.Remove(headLength)
+		return nil, err
+	}
+	n, err := readAtRetryingEAGAIN(ctx, fileReader, buffer, cr.chunkId.OffsetInFile())
+	err = checkFullRead(cr.chunkId.Name, cr.chunkId.OffsetInFile(), headLength, n, err)
+	if err != nil {
+		cr.returnSlice(buffer)
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func (cr *windowedChunkReader) retryBlockingPrefetchIfNecessary() error {
+	if cr.head != nil {
+		return nil
+	}
+	if err := cr.openSource(); err != nil {
+		return err
+	}
+	const isRetry = true
+	return cr.blockingPrefetch(cr.ctx, cr.source, isRetry)
+}
+
+// openSource opens our own handle on the file, if it's not open already
+func (cr *windowedChunkReader) openSource() error {
+	if cr.source != nil {
+		return nil
+	}
+	source, err := cr.sourceFactory()
+	if err != nil {
+		return err
+	}
+	cr.source = source
+	return nil
+}
+
+func (cr *windowedChunkReader) Seek(offset int64, whence int) (int64, error) {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return 0, err
+	}
+
+	newPosition := cr.positionInChunk
+	switch whence {
+	case io.SeekStart:
+		newPosition = offset
+	case io.SeekCurrent:
+		newPosition += offset
+	case io.SeekEnd:
+		newPosition = cr.length - offset
+	}
+
+	if newPosition < 0 {
+		return 0, errors.New("cannot seek to before beginning")
+	}
+	if newPosition > cr.length {
+		newPosition = cr.length
+	}
+
+	// Like singleChunkReader, seeking does no I/O, and releases nothing. If the pipe is no longer in the right place, Read will replace it
+	cr.positionInChunk = newPosition
+	return cr.positionInChunk, nil
+}
+
+func (cr *windowedChunkReader) Read(p []byte) (int, error) {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return 0, err
+	}
+	return cr.doRead(p)
+}
+
+func (cr *windowedChunkReader) ReadVectored(bufs [][]byte) (int, error) {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return 0, err
+	}
+	return readVectored(cr.doRead, bufs)
+}
+
+func (cr *windowedChunkReader) doRead(p []byte) (n int, err error) {
+	if cr.positionInChunk >= cr.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if cr.positionInChunk < cr.headLength() {
+		n, err = cr.readHead(p)
+	} else {
+		n, err = cr.readPipe(p)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	cr.hash(p[:n], cr.positionInChunk)
+	cr.positionInChunk += int64(n)
+
+	if cr.positionInChunk >= cr.length {
+		// as in singleChunkReader, we assume that data that has been read to the end is no longer needed
+		cr.releaseAll()
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (cr *windowedChunkReader) readHead(p []byte) (int, error) {
+	if err := cr.retryBlockingPrefetchIfNecessary(); err != nil {
+		return 0, err
+	}
+	n := copy(p, cr.head[cr.positionInChunk:])
+	if cr.positionInChunk+int64(n) >= int64(len(cr.head)) {
+		// we've finished with the head, so release it before the pipe reads any more, to keep to two windows in RAM
+		cr.releaseHead()
+	}
+	return n, nil
+}
+
+func (cr *windowedChunkReader) readPipe(p []byte) (int, error) {
+	if cr.pipe != nil && cr.pipeNext != cr.positionInChunk {
+		cr.closePipe() // we've seeked away from where it is
+	}
+	if cr.pipe == nil {
+		if err := cr.startPipe(cr.positionInChunk); err != nil {
+			return 0, err
+		}
+	}
+
+	pipe := cr.pipe
+	closeCount := cr.beginIO(cr.cancelPipe)
+	n, err := pipe.Read(p)
+	if closeErr := cr.endIO(closeCount); closeErr != nil {
+		return 0, closeErr
+	}
+	if err == io.EOF && n > 0 {
+		err = nil // we spot the end of the chunk ourselves
+	}
+	if err != nil {
+		if err != io.EOF {
+			// don't trust the pipe's position after a failure. The next Read starts a new one, from where we are
+			cr.closePipe()
+		}
+		return 0, err
+	}
+	cr.pipeNext += int64(n)
+	return n, nil
+}
+
+// hash adds any of the bytes read at positionInChunk that the hasher hasn't had yet. Bytes read out of order can't be hashed,
+// but a seek back, for a retry, only re-reads bytes that have already been hashed, so hashing carries on where it left off
+func (cr *windowedChunkReader) hash(data []byte, positionInChunk int64) {
+	if positionInChunk > cr.hashedUpTo || cr.md5 != nil {
+		return
+	}
+	end := positionInChunk + int64(len(data))
+	if end <= cr.hashedUpTo {
+		return
+	}
+	_, _ = cr.hasher.Write(data[cr.hashedUpTo-positionInChunk:])
+	cr.hashedUpTo = end
+	if cr.hashedUpTo == cr.length {
+		cr.md5 = cr.hasher.Sum(nil)
+	}
+}
+
+func (cr *windowedChunkReader) rentSlice(length int64) ([]byte, error) {
+	return rentSliceChecked(cr.slicePool, length)
+}
+
+func (cr *windowedChunkReader) returnSlice(slice []byte) {
+	if cr.slicePool != nil {
+		cr.slicePool.ReturnSlice(slice)
+	}
+	cr.cacheLimiter.Remove(int64(len(slice)))
+}
+
+func (cr *windowedChunkReader) releaseHead() {
+	if cr.head != nil {
+		cr.returnSlice(cr.head)
+		cr.head = nil
+	}
+}
+
+// startPipe starts a pipe that reads the rest of the chunk from positionInChunk, on our own handle on the file
+func (cr *windowedChunkReader) startPipe(positionInChunk int64) error {
+	if err := cr.openSource(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(cr.ctx)
+	cr.pipe = NewPipelinedReader(ctx, cr.source, cr.chunkId.Name, cr.chunkId.OffsetInFile()+positionInChunk, cr.length-positionInChunk, cr.windowSize, cr.slicePool, cr.cacheLimiter)
+	cr.pipeNext = positionInChunk
+	cr.cancelPipe = cancel
+	return nil
+}
+
+func (cr *windowedChunkReader) closePipe() {
+	if cr.pipe != nil {
+		_ = cr.pipe.Close()
+		cr.cancelPipe()
+		cr.pipe = nil
+		cr.cancelPipe = nil
+	}
+}
+
+// releaseAll releases the windows in RAM, and closes our handle on the file, which will be re-opened if a retry needs it
+func (cr *windowedChunkReader) releaseAll() {
+	cr.releaseHead()
+	cr.closePipe()
+	if cr.source != nil {
+		_ = cr.source.Close()
+		cr.source = nil
+	}
+}
+
+func (cr *windowedChunkReader) Close() error {
+	// Don't acquire muMaster, which a Read that's in progress will be holding
+	cr.muClose.Lock()
+	defer cr.muClose.Unlock()
+
+	if cr.positionInChunk < cr.length && cr.ctx.Err() == nil {
+		cr.generalLogger.Log(pipeline.LogInfo, "Early close of chunk in windowedChunkReader with context still active")
+	}
+
+	cr.isClosed = true
+	cr.closeCount++
+	if cr.busy {
+		cr.cancelIO() // and endIO releases everything, once the I/O has stopped
+		return nil
+	}
+	cr.releaseAll()
+	return nil
+}
+
+// GetPrologueState takes the leading bytes from the head, which stays in RAM for the Read that follows
+func (cr *windowedChunkReader) GetPrologueState() PrologueState {
+	cr.use()
+	defer cr.unuse()
+
+	const mimeRecgonitionLen = 512
+	if err := cr.retryBlockingPrefetchIfNecessary(); err != nil {
+		return PrologueState{} // we just can't sniff the mime type
+	}
+	leadingBytes := make([]byte, mimeRecgonitionLen)
+	n := copy(leadingBytes, cr.head)
+	return PrologueState{LeadingBytes: leadingBytes[:n]}
+}
+
+func (cr *windowedChunkReader) Length() int64 {
+	cr.use()
+	defer cr.unuse()
+
+	return cr.length
+}
+
+// HasPrefetchedEntirelyZeros is always false, since we never have the whole chunk in RAM to check
+func (cr *windowedChunkReader) HasPrefetchedEntirelyZeros() bool {
+	return false
+}
+
+// WriteBufferTo can't be supported, since the whole chunk is never in RAM at once. Callers that need it mustn't use windowing
+func (cr *windowedChunkReader) WriteBufferTo(h hash.Hash) {
+	panic("invalid state. A windowed chunk reader never holds the whole chunk, so it has no buffer to write")
+}
+
+// ChunkMD5 returns the hash from the reads, if the chunk has been read through in order. If not, it reads the chunk for itself,
+// one window at a time, without disturbing the pipe
+func (cr *windowedChunkReader) ChunkMD5() ([]byte, error) {
+	cr.use()
+	defer cr.unuse()
+
+	if err := cr.checkNotClosed(); err != nil {
+		return nil, err
+	}
+	if cr.md5 != nil {
+		return cr.md5, nil
+	}
+
+	if err := cr.openSource(); err != nil {
+		return nil, err
+	}
+	source := cr.source
+	ctx, cancel := context.WithCancel(cr.ctx)
+	defer cancel()
+	closeCount := cr.beginIO(cancel)
+	chunkMD5, err := cr.hashChunkFrom(ctx, source)
+	if closeErr := cr.endIO(closeCount); closeErr != nil {
+		return nil, closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	cr.md5 = chunkMD5
+	return cr.md5, nil
+}
+
+// hashChunkFrom reads the whole chunk, a window at a time, and hashes it. It runs between beginIO and endIO, so it touches no mutable state
+func (cr *windowedChunkReader) hashChunkFrom(ctx context.Context, source io.ReaderAt) ([]byte, error) {
+	windowLength := cr.headLength()
+	err := cr.cacheLimiter.WaitUntilAdd(ctx, windowLength, func() bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := cr.rentSlice(windowLength)
+	if err != nil {
+		cr.cacheLimiter.Remove(windowLength)
+		return nil, err
+	}
+	defer cr.returnSlice(buffer)
+
+	hasher := md5.New()
+	for position := int64(0); position < cr.length; position += windowLength {
+		window := buffer
+		if remaining := cr.length - position; remaining < windowLength {
+			window = buffer[:remaining]
+		}
+		offset := cr.chunkId.OffsetInFile() + position
+		n, err := readAtRetryingEAGAIN(ctx, source, window, offset)
+		err = checkFullRead(cr.chunkId.Name, offset, int64(len(window)), n, err)
+		if err != nil {
+			return nil, err
+		}
+		_, _ = hasher.Write(window)
+	}
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,107 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	chk "gopkg.in/check.v1"
+)
+
+type alignedReaderAtSuite struct{}
+
+var _ = chk.Suite(&alignedReaderAtSuite{})
+
+// rangeRecordingReaderAt records the offset and length of every read
+type rangeRecordingReaderAt struct {
+	inner  io.ReaderAt
+	ranges [][2]int64
+}
+
+func (r *rangeRecordingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.ranges = append(r.ranges, [2]int64{off, int64(len(p))})
+	return r.inner.ReadAt(p, off)
+}
+
+func (s *alignedReaderAtSuite) TestReadsAreAlignedAndTrimmed(c *chk.C) {
+	fileContent := newTestFile(1000)
+	recorder := &rangeRecordingReaderAt{inner: bytes.NewReader(fileContent)}
+	r := NewAlignedReaderAt(recorder, 64)
+
+	cases := []struct{ off, length int }{
+		{0, 128},   // already aligned
+		{10, 20},   // within one block
+		{60, 10},   // across a boundary
+		{100, 300}, // unaligned at both ends
+		{950, 50},  // up to the end of the file, which is not aligned
+	}
+	for _, x := range cases {
+		recorder.ranges = nil
+		p := make([]byte, x.length)
+		n, err := r.ReadAt(p, int64(x.off))
+		c.Assert(err, chk.IsNil)
+		c.Assert(n, chk.Equals, x.length)
+		c.Assert(bytes.Equal(p, fileContent[x.off:x.off+x.length]), chk.Equals, true)
+
+		c.Assert(len(recorder.ranges) <= 3, chk.Equals, true)
+		for _, r := range recorder.ranges {
+			c.Assert(r[0]%64, chk.Equals, int64(0))
+			c.Assert(r[1]%64, chk.Equals, int64(0))
+		}
+	}
+
+	// only the sectors at the ends, that are only partly wanted, are read into separate buffers. The middle goes straight into p
+	recorder.ranges = nil
+	_, err := r.ReadAt(make([]byte, 300), 100)
+	c.Assert(err, chk.IsNil)
+	c.Assert(recorder.ranges, chk.DeepEquals, [][2]int64{{64, 64}, {128, 256}, {384, 64}})
+
+	// past the end of the file
+	n, err := r.ReadAt(make([]byte, 100), 950)
+	c.Assert(n, chk.Equals, 50)
+	c.Assert(err, chk.Equals, io.EOF)
+	n, err = r.ReadAt(make([]byte, 200), 900) // the file ends in the aligned middle
+	c.Assert(n, chk.Equals, 100)
+	c.Assert(err, chk.Equals, io.EOF)
+	n, err = r.ReadAt(make([]byte, 10), 1010)
+	c.Assert(n, chk.Equals, 0)
+	c.Assert(err, chk.Equals, io.EOF)
+}
+
+func (s *alignedReaderAtSuite) TestChunkReaderWithReadAlignment(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := newFaultyReaderAt(fileContent)
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	recorder := &rangeRecordingReaderAt{inner: source}
+
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 300, 333), 333,
+		nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{ReadAlignment: 256})
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(recorder, false), chk.IsNil)
+	c.Assert(recorder.ranges, chk.DeepEquals, [][2]int64{{256, 256}, {512, 256}})
+
+	data, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(bytes.Equal(data, fileContent[300:633]), chk.Equals, true)
+}
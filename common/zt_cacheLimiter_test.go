@@ -0,0 +1,121 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	chk "gopkg.in/check.v1"
+)
+
+type cacheLimiterSuite struct{}
+
+var _ = chk.Suite(&cacheLimiterSuite{})
+
+// messageRecordingLogger keeps the messages it is asked to log
+type messageRecordingLogger struct {
+	nullLogger
+	messages []string
+}
+
+func (l *messageRecordingLogger) Log(level pipeline.LogLevel, msg string) {
+	l.messages = append(l.messages, msg)
+}
+
+func (s *cacheLimiterSuite) TestUnderflowWithoutGuard(c *chk.C) {
+	limiter := NewCacheLimiter(100)
+	c.Assert(limiter.TryAdd(10, false), chk.Equals, true)
+	limiter.Remove(10)
+	limiter.Remove(10) // the value is now -10, so there's bogus headroom
+	c.Assert(limiter.TryAdd(80, false), chk.Equals, true)
+}
+
+func (s *cacheLimiterSuite) TestUnderflowGuardPanics(c *chk.C) {
+	limiter := NewCacheLimiterWithOptions(100, CacheLimiterOptions{UnderflowGuard: EUnderflowGuard.Panic()})
+	c.Assert(limiter.TryAdd(10, false), chk.Equals, true)
+	limiter.Remove(10)
+	c.Assert(func() { limiter.Remove(10) }, chk.PanicMatches, "cache limiter accounting error: removing 10 when the value is only 0")
+}
+
+func (s *cacheLimiterSuite) TestUnderflowGuardClamps(c *chk.C) {
+	logger := &messageRecordingLogger{}
+	limiter := NewCacheLimiterWithOptions(100, CacheLimiterOptions{UnderflowGuard: EUnderflowGuard.Clamp(), Logger: logger})
+	c.Assert(limiter.TryAdd(10, false), chk.Equals, true)
+	limiter.Remove(30)
+	c.Assert(logger.messages, chk.HasLen, 1)
+	c.Assert(strings.HasPrefix(logger.messages[0], "cache limiter accounting error: removing 30 when the value is only 10"), chk.Equals, true)
+
+	// clamped at zero, so the limit still works, and WaitForZero was woken
+	c.Assert(limiter.WaitForZero(context.Background()), chk.IsNil)
+	c.Assert(limiter.TryAdd(80, false), chk.Equals, false)
+	c.Assert(limiter.TryAdd(75, false), chk.Equals, true)
+}
+
+func (s *cacheLimiterSuite) TestWaitForZeroWhenAlreadyZero(c *chk.C) {
+	limiter := NewCacheLimiter(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // so it would fail if it waited at all
+	c.Assert(limiter.WaitForZero(ctx), chk.IsNil)
+
+	c.Assert(limiter.TryAdd(10, false), chk.Equals, true)
+	limiter.Remove(10)
+	c.Assert(limiter.WaitForZero(ctx), chk.IsNil)
+}
+
+func (s *cacheLimiterSuite) TestWaitForZeroWakesOnRemove(c *chk.C) {
+	limiter := NewCacheLimiter(100)
+	c.Assert(limiter.TryAdd(10, false), chk.Equals, true)
+	c.Assert(limiter.TryAdd(20, false), chk.Equals, true)
+
+	done := make(chan error, 1)
+	go func() { done <- limiter.WaitForZero(context.Background()) }()
+
+	// not woken until the value gets all the way to zero
+	limiter.Remove(10)
+	select {
+	case <-done:
+		c.Fatal("WaitForZero returned while the value was still 20")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	limiter.Remove(20)
+	select {
+	case err := <-done:
+		c.Assert(err, chk.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("WaitForZero wasn't woken when the value got to zero")
+	}
+}
+
+func (s *cacheLimiterSuite) TestWaitForZeroCancellation(c *chk.C) {
+	limiter := NewCacheLimiter(100)
+	c.Assert(limiter.TryAdd(10, false), chk.Equals, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	c.Assert(limiter.WaitForZero(ctx), chk.Equals, context.Canceled)
+}
@@ -0,0 +1,118 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	chk "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+type chunkPrefetcherSuite struct{}
+
+var _ = chk.Suite(&chunkPrefetcherSuite{})
+
+func newTestChunkReaders(fileContent []byte, chunkSize int64, cacheLimiter CacheLimiter) []SingleChunkReader {
+	factory := func() (CloseableReaderAt, error) { return newFaultyReaderAt(fileContent), nil }
+	readers := make([]SingleChunkReader, 0)
+	for offset := int64(0); offset < int64(len(fileContent)); offset += chunkSize {
+		length := chunkSize
+		if offset+length > int64(len(fileContent)) {
+			length = int64(len(fileContent)) - offset
+		}
+		readers = append(readers, NewSingleChunkReader(context.Background(), factory, NewChunkID("test", offset, length), length,
+			nullChunkStatusLogger{}, nullLogger{}, nil, cacheLimiter))
+	}
+	return readers
+}
+
+func (s *chunkPrefetcherSuite) TestReadsAllChunksInOrder(c *chk.C) {
+	fileContent := newTestFile(1000)
+	cacheLimiter := NewCacheLimiter(1024 * 1024)
+	p := NewChunkPrefetcher(context.Background(), bytes.NewReader(fileContent), newTestChunkReaders(fileContent, 300, cacheLimiter))
+	p.Start()
+	defer p.Stop()
+
+	result := &bytes.Buffer{}
+	for {
+		reader, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, chk.IsNil)
+		data, err := ioutil.ReadAll(reader)
+		c.Assert(err, chk.IsNil)
+		result.Write(data)
+		reader.Close()
+	}
+
+	c.Assert(bytes.Equal(result.Bytes(), fileContent), chk.Equals, true)
+	c.Assert(cacheLimiter.WaitForZero(context.Background()), chk.IsNil)
+}
+
+func (s *chunkPrefetcherSuite) TestStopClosesUnconsumedReaders(c *chk.C) {
+	fileContent := newTestFile(1000)
+	cacheLimiter := NewCacheLimiter(1024 * 1024)
+	p := NewChunkPrefetcher(context.Background(), bytes.NewReader(fileContent), newTestChunkReaders(fileContent, 100, cacheLimiter))
+	p.Start()
+
+	reader, err := p.Next()
+	c.Assert(err, chk.IsNil)
+	reader.Close()
+	p.Stop()
+
+	// everything that the prefetcher read, but didn't hand over, has been released
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c.Assert(cacheLimiter.WaitForZero(ctx), chk.IsNil)
+
+	_, err = p.Next()
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *chunkPrefetcherSuite) TestStopInterruptsBlockedPrefetch(c *chk.C) {
+	fileContent := newTestFile(1000)
+	cacheLimiter := NewCacheLimiter(100)
+	c.Assert(cacheLimiter.TryAdd(100, true), chk.Equals, true) // so the first prefetch waits for RAM
+	p := NewChunkPrefetcher(context.Background(), bytes.NewReader(fileContent), newTestChunkReaders(fileContent, 100, cacheLimiter))
+	p.Start()
+	time.Sleep(100 * time.Millisecond) // let the prefetch get stuck
+
+	// the readers' own context is never cancelled, but Stop doesn't wait for it
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		c.Fatal("Stop waited for a prefetch that was blocked")
+	}
+
+	cacheLimiter.Remove(100)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c.Assert(cacheLimiter.WaitForZero(ctx), chk.IsNil)
+}
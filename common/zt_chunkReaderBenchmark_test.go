@@ -0,0 +1,72 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	chk "gopkg.in/check.v1"
+)
+
+type chunkReaderBenchmarkSuite struct{}
+
+var _ = chk.Suite(&chunkReaderBenchmarkSuite{})
+
+func writeTempTestFile(size int) string {
+	f, err := ioutil.TempFile("", "chunkReaderBenchmark")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if _, err = f.Write(newTestFile(size)); err != nil {
+		panic(err)
+	}
+	return f.Name()
+}
+
+func (s *chunkReaderBenchmarkSuite) TestMeasureChunkReaderThroughput(c *chk.C) {
+	path := writeTempTestFile(10 * 1024)
+	defer os.Remove(path)
+
+	// 25 chunks, wrapping round the 10 that are in the file
+	result, err := MeasureChunkReaderThroughput(path, 1024, 25, SingleChunkReaderFactory(1024, 4096, SingleChunkReaderOptions{}))
+	c.Assert(err, chk.IsNil)
+	c.Assert(result.Chunks, chk.Equals, 25)
+	c.Assert(result.Bytes, chk.Equals, int64(25*1024))
+	c.Assert(result.Elapsed > 0, chk.Equals, true)
+
+	_, err = MeasureChunkReaderThroughput(path, 20*1024, 1, SingleChunkReaderFactory(20*1024, 40*1024, SingleChunkReaderOptions{}))
+	c.Assert(err, chk.ErrorMatches, "cannot read chunks of 20480 bytes from .*, which is 10240 bytes")
+}
+
+func BenchmarkSingleChunkReader(b *testing.B) {
+	const chunkSize = 4 * 1024 * 1024
+	path := writeTempTestFile(8 * chunkSize)
+	defer os.Remove(path)
+
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	if _, err := MeasureChunkReaderThroughput(path, chunkSize, b.N, SingleChunkReaderFactory(chunkSize, 4*chunkSize, SingleChunkReaderOptions{})); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	chk "gopkg.in/check.v1"
+	"io"
+	"time"
+)
+
+type coalescingReaderAtSuite struct{}
+
+var _ = chk.Suite(&coalescingReaderAtSuite{})
+
+type countingReaderAt struct {
+	inner io.ReaderAt
+	count int
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.count++
+	return r.inner.ReadAt(p, off)
+}
+
+func (s *coalescingReaderAtSuite) TestAdjacentReadsAreCoalesced(c *chk.C) {
+	fileContent := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	counter := &countingReaderAt{inner: bytes.NewReader(fileContent)}
+	r := NewCoalescingReaderAt(counter, 16, time.Minute)
+
+	// read the file in 4-byte chunks, in order
+	for offset := 0; offset < len(fileContent); offset += 4 {
+		chunk := make([]byte, 4)
+		n, err := r.ReadAt(chunk, int64(offset))
+		c.Assert(err, chk.IsNil)
+		c.Assert(n, chk.Equals, 4)
+		c.Assert(string(chunk), chk.Equals, string(fileContent[offset:offset+4]))
+	}
+
+	// 36 bytes, in 16 byte reads
+	c.Assert(counter.count, chk.Equals, 3)
+}
+
+func (s *coalescingReaderAtSuite) TestShortReadAtEndOfFile(c *chk.C) {
+	r := NewCoalescingReaderAt(bytes.NewReader([]byte("0123456789")), 16, time.Minute)
+
+	chunk := make([]byte, 4)
+	n, err := r.ReadAt(chunk, 8)
+	c.Assert(err, chk.Equals, io.EOF)
+	c.Assert(n, chk.Equals, 2)
+	c.Assert(string(chunk[:n]), chk.Equals, "89")
+}
+
+func (s *coalescingReaderAtSuite) TestReadSizeIndependentOfCallerSize(c *chk.C) {
+	fileContent := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	// caller sizes that don't divide the read size, and some that exceed it
+	for _, readSize := range []int{5, 10, 16, 64} {
+		for _, callerSize := range []int{1, 3, 7, 12, 40} {
+			counter := &countingReaderAt{inner: bytes.NewReader(fileContent)}
+			r := NewCoalescingReaderAt(counter, readSize, time.Minute)
+
+			result := make([]byte, 0)
+			for offset := 0; offset < len(fileContent); offset += callerSize {
+				p := make([]byte, callerSize)
+				n, err := r.ReadAt(p, int64(offset))
+				if err != io.EOF {
+					c.Assert(err, chk.IsNil)
+				}
+				result = append(result, p[:n]...)
+			}
+			c.Assert(string(result), chk.Equals, string(fileContent), chk.Commentf("read size %d, caller size %d", readSize, callerSize))
+
+			if callerSize < readSize {
+				// a read that straddles the end of the buffer refills it from that point, so at worst we need about two buffer fills per readSize of the file
+				c.Assert(counter.count <= 2*(len(fileContent)/readSize+1), chk.Equals, true)
+			} else {
+				c.Assert(counter.count, chk.Equals, (len(fileContent)+callerSize-1)/callerSize) // passed straight through
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+
+	chk "gopkg.in/check.v1"
+)
+
+type concatChunkReaderSuite struct{}
+
+var _ = chk.Suite(&concatChunkReaderSuite{})
+
+func newTestConcatChunkReader(header []byte, fileContent []byte, offset, length int64) SingleChunkReader {
+	factory := func() (CloseableReaderAt, error) { return newFaultyReaderAt(fileContent), nil }
+	return NewConcatChunkReader(context.Background(), header, factory, NewChunkID("test", offset, length), length,
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024*1024), NewCacheLimiter(1024*1024))
+}
+
+func (s *concatChunkReaderSuite) TestReadAcrossBoundary(c *chk.C) {
+	header := []byte("HEADER:")
+	fileContent := newTestFile(1000)
+	expected := append(append([]byte{}, header...), fileContent[100:400]...)
+
+	reader := newTestConcatChunkReader(header, fileContent, 100, 300)
+	defer reader.Close()
+	c.Assert(reader.Length(), chk.Equals, int64(len(expected)))
+
+	// small reads, so that one of them straddles the boundary
+	result := make([]byte, 0)
+	p := make([]byte, 5)
+	for {
+		n, err := reader.Read(p)
+		result = append(result, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, chk.IsNil)
+	}
+	c.Assert(bytes.Equal(result, expected), chk.Equals, true)
+
+	// a retry re-reads everything, including the body, whose buffer was freed at EOF
+	_, err := reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	result, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(bytes.Equal(result, expected), chk.Equals, true)
+}
+
+func (s *concatChunkReaderSuite) TestReadVectored(c *chk.C) {
+	header := []byte("HEADER:")
+	fileContent := newTestFile(1000)
+	expected := append(append([]byte{}, header...), fileContent[100:400]...)
+
+	reader := newTestConcatChunkReader(header, fileContent, 100, 300)
+	defer reader.Close()
+
+	// the first buffer straddles the boundary between the header and the body
+	bufs := [][]byte{make([]byte, 10), make([]byte, 290), make([]byte, 100)}
+	n, err := reader.ReadVectored(bufs)
+	c.Assert(err, chk.Equals, io.EOF)
+	c.Assert(n, chk.Equals, len(expected))
+	c.Assert(append(append(bufs[0], bufs[1]...), bufs[2][:7]...), chk.DeepEquals, expected)
+}
+
+func (s *concatChunkReaderSuite) TestSeek(c *chk.C) {
+	header := []byte("HEADER:")
+	fileContent := newTestFile(1000)
+	expected := append(append([]byte{}, header...), fileContent[0:100]...)
+
+	reader := newTestConcatChunkReader(header, fileContent, 0, 100)
+	defer reader.Close()
+
+	for _, position := range []int64{3, 7, 50} {
+		newPosition, err := reader.Seek(position, io.SeekStart)
+		c.Assert(err, chk.IsNil)
+		c.Assert(newPosition, chk.Equals, position)
+		result, err := ioutil.ReadAll(reader)
+		c.Assert(err, chk.IsNil)
+		c.Assert(bytes.Equal(result, expected[position:]), chk.Equals, true)
+	}
+
+	// seeking to the end is how some code gets the length
+	end, err := reader.Seek(0, io.SeekEnd)
+	c.Assert(err, chk.IsNil)
+	c.Assert(end, chk.Equals, int64(len(expected)))
+	_, err = reader.Seek(-1, io.SeekStart)
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *concatChunkReaderSuite) TestChunkMD5AndPrologue(c *chk.C) {
+	header := []byte("HEADER:")
+	fileContent := newTestFile(1000)
+	expected := append(append([]byte{}, header...), fileContent...)
+
+	reader := newTestConcatChunkReader(header, fileContent, 0, 1000)
+	defer reader.Close()
+
+	c.Assert(reader.GetPrologueState().LeadingBytes, chk.DeepEquals, expected[:512])
+	hash, err := reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	expectedHash := md5.Sum(expected)
+	c.Assert(hash, chk.DeepEquals, expectedHash[:])
+
+	// the prologue didn't consume anything
+	result, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(bytes.Equal(result, expected), chk.Equals, true)
+}
+
+func (s *concatChunkReaderSuite) TestHeaderOnly(c *chk.C) {
+	reader := newTestConcatChunkReader([]byte("HEADER"), newTestFile(10), 0, 0)
+	defer reader.Close()
+
+	result, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(result), chk.Equals, "HEADER")
+}
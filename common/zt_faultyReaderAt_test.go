@@ -0,0 +1,70 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"io"
+)
+
+// faultyReaderAt is an in-memory file for chunk reader tests, that can be told to misbehave.
+// It implements CloseableReaderAt, so it can be returned from a ChunkReaderSourceFactory.
+type faultyReaderAt struct {
+	data []byte
+
+	// any ReadAt whose range includes one of these offsets fails with the corresponding error
+	errorsAtOffsets map[int64]error
+
+	// if greater than zero, each ReadAt returns at most this many bytes, with no error (i.e. a short read)
+	maxReadLength int
+
+	closed bool
+}
+
+func newFaultyReaderAt(data []byte) *faultyReaderAt {
+	return &faultyReaderAt{data: data, errorsAtOffsets: make(map[int64]error)}
+}
+
+func (r *faultyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	for errorOffset, err := range r.errorsAtOffsets {
+		if errorOffset >= off && errorOffset < end {
+			return 0, err
+		}
+	}
+
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	if r.maxReadLength > 0 && len(p) > r.maxReadLength {
+		p = p[:r.maxReadLength]
+		return copy(p, r.data[off:]), nil
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *faultyReaderAt) Close() error {
+	r.closed = true
+	return nil
+}
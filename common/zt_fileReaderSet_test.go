@@ -0,0 +1,71 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	chk "gopkg.in/check.v1"
+)
+
+type fileReaderSetSuite struct{}
+
+var _ = chk.Suite(&fileReaderSetSuite{})
+
+func (s *fileReaderSetSuite) TestReadersShareTheFile(c *chk.C) {
+	path := writeTempTestFile(1000)
+	defer os.Remove(path)
+	fileContent, err := ioutil.ReadFile(path)
+	c.Assert(err, chk.IsNil)
+
+	set, err := NewFileReaderSet(context.Background(), path, nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024), NewCacheLimiter(4096), SingleChunkReaderOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(set.FileSize(), chk.Equals, int64(1000))
+
+	first, err := set.NewReader(0, 600)
+	c.Assert(err, chk.IsNil)
+	second, err := set.NewReader(600, 400)
+	c.Assert(err, chk.IsNil)
+	_, err = set.NewReader(600, 401)
+	c.Assert(err, chk.NotNil) // runs past the end of the file
+
+	c.Assert(second.BlockingPrefetch(set, false), chk.IsNil)
+	data, err := ioutil.ReadAll(second)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, fileContent[600:])
+
+	// closing the set doesn't close the file, while a reader still needs it (here, to re-read after Read freed the buffer)
+	c.Assert(set.Close(), chk.IsNil)
+	_, err = set.NewReader(0, 10)
+	c.Assert(err, chk.Equals, errFileReaderSetClosed)
+	c.Assert(second.Close(), chk.IsNil)
+	c.Assert(second.Close(), chk.IsNil) // closing twice doesn't release twice
+	data, err = ioutil.ReadAll(first)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, fileContent[:600])
+
+	// the last reader to close closes the file
+	c.Assert(first.Close(), chk.IsNil)
+	_, err = set.ReadAt(make([]byte, 10), 0)
+	c.Assert(err, chk.NotNil)
+}
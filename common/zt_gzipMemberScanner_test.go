@@ -0,0 +1,70 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	chk "gopkg.in/check.v1"
+	"io/ioutil"
+)
+
+type gzipMemberScannerSuite struct{}
+
+var _ = chk.Suite(&gzipMemberScannerSuite{})
+
+func (s *gzipMemberScannerSuite) TestFindGzipMemberRanges(c *chk.C) {
+	contents := []string{"first member", "", "the third member, which is a bit longer than the others"}
+
+	file := &bytes.Buffer{}
+	for _, content := range contents {
+		w := gzip.NewWriter(file)
+		_, err := w.Write([]byte(content))
+		c.Assert(err, chk.IsNil)
+		c.Assert(w.Close(), chk.IsNil)
+	}
+	fileBytes := file.Bytes()
+
+	ranges, err := FindGzipMemberRanges(bytes.NewReader(fileBytes))
+	c.Assert(err, chk.IsNil)
+	c.Assert(ranges, chk.HasLen, len(contents))
+
+	// each range must be an independently-decompressible member, and together they must cover the file
+	expectedOffset := int64(0)
+	for i, r := range ranges {
+		c.Assert(r.Offset, chk.Equals, expectedOffset)
+
+		zr, err := gzip.NewReader(bytes.NewReader(fileBytes[r.Offset : r.Offset+r.Length]))
+		c.Assert(err, chk.IsNil)
+		zr.Multistream(false)
+		decompressed, err := ioutil.ReadAll(zr)
+		c.Assert(err, chk.IsNil)
+		c.Assert(string(decompressed), chk.Equals, contents[i])
+
+		expectedOffset += r.Length
+	}
+	c.Assert(expectedOffset, chk.Equals, int64(len(fileBytes)))
+}
+
+func (s *gzipMemberScannerSuite) TestFindGzipMemberRangesRejectsNonGzip(c *chk.C) {
+	_, err := FindGzipMemberRanges(bytes.NewReader([]byte("not a gzip file")))
+	c.Assert(err, chk.NotNil)
+}
@@ -0,0 +1,99 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+
+	chk "gopkg.in/check.v1"
+)
+
+type hashingReadSeekerSuite struct{}
+
+var _ = chk.Suite(&hashingReadSeekerSuite{})
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+func newTestHashingChunkReader(fileContent []byte) (*HashingReadSeeker, SingleChunkReader) {
+	source := newFaultyReaderAt(fileContent)
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	chunkReader := NewSingleChunkReader(context.Background(), factory, NewChunkID("test", 0, int64(len(fileContent))), int64(len(fileContent)),
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024*1024), NewCacheLimiter(1024*1024))
+	return NewHashingReadSeeker(chunkReader, crc64.New(crc64Table)), chunkReader
+}
+
+func (s *hashingReadSeekerSuite) TestHashSurvivesRetry(c *chk.C) {
+	fileContent := newTestFile(10000)
+	expected := crc64.Checksum(fileContent, crc64Table)
+	reader, chunkReader := newTestHashingChunkReader(fileContent)
+	defer chunkReader.Close()
+
+	// first pass
+	data, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(bytes.Equal(data, fileContent), chk.Equals, true)
+	sum, err := reader.Sum()
+	c.Assert(err, chk.IsNil)
+	c.Assert(crc64FromBytes(sum), chk.Equals, expected)
+
+	// retry, after a partial read
+	_, err = reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	_, err = reader.Read(make([]byte, 1234))
+	c.Assert(err, chk.IsNil)
+	_, err = reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	_, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	sum, err = reader.Sum()
+	c.Assert(err, chk.IsNil)
+	c.Assert(crc64FromBytes(sum), chk.Equals, expected)
+}
+
+func (s *hashingReadSeekerSuite) TestHashIncompleteAfterSkippingData(c *chk.C) {
+	reader, chunkReader := newTestHashingChunkReader(newTestFile(10000))
+	defer chunkReader.Close()
+
+	_, err := reader.Seek(5000, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	_, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	_, err = reader.Sum()
+	c.Assert(err, chk.Equals, ErrHashIncomplete)
+
+	// not done yet, either
+	_, err = reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	_, err = reader.Sum()
+	c.Assert(err, chk.Equals, ErrHashIncomplete)
+}
+
+func crc64FromBytes(b []byte) uint64 {
+	var result uint64
+	for _, x := range b {
+		result = result<<8 | uint64(x)
+	}
+	return result
+}
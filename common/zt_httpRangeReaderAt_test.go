@@ -0,0 +1,67 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	chk "gopkg.in/check.v1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+type httpRangeReaderAtSuite struct{}
+
+var _ = chk.Suite(&httpRangeReaderAtSuite{})
+
+func (s *httpRangeReaderAtSuite) TestReadsRanges(c *chk.C) {
+	fileContent := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(fileContent))
+	}))
+	defer server.Close()
+
+	r := NewHTTPRangeReaderAt(context.Background(), nil, server.URL)
+
+	buf := make([]byte, 10)
+	n, err := r.ReadAt(buf, 5)
+	c.Assert(err, chk.IsNil)
+	c.Assert(n, chk.Equals, 10)
+	c.Assert(string(buf), chk.Equals, "56789abcde")
+
+	// reading over the end gives what there is, and EOF
+	n, err = r.ReadAt(buf, 30)
+	c.Assert(err, chk.Equals, io.EOF)
+	c.Assert(string(buf[:n]), chk.Equals, "uvwxyz")
+}
+
+func (s *httpRangeReaderAtSuite) TestRangeNotSupported(c *chk.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("the whole object, every time"))
+	}))
+	defer server.Close()
+
+	r := NewHTTPRangeReaderAt(context.Background(), nil, server.URL)
+	_, err := r.ReadAt(make([]byte, 4), 2)
+	c.Assert(err, chk.Equals, ErrRangeNotSupported)
+}
@@ -23,6 +23,8 @@ package common
 import (
 	chk "gopkg.in/check.v1"
 	"math"
+	"testing"
+	"time"
 )
 
 type multiSliceBytePoolerSuite struct{}
@@ -64,3 +66,547 @@ func (s *multiSliceBytePoolerSuite) TestMultiSliceSlotInfo(c *chk.C) {
 	}
 
 }
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceRoundedDownReuse(c *chk.C) {
+	pool := NewMultiSizeSlicePoolWithOptions(8*1024, SlicePoolOptions{Rounding: ESlotRounding.Down()})
+
+	// allocations are exact, not rounded up
+	slice := pool.RentSlice(5000)
+	c.Assert(len(slice), chk.Equals, 5000)
+	c.Assert(cap(slice), chk.Equals, 5000)
+
+	// a returned slice is reused when it's big enough...
+	pool.ReturnSlice(slice)
+	reused := pool.RentSlice(4500)
+	c.Assert(len(reused), chk.Equals, 4500)
+	c.Assert(cap(reused), chk.Equals, 5000)
+
+	// ...but not when it's too small, even though the request maps to the same slot
+	pool.ReturnSlice(reused)
+	bigger := pool.RentSlice(6000)
+	c.Assert(len(bigger), chk.Equals, 6000)
+	c.Assert(cap(bigger), chk.Equals, 6000)
+
+	// and the small one is still there for later
+	c.Assert(cap(pool.RentSlice(4096)), chk.Equals, 5000)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceDescribe(c *chk.C) {
+	pool := NewMultiSizeSlicePool(8)
+	pool.ReturnSlice(pool.RentSlice(4))
+	pool.ReturnSlice(make([]byte, 8))
+
+	description := pool.Describe()
+	c.Assert(description, chk.HasLen, 4)
+	for i, d := range description {
+		c.Assert(d.Index, chk.Equals, i)
+		c.Assert(d.SliceCapacity, chk.Equals, 1<<uint(i))
+		c.Assert(d.MaxPooledCount, chk.Equals, getMaxSliceCountInPool(i))
+	}
+	c.Assert(description[1].PooledCount, chk.Equals, 0)
+	c.Assert(description[2].PooledCount, chk.Equals, 1)
+	c.Assert(description[3].PooledCount, chk.Equals, 1)
+
+	c.Assert(pool.String(), chk.Equals, "slot 0: 1 byte slices, 0 of 500 pooled\n"+
+		"slot 1: 2 byte slices, 0 of 500 pooled\n"+
+		"slot 2: 4 byte slices, 1 of 500 pooled\n"+
+		"slot 3: 8 byte slices, 1 of 500 pooled\n")
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceStatsAndReset(c *chk.C) {
+	pool := NewMultiSizeSlicePool(8)
+
+	slice := pool.RentSlice(8) // miss
+	pool.ReturnSlice(slice)
+	pool.RentSlice(8) // hit
+
+	stats := pool.StatsAndReset()
+	c.Assert(stats, chk.HasLen, 4)
+	c.Assert(stats[3], chk.Equals, SlicePoolStats{Hits: 1, Misses: 1})
+
+	// everything is zero after the reset
+	for _, slotStats := range pool.StatsAndReset() {
+		c.Assert(slotStats, chk.Equals, SlicePoolStats{})
+	}
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSlicePoolStats(c *chk.C) {
+	pool := NewMultiSizeSlicePool(8)
+	maxPooled := getMaxSliceCountInPool(3)
+
+	// rent more than the slot can hold, then return them all, so the extras are dropped
+	rented := make([][]byte, maxPooled+10)
+	for i := range rented {
+		rented[i] = pool.RentSlice(8) // all misses
+	}
+	for _, slice := range rented {
+		pool.ReturnSlice(slice)
+	}
+
+	// these are all served from the pool
+	for i := 0; i < 5; i++ {
+		pool.RentSlice(8)
+	}
+
+	expected := SlicePoolStats{Hits: 5, Misses: int64(maxPooled + 10), Drops: 10}
+	stats := pool.PoolStats()
+	c.Assert(stats, chk.HasLen, 4)
+	c.Assert(stats[3], chk.Equals, expected)
+	c.Assert(TotalSlicePoolStats(stats), chk.Equals, expected)
+
+	// StatsAndReset doesn't affect the totals, and only reports what happened since it was last called
+	c.Assert(pool.StatsAndReset()[3], chk.Equals, expected)
+	pool.RentSlice(8)
+	c.Assert(pool.StatsAndReset()[3], chk.Equals, SlicePoolStats{Hits: 1})
+	c.Assert(pool.PoolStats()[3], chk.Equals, SlicePoolStats{Hits: 6, Misses: int64(maxPooled + 10), Drops: 10})
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceSlotCapacity(c *chk.C) {
+	type call struct{ slotIndex, maxCapInSlot int }
+	calls := make([]call, 0)
+	pool := NewMultiSizeSlicePoolWithCapacity(1024, func(slotIndex int, maxCapInSlot int) int {
+		calls = append(calls, call{slotIndex, maxCapInSlot})
+		if maxCapInSlot >= 512 {
+			return 2 // hold the big ones to just a couple of buffers
+		}
+		return 50
+	})
+
+	// called once per slot, in order, with the right cap for each
+	c.Assert(calls, chk.HasLen, 11)
+	for i, cl := range calls {
+		c.Assert(cl, chk.Equals, call{i, 1 << uint(i)})
+	}
+
+	d := pool.Describe()
+	c.Assert(d[8].MaxPooledCount, chk.Equals, 50)
+	c.Assert(d[9].MaxPooledCount, chk.Equals, 2)
+	c.Assert(d[10].MaxPooledCount, chk.Equals, 2)
+
+	// the limit is enforced
+	for i := 0; i < 3; i++ {
+		pool.ReturnSlice(make([]byte, 1024))
+	}
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 2)
+	c.Assert(pool.PoolStats()[10].Drops, chk.Equals, int64(1))
+
+	// a slot with no capacity pools nothing
+	pool = NewMultiSizeSlicePoolWithCapacity(8, func(int, int) int { return 0 })
+	pool.ReturnSlice(make([]byte, 8))
+	c.Assert(pool.Describe()[3].PooledCount, chk.Equals, 0)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceRentZeroed(c *chk.C) {
+	pools := []MultiSizeSlicePooler{
+		NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{Rounding: ESlotRounding.Up()}),
+		NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{Rounding: ESlotRounding.Down()}),
+		NewRentHistogramSlicePool(NewMultiSizeSlicePool(1024)),
+	}
+	for _, pool := range pools {
+
+		dirty := pool.RentSlice(1000)
+		for i := range dirty {
+			dirty[i] = 0xFF
+		}
+		pool.ReturnSlice(dirty)
+
+		zeroed := pool.RentSliceZeroed(600)
+		c.Assert(zeroed, chk.HasLen, 600)
+		c.Assert(&zeroed[0], chk.Equals, &dirty[0]) // make sure we really did get the dirty one back from the pool
+		for _, b := range zeroed {
+			c.Assert(b, chk.Equals, byte(0))
+		}
+	}
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceRentedSliceCheck(c *chk.C) {
+	debugCheckRentedSlices = true
+	defer func() { debugCheckRentedSlices = false }()
+
+	for _, rounding := range []SlotRounding{ESlotRounding.Up(), ESlotRounding.Down()} {
+		pool := NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{Rounding: rounding})
+		for size := uint32(1); size <= 1024; size++ {
+			pool.ReturnSlice(pool.RentSlice(size)) // would panic if the check failed
+		}
+	}
+
+	c.Assert(func() { checkRentedSlice(make([]byte, 3, 10), 4) }, chk.PanicMatches, "slice pool bookkeeping error.*")
+	checkRentedSlice(make([]byte, 4, 10), 4) // must not panic
+}
+
+func (s *multiSliceBytePoolerSuite) TestRecommendedMaxSliceLength(c *chk.C) {
+	c.Assert(RecommendedMaxSliceLength(0), chk.Equals, uint32(1))
+	c.Assert(RecommendedMaxSliceLength(1), chk.Equals, uint32(1))
+	c.Assert(RecommendedMaxSliceLength(3), chk.Equals, uint32(4))
+	c.Assert(RecommendedMaxSliceLength(8*1024*1024), chk.Equals, uint32(8*1024*1024))
+	c.Assert(RecommendedMaxSliceLength(8*1024*1024+1), chk.Equals, uint32(16*1024*1024))
+	c.Assert(RecommendedMaxSliceLength(100*1024*1024), chk.Equals, uint32(128*1024*1024))
+	c.Assert(RecommendedMaxSliceLength(math.MaxUint32), chk.Equals, uint32(1<<31))
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceMaxRentSize(c *chk.C) {
+	pool := NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{MaxRentSize: 512})
+
+	slice, err := pool.TryRentSlice(512)
+	c.Assert(err, chk.IsNil)
+	c.Assert(slice, chk.HasLen, 512)
+	c.Assert(pool.LargestRentSize(), chk.Equals, uint32(512))
+
+	_, err = pool.TryRentSlice(513)
+	c.Assert(err, chk.ErrorMatches, "cannot rent a slice of 513 bytes.*")
+
+	// RentSlice can't return an error, so it panics, whether or not debugCheckRentedSlices is on
+	c.Assert(debugCheckRentedSlices, chk.Equals, false)
+	c.Assert(func() { pool.RentSlice(2048) }, chk.PanicMatches, "cannot rent a slice of 2048 bytes.*")
+
+	// over-sized requests are still observed, even though they fail
+	c.Assert(pool.LargestRentSize(), chk.Equals, uint32(2048))
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceDrainIdle(c *chk.C) {
+	pool := NewMultiSizeSlicePool(1024)
+
+	pool.ReturnSlice(pool.RentSlice(1024))
+	pool.ReturnSlice(pool.RentSlice(16))
+	time.Sleep(100 * time.Millisecond)
+
+	// only the 16 byte slot has been used recently
+	pool.ReturnSlice(pool.RentSlice(16))
+	c.Assert(pool.DrainIdle(50*time.Millisecond), chk.Equals, 1)
+
+	// later, the 16 byte slot is idle too, but returning slices makes the 1024 byte slot busy again, so it keeps them
+	time.Sleep(100 * time.Millisecond)
+	pool.ReturnSlice(make([]byte, 1024))
+	pool.ReturnSlice(make([]byte, 1024))
+	c.Assert(pool.DrainIdle(50*time.Millisecond), chk.Equals, 1)
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 2)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceDrain(c *chk.C) {
+	pool := NewMultiSizeSlicePool(1024)
+	for i := 0; i < 3; i++ {
+		pool.ReturnSlice(make([]byte, 1024))
+		pool.ReturnSlice(make([]byte, 16))
+	}
+
+	// everything goes, even though the slots were just used
+	c.Assert(pool.Drain(), chk.Equals, 6)
+	c.Assert(pool.Snapshot().TotalPooledBytes(), chk.Equals, int64(0))
+	c.Assert(pool.Drain(), chk.Equals, 0)
+
+	// so later rents are fresh allocations
+	pool.StatsAndReset()
+	pool.RentSlice(1024)
+	pool.RentSlice(16)
+	total := TotalSlicePoolStats(pool.StatsAndReset())
+	c.Assert(total, chk.Equals, SlicePoolStats{Misses: 2})
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceDrainWhileInUse(c *chk.C) {
+	pool := NewMultiSizeSlicePool(1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			pool.ReturnSlice(pool.RentSlice(1024))
+		}
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+			pool.Drain() // must neither block nor panic
+		}
+	}
+	pool.Drain()
+	c.Assert(pool.Snapshot().TotalPooledBytes(), chk.Equals, int64(0))
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceSwapSlice(c *chk.C) {
+	pool := NewMultiSizeSlicePool(1024)
+
+	// same slot, so the old slice comes straight back, cleared
+	old := pool.RentSlice(1000)
+	old[0] = 1
+	swapped := pool.SwapSlice(old, 900)
+	c.Assert(len(swapped), chk.Equals, 900)
+	c.Assert(&swapped[0], chk.Equals, &old[0])
+	c.Assert(swapped[0], chk.Equals, byte(0))
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 0)
+	c.Assert(pool.StatsAndReset()[10], chk.Equals, SlicePoolStats{Hits: 1, Misses: 1})
+
+	// different slot, so the old slice is pooled and a new one rented
+	swapped = pool.SwapSlice(swapped, 16)
+	c.Assert(len(swapped), chk.Equals, 16)
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 1)
+
+	// a slice that didn't come from the pool, and doesn't have the slot's capacity, is never handed back
+	foreign := make([]byte, 600)
+	c.Assert(cap(pool.SwapSlice(foreign, 600)), chk.Equals, 1024)
+
+	// with no old slice, it's just a rent
+	c.Assert(pool.SwapSlice(nil, 600), chk.HasLen, 600)
+	c.Assert(pool.SwapSlice([]byte{}, 600), chk.HasLen, 600)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceSwapSliceRoundedDown(c *chk.C) {
+	pool := NewMultiSizeSlicePoolWithOptions(8*1024, SlicePoolOptions{Rounding: ESlotRounding.Down()})
+
+	old := pool.RentSlice(5000)
+	c.Assert(&pool.SwapSlice(old, 4500)[0], chk.Equals, &old[0])
+
+	// too small for the request, even though it's the same slot
+	bigger := pool.SwapSlice(old, 6000)
+	c.Assert(cap(bigger), chk.Equals, 6000)
+	c.Assert(pool.Describe()[12].PooledCount, chk.Equals, 1)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceRentRoundedUp(c *chk.C) {
+	pool := NewMultiSizeSlicePool(1024)
+
+	// the whole slot's capacity is available to append into, without reallocating
+	buf, capacity := pool.RentSliceRoundedUp(600)
+	c.Assert(len(buf), chk.Equals, 0)
+	c.Assert(capacity, chk.Equals, 1024)
+	c.Assert(cap(buf), chk.Equals, 1024)
+	buf = append(buf, make([]byte, 1000)...)
+	buf = append(buf, 1)
+	c.Assert(cap(buf), chk.Equals, 1024)
+	pool.ReturnSlice(buf)
+
+	// and the slice comes back from the pool, cleared
+	again, capacity := pool.RentSliceRoundedUp(1024)
+	c.Assert(capacity, chk.Equals, 1024)
+	c.Assert(again[:1024][1000], chk.Equals, byte(0))
+	c.Assert(pool.StatsAndReset()[10], chk.Equals, SlicePoolStats{Hits: 1, Misses: 1})
+
+	// a pool that rounds down still gives at least the next power of 2
+	down := NewMultiSizeSlicePoolWithOptions(8*1024, SlicePoolOptions{Rounding: ESlotRounding.Down()})
+	buf, capacity = down.RentSliceRoundedUp(5000)
+	c.Assert(len(buf), chk.Equals, 0)
+	c.Assert(capacity, chk.Equals, 8*1024)
+
+	c.Assert(func() {
+		NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{MaxRentSize: 1000}).RentSliceRoundedUp(1001)
+	}, chk.PanicMatches, ".*maximum allowed is 1000 bytes")
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceWouldPool(c *chk.C) {
+	pool := NewMultiSizeSlicePool(64 * 1024)
+	slotIndex, _ := getSlotInfo(64 * 1024)
+	maxCount := getMaxSliceCountInPool(slotIndex)
+
+	for i := 0; i < maxCount; i++ {
+		c.Assert(pool.WouldPool(64*1024), chk.Equals, true)
+		pool.ReturnSlice(make([]byte, 64*1024))
+	}
+	c.Assert(pool.WouldPool(64*1024), chk.Equals, false)
+	c.Assert(pool.WouldPool(1024), chk.Equals, true) // other slots are unaffected
+
+	// there's no slot at all for these
+	c.Assert(pool.WouldPool(128*1024), chk.Equals, false)
+	c.Assert(pool.WouldPool(0), chk.Equals, false)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceWouldPoolAgreesWithReturnSlice(c *chk.C) {
+	pooledCount := func(pool MultiSizeSlicePooler) int {
+		total := 0
+		for _, slot := range pool.Describe() {
+			total += slot.PooledCount
+		}
+		return total
+	}
+
+	for _, rounding := range []SlotRounding{ESlotRounding.Up(), ESlotRounding.Down()} {
+		for _, capacity := range []uint32{1, 1000, 1024, 1025, 3000, 4096, 8192} {
+			pool := NewMultiSizeSlicePoolWithOptions(4096, SlicePoolOptions{Rounding: rounding})
+			wouldPool := pool.WouldPool(capacity)
+			pool.ReturnSlice(make([]byte, capacity))
+			c.Assert(wouldPool, chk.Equals, pooledCount(pool) == 1, chk.Commentf("%v rounding, capacity %d", rounding, capacity))
+		}
+	}
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceMaxSlots(c *chk.C) {
+	pool := NewMultiSizeSlicePoolWithOptions(math.MaxUint32, SlicePoolOptions{MaxSlots: 11}) // slots up to 1 KB
+	c.Assert(pool.Describe(), chk.HasLen, 11)
+
+	// bigger slices can still be rented and returned, but aren't pooled
+	for i := 0; i < 2; i++ {
+		slice := pool.RentSlice(1025)
+		c.Assert(len(slice), chk.Equals, 1025)
+		pool.ReturnSlice(slice)
+	}
+	c.Assert(pool.WouldPool(1025), chk.Equals, false)
+	c.Assert(pool.SwapSlice(pool.RentSlice(2048), 2048), chk.HasLen, 2048)
+
+	// and sizes within the slots are pooled as usual
+	pool.ReturnSlice(pool.RentSlice(1024))
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 1)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceBeyondMaxSliceLength(c *chk.C) {
+	for _, rounding := range []SlotRounding{ESlotRounding.Up(), ESlotRounding.Down()} {
+		pool := NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{Rounding: rounding})
+		slotCount := len(pool.Describe())
+
+		// over-size rents and returns bypass the pool, rather than running off the end of the slots.
+		// (When rounding down, the top slot also holds slices up to 2047 bytes, so they aren't over-size)
+		for _, size := range []uint32{2048, 4097, 10 * 1024 * 1024} {
+			slice := pool.RentSlice(size)
+			c.Assert(slice, chk.HasLen, int(size))
+			pool.ReturnSlice(slice)
+
+			zeroed := pool.RentSliceZeroed(size)
+			c.Assert(zeroed, chk.HasLen, int(size))
+			pool.ReturnSlice(zeroed)
+
+			buf, capacity := pool.RentSliceRoundedUp(size)
+			c.Assert(buf, chk.HasLen, 0)
+			c.Assert(capacity >= int(size), chk.Equals, true)
+			pool.ReturnSlice(buf)
+
+			c.Assert(pool.SwapSlice(pool.RentSlice(size), size), chk.HasLen, int(size))
+			c.Assert(pool.WouldPool(size), chk.Equals, false)
+		}
+
+		// nothing was pooled, and no slots were added
+		c.Assert(pool.Describe(), chk.HasLen, slotCount)
+		c.Assert(pool.Snapshot().TotalPooledBytes(), chk.Equals, int64(0))
+	}
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceRentHistogram(c *chk.C) {
+	pool := NewRentHistogramSlicePool(NewMultiSizeSlicePool(math.MaxUint32))
+	for _, size := range []uint32{1, 3, 4, 5, 1000, 1024} {
+		pool.ReturnSlice(pool.RentSlice(size))
+	}
+	_, err := pool.TryRentSlice(1025)
+	c.Assert(err, chk.IsNil)
+	c.Assert(pool.SwapSlice(pool.RentSlice(2), 8), chk.HasLen, 8)
+
+	c.Assert(pool.RentSizeHistogram(), chk.DeepEquals, []RentSizeBucket{
+		{SizeClass: 1, Count: 1},
+		{SizeClass: 2, Count: 1},
+		{SizeClass: 4, Count: 2},
+		{SizeClass: 8, Count: 2},
+		{SizeClass: 1024, Count: 2},
+		{SizeClass: 2048, Count: 1},
+	})
+
+	// pooling is unaffected
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 1)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceRebuildSlot(c *chk.C) {
+	pool := NewMultiSizeSlicePool(1024)
+	for i := 0; i < 5; i++ {
+		pool.ReturnSlice(make([]byte, 1024))
+	}
+	pool.ReturnSlice(make([]byte, 512))
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 5)
+
+	pool.RebuildSlot(10)
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 0)
+	c.Assert(pool.Describe()[10].MaxPooledCount, chk.Equals, 500)
+	c.Assert(pool.Describe()[9].PooledCount, chk.Equals, 1) // other slots are untouched
+	c.Assert(func() { pool.RebuildSlot(11) }, chk.PanicMatches, "cannot rebuild slot 11, since the pool only has slots 0 to 10")
+
+	// rents and returns may carry on while slots are rebuilt
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 1000; i++ {
+				slice := pool.RentSlice(1000)
+				c.Check(len(slice), chk.Equals, 1000)
+				pool.ReturnSlice(slice)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		pool.RebuildSlot(10)
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+	c.Assert(pool.Describe()[10].PooledCount <= 4, chk.Equals, true)
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceRejectsMisSizedReturns(c *chk.C) {
+	rejected := make([]int, 0)
+	pool := NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{
+		OnRejectedReturn: func(slice []byte) { rejected = append(rejected, cap(slice)) }})
+	rented := pool.RentSlice(700)
+	pool.ReturnSlice(make([]byte, 1000)) // would go in the 1024 slot, but it's too small for it
+	pool.ReturnSlice(make([]byte, 10, 1024))
+	pool.ReturnSlice(rented)
+	c.Assert(rejected, chk.DeepEquals, []int{1000})
+	c.Assert(pool.Describe()[10].PooledCount, chk.Equals, 2)
+	c.Assert(pool.StatsAndReset()[10].Drops, chk.Equals, int64(1))
+
+	// with no callback, mis-sized slices are still dropped, so they are never handed out as full-capacity buffers
+	pool = NewMultiSizeSlicePool(1024)
+	pool.ReturnSlice(make([]byte, 100))
+	c.Assert(pool.Describe()[7].PooledCount, chk.Equals, 0)
+	slice := pool.RentSlice(120) // same slot. Would panic if it got the cap 100 slice
+	c.Assert(slice, chk.HasLen, 120)
+	c.Assert(cap(slice), chk.Equals, 128)
+
+	// rounding down expects odd caps, so they are pooled
+	roundedDown := NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{Rounding: ESlotRounding.Down()})
+	roundedDown.ReturnSlice(make([]byte, 1000))
+	c.Assert(roundedDown.Describe()[9].PooledCount, chk.Equals, 1)
+}
+
+var benchmarkSlotIndex int
+
+func BenchmarkGetSlotInfo(b *testing.B) {
+	// the block sizes that are commonly used, plus a few odd sizes such as final chunks
+	sizes := []uint32{4 * 1024 * 1024, 8 * 1024 * 1024, 100 * 1024 * 1024, 16 * 1024 * 1024, 12345, 8 * 1024 * 1024, 4 * 1024 * 1024, 1}
+	for i := 0; i < b.N; i++ {
+		for _, size := range sizes {
+			slotIndex, _ := getSlotInfo(size)
+			benchmarkSlotIndex += slotIndex
+		}
+	}
+}
+
+func (s *multiSliceBytePoolerSuite) TestMultiSliceSnapshot(c *chk.C) {
+	pool := NewMultiSizeSlicePool(1024)
+	for i := 0; i < 3; i++ {
+		pool.ReturnSlice(make([]byte, 1024))
+	}
+	pool.ReturnSlice(make([]byte, 512))
+	snapshot := pool.Snapshot()
+	c.Assert(snapshot.PooledCounts, chk.HasLen, 11)
+	c.Assert(snapshot.PooledCounts[10], chk.Equals, int64(3))
+	c.Assert(snapshot.PooledCounts[9], chk.Equals, int64(1))
+	c.Assert(snapshot.PooledBytes[10], chk.Equals, int64(3*1024))
+	c.Assert(snapshot.TotalPooledBytes(), chk.Equals, int64(3*1024+512))
+
+	// under concurrent use, the counts stay within what the slot can hold, and settle on the channel's length
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 1000; i++ {
+				pool.ReturnSlice(pool.RentSlice(1000))
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		count := pool.Snapshot().PooledCounts[10]
+		c.Assert(count >= 0 && count <= 500, chk.Equals, true)
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+	c.Assert(pool.Snapshot().PooledCounts[10], chk.Equals, int64(pool.Describe()[10].PooledCount))
+
+	// a rebuilt slot starts from zero
+	pool.RebuildSlot(10)
+	c.Assert(pool.Snapshot().PooledCounts[10], chk.Equals, int64(0))
+	c.Assert(pool.Snapshot().PooledCounts[9], chk.Equals, int64(1))
+}
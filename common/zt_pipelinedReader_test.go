@@ -0,0 +1,133 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	chk "gopkg.in/check.v1"
+)
+
+type pipelinedReaderSuite struct{}
+
+var _ = chk.Suite(&pipelinedReaderSuite{})
+
+// offsetRecordingReaderAt reports the offset of each read on a channel, so tests can see reads that happen in the background
+type offsetRecordingReaderAt struct {
+	inner   io.ReaderAt
+	offsets chan int64
+}
+
+func (r *offsetRecordingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.offsets <- off
+	return r.inner.ReadAt(p, off)
+}
+
+func (s *pipelinedReaderSuite) TestPipelinedReaderPrefetchesNextWindow(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &offsetRecordingReaderAt{inner: bytes.NewReader(fileContent), offsets: make(chan int64, 10)}
+	limiter := NewCacheLimiter(1000)
+	reader := NewPipelinedReader(context.Background(), source, "test", 100, 750, 300, NewMultiSizeSlicePool(1024), limiter)
+
+	// the first window is read as soon as the reader is made, and the second as soon as the first is in use
+	c.Assert(<-source.offsets, chk.Equals, int64(100))
+	p := make([]byte, 10)
+	n, err := reader.Read(p)
+	c.Assert(err, chk.IsNil)
+	c.Assert(p[:n], chk.DeepEquals, fileContent[100:110])
+	c.Assert(<-source.offsets, chk.Equals, int64(400))
+
+	rest, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(rest, chk.DeepEquals, fileContent[110:850])
+	c.Assert(<-source.offsets, chk.Equals, int64(700))
+	c.Assert(reader.Close(), chk.IsNil)
+	c.Assert(limiter.TryAdd(750, false), chk.Equals, true) // everything was released
+}
+
+func (s *pipelinedReaderSuite) TestPipelinedReaderWithoutBudget(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &offsetRecordingReaderAt{inner: bytes.NewReader(fileContent), offsets: make(chan int64, 10)}
+
+	// the strict limit leaves room for only one window, so each of the others is read when it's needed
+	limiter := NewCacheLimiter(500)
+	reader := NewPipelinedReader(context.Background(), source, "test", 0, 1000, 300, nil, limiter)
+	p := make([]byte, 300)
+	_, err := io.ReadFull(reader, p)
+	c.Assert(err, chk.IsNil)
+	c.Assert(len(source.offsets), chk.Equals, 1)
+
+	data, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, fileContent[300:])
+	c.Assert(reader.Close(), chk.IsNil)
+	c.Assert(limiter.TryAdd(375, false), chk.Equals, true)
+}
+
+func (s *pipelinedReaderSuite) TestPipelinedReaderClose(c *chk.C) {
+	fileContent := newTestFile(1000)
+	limiter := NewCacheLimiter(1000)
+	reader := NewPipelinedReader(context.Background(), bytes.NewReader(fileContent), "test", 0, 1000, 300, nil, limiter)
+	_, err := reader.Read(make([]byte, 10))
+	c.Assert(err, chk.IsNil)
+
+	// closing part way through releases the current window and the prefetched one
+	c.Assert(reader.Close(), chk.IsNil)
+	c.Assert(limiter.TryAdd(750, false), chk.Equals, true)
+	_, err = reader.Read(make([]byte, 10))
+	c.Assert(err, chk.Equals, ErrClosedReader)
+	c.Assert(reader.Close(), chk.IsNil)
+
+	// and a read past the end of the source is reported
+	reader = NewPipelinedReader(context.Background(), bytes.NewReader(fileContent), "test", 900, 200, 300, nil, NewCacheLimiter(1000))
+	defer reader.Close()
+	_, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.ErrorMatches, "short read from test: expected 200 bytes at offset 900, but got 100.*")
+}
+
+func (s *pipelinedReaderSuite) TestPipelinedReaderRetriesFailedWindow(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := newFaultyReaderAt(fileContent)
+	source.errorsAtOffsets[400] = errors.New("transient failure")
+	limiter := NewCacheLimiter(1000)
+	reader := NewPipelinedReader(context.Background(), source, "test", 100, 750, 300, nil, limiter)
+
+	// the second window, which was prefetched, fails
+	p := make([]byte, 300)
+	_, err := io.ReadFull(reader, p)
+	c.Assert(err, chk.IsNil)
+	c.Assert(p, chk.DeepEquals, fileContent[100:400])
+	_, err = reader.Read(p)
+	c.Assert(err, chk.ErrorMatches, "transient failure")
+
+	// once the source recovers, the reader carries on from the failed window, rather than skipping it
+	// (nothing is being read in the background at this point, so it's safe to change the source)
+	delete(source.errorsAtOffsets, 400)
+	rest, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(rest, chk.DeepEquals, fileContent[400:850])
+	c.Assert(reader.Close(), chk.IsNil)
+	c.Assert(limiter.TryAdd(750, false), chk.Equals, true)
+}
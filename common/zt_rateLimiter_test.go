@@ -0,0 +1,67 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type rateLimiterSuite struct{}
+
+var _ = chk.Suite(&rateLimiterSuite{})
+
+func (s *rateLimiterSuite) TestRateLimiterSharedBetweenGoroutines(c *chk.C) {
+	limiter := NewRateLimiter(10000, 1000)
+
+	// the burst goes straight through, but the next 2000 units, between two users, take about 200ms
+	start := time.Now()
+	c.Assert(limiter.WaitN(context.Background(), 1000), chk.IsNil)
+	c.Assert(time.Since(start) < 50*time.Millisecond, chk.Equals, true)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(limiter.WaitN(context.Background(), 1000), chk.IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(time.Since(start) >= 190*time.Millisecond, chk.Equals, true)
+}
+
+func (s *rateLimiterSuite) TestRateLimiterCancellation(c *chk.C) {
+	limiter := NewRateLimiter(100, 1)
+
+	// more than the burst, so it must wait, and the context ends first
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c.Assert(limiter.WaitN(ctx, 100), chk.Equals, context.DeadlineExceeded)
+
+	// what the cancelled wait took was given back, so the limiter isn't left a second in debt
+	start := time.Now()
+	c.Assert(limiter.WaitN(context.Background(), 2), chk.IsNil)
+	c.Assert(time.Since(start) < 500*time.Millisecond, chk.Equals, true)
+}
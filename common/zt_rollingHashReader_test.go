@@ -0,0 +1,99 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash/adler32"
+	"io/ioutil"
+
+	chk "gopkg.in/check.v1"
+)
+
+type rollingHashReaderSuite struct{}
+
+var _ = chk.Suite(&rollingHashReaderSuite{})
+
+// windowSum computes the rolling sum of a window directly, for comparison
+func windowSum(window []byte) uint32 {
+	var a, b uint32
+	for _, x := range window {
+		a = (a + uint32(x)) % (1 << 16)
+		b = (b + a) % (1 << 16)
+	}
+	return a | b<<16
+}
+
+func (s *rollingHashReaderSuite) TestRollingSumMatchesWindow(c *chk.C) {
+	data := newTestFile(5000)
+	const windowSize = 48
+
+	for _, end := range []int{1, windowSize - 1, windowSize, windowSize + 1, 1000, 5000} {
+		r := NewRollingHashReader(bytes.NewReader(data[:end]), windowSize, 0)
+		_, err := ioutil.ReadAll(r)
+		c.Assert(err, chk.IsNil)
+
+		start := end - windowSize
+		if start < 0 {
+			start = 0
+		}
+		c.Assert(r.RollingSum(), chk.Equals, windowSum(data[start:end]), chk.Commentf("end %d", end))
+	}
+}
+
+func (s *rollingHashReaderSuite) TestBoundariesFollowContent(c *chk.C) {
+	data := newTestFile(200 * 1024)
+	const mask = 1<<12 - 1 // boundary about every 4 KB
+
+	r := NewRollingHashReader(bytes.NewReader(data), 64, mask)
+	_, err := ioutil.ReadAll(r)
+	c.Assert(err, chk.IsNil)
+	original := r.Boundaries()
+	c.Assert(len(original) > 10, chk.Equals, true)
+
+	// inserting data at the start moves every boundary along with the content
+	inserted := append([]byte("some new data at the start"), data...)
+	r = NewRollingHashReader(bytes.NewReader(inserted), 64, mask)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, chk.IsNil)
+	shifted := r.Boundaries()
+
+	shift := int64(len(inserted) - len(data))
+	found := make(map[int64]bool)
+	for _, b := range shifted {
+		found[b-shift] = true
+	}
+	for _, b := range original {
+		c.Assert(found[b], chk.Equals, true)
+	}
+}
+
+func (s *rollingHashReaderSuite) TestWeakAndStrongSums(c *chk.C) {
+	data := newTestFile(10000)
+	r := NewRollingHashReader(bytes.NewReader(data), 64, 0)
+	_, err := ioutil.ReadAll(r)
+	c.Assert(err, chk.IsNil)
+
+	strong := sha256.Sum256(data)
+	c.Assert(r.WeakSum(), chk.Equals, adler32.Checksum(data))
+	c.Assert(r.StrongSum(), chk.DeepEquals, strong[:])
+}
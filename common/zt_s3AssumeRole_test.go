@@ -0,0 +1,81 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/pkg/credentials"
+	chk "gopkg.in/check.v1"
+)
+
+type s3AssumeRoleSuite struct{}
+
+var _ = chk.Suite(&s3AssumeRoleSuite{})
+
+func (s *s3AssumeRoleSuite) TestSignAWSRequestV4(c *chk.C) {
+	// the "get-vanilla" case from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	cred := credentials.Value{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSRequestV4(req, nil, cred, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	c.Assert(req.Header.Get("Authorization"), chk.Equals, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31")
+}
+
+func (s *s3AssumeRoleSuite) TestAssumeRoleRetrieve(c *chk.C) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		form, _ = url.ParseQuery(string(body))
+		c.Check(strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=base-key/"), chk.Equals, true)
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult><Credentials>
+<AccessKeyId>role-key</AccessKeyId><SecretAccessKey>role-secret</SecretAccessKey><SessionToken>role-token</SessionToken>
+<Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`, expiration.Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	provider := &s3AssumeRoleProvider{
+		base:        credentials.NewStaticV4("base-key", "base-secret", ""),
+		role:        S3AssumeRoleInfo{RoleARN: "arn:aws:iam::123456789012:role/partner", ExternalID: "ext"},
+		stsEndpoint: server.URL,
+		stsRegion:   defaultSTSRegion,
+		client:      server.Client(),
+	}
+	c.Assert(provider.IsExpired(), chk.Equals, true) // nothing retrieved yet
+
+	value, err := provider.Retrieve()
+	c.Assert(err, chk.IsNil)
+	c.Assert(value, chk.Equals, credentials.Value{AccessKeyID: "role-key", SecretAccessKey: "role-secret", SessionToken: "role-token", SignerType: credentials.SignatureV4})
+	c.Assert(form.Get("RoleArn"), chk.Equals, "arn:aws:iam::123456789012:role/partner")
+	c.Assert(form.Get("ExternalId"), chk.Equals, "ext")
+	c.Assert(form.Get("RoleSessionName"), chk.Equals, defaultS3AssumeRoleSessionName)
+
+	// an hour to go is well outside the refresh window
+	c.Assert(provider.IsExpired(), chk.Equals, false)
+}
@@ -0,0 +1,113 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/minio/minio-go/pkg/s3signer"
+	chk "gopkg.in/check.v1"
+)
+
+type s3RequesterPaysTransportSuite struct{}
+
+var _ = chk.Suite(&s3RequesterPaysTransportSuite{})
+
+// roundTripperFunc lets a function be used as an http.RoundTripper
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (s *s3RequesterPaysTransportSuite) TestGetSignedRegion(c *chk.C) {
+	region, ok := getSignedRegion("AWS4-HMAC-SHA256 Credential=AKID/20190801/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc")
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(region, chk.Equals, "us-east-1")
+
+	// anonymous
+	_, ok = getSignedRegion("")
+	c.Assert(ok, chk.Equals, false)
+
+	// V2, which has no credential scope
+	_, ok = getSignedRegion("AWS AKID:c2lnbmF0dXJl")
+	c.Assert(ok, chk.Equals, false)
+
+	// malformed scopes
+	_, ok = getSignedRegion("AWS4-HMAC-SHA256 Credential=AKID/20190801/us-east-1, SignedHeaders=host, Signature=abc")
+	c.Assert(ok, chk.Equals, false)
+	_, ok = getSignedRegion("AWS4-HMAC-SHA256 Credential=")
+	c.Assert(ok, chk.Equals, false)
+}
+
+func (s *s3RequesterPaysTransportSuite) TestRoundTripResigns(c *chk.C) {
+	var sent *http.Request
+	transport := &s3RequesterPaysTransport{
+		credential: credentials.NewStaticV4("AKID", "secret", ""),
+		inner: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://bucket.s3.eu-west-1.amazonaws.com/?list-type=2", nil)
+	c.Assert(err, chk.IsNil)
+	req = s3signer.SignV4(*req, "AKID", "secret", "", "eu-west-1")
+	originalAuthorization := req.Header.Get("Authorization")
+
+	_, err = transport.RoundTrip(req)
+	c.Assert(err, chk.IsNil)
+
+	// the header is added, and signed, for the same region as before
+	c.Assert(sent.Header.Get("X-Amz-Request-Payer"), chk.Equals, "requester")
+	authorization := sent.Header.Get("Authorization")
+	c.Assert(authorization, chk.Not(chk.Equals), originalAuthorization)
+	c.Assert(strings.Contains(authorization, "SignedHeaders=host;x-amz-date;x-amz-request-payer,"), chk.Equals, true)
+	region, ok := getSignedRegion(authorization)
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(region, chk.Equals, "eu-west-1")
+
+	// and the caller's request is left alone
+	c.Assert(req.Header.Get("X-Amz-Request-Payer"), chk.Equals, "")
+	c.Assert(req.Header.Get("Authorization"), chk.Equals, originalAuthorization)
+}
+
+func (s *s3RequesterPaysTransportSuite) TestRoundTripAnonymous(c *chk.C) {
+	var sent *http.Request
+	transport := &s3RequesterPaysTransport{
+		credential: credentials.NewStaticV4("AKID", "secret", ""),
+		inner: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://bucket.s3.eu-west-1.amazonaws.com/key", nil)
+	c.Assert(err, chk.IsNil)
+	_, err = transport.RoundTrip(req)
+	c.Assert(err, chk.IsNil)
+
+	// the header is added, but there's no signature to redo
+	c.Assert(sent.Header.Get("X-Amz-Request-Payer"), chk.Equals, "requester")
+	c.Assert(sent.Header.Get("Authorization"), chk.Equals, "")
+}
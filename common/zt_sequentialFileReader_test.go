@@ -0,0 +1,76 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	chk "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+)
+
+type sequentialFileReaderSuite struct{}
+
+var _ = chk.Suite(&sequentialFileReaderSuite{})
+
+func (s *sequentialFileReaderSuite) TestSequentialFileReaderReadsAllChunks(c *chk.C) {
+	fileContent := []byte("0123456789abcdefghij-tail")
+	const chunkSize = 10
+	r := NewSequentialFileReader(bytes.NewReader(fileContent), "test", int64(len(fileContent)), chunkSize, NewMultiSizeSlicePool(1024))
+	defer r.Close()
+
+	reassembled := make([]byte, 0)
+	for {
+		id, chunkReader, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, chk.IsNil)
+		c.Assert(id.OffsetInFile(), chk.Equals, int64(len(reassembled)))
+
+		data, err := ioutil.ReadAll(chunkReader)
+		c.Assert(err, chk.IsNil)
+		c.Assert(int64(len(data)), chk.Equals, chunkReader.Length())
+		reassembled = append(reassembled, data...)
+	}
+
+	c.Assert(string(reassembled), chk.Equals, string(fileContent))
+}
+
+func (s *sequentialFileReaderSuite) TestSequentialFileReaderWithoutPool(c *chk.C) {
+	fileContent := []byte("0123456789abcdefghij-tail")
+	r := NewSequentialFileReader(bytes.NewReader(fileContent), "test", int64(len(fileContent)), 10, nil)
+
+	reassembled := make([]byte, 0)
+	for {
+		_, chunkReader, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, chk.IsNil)
+		data, err := ioutil.ReadAll(chunkReader)
+		c.Assert(err, chk.IsNil)
+		reassembled = append(reassembled, data...)
+	}
+	c.Assert(string(reassembled), chk.Equals, string(fileContent))
+	c.Assert(r.Close(), chk.IsNil)
+	c.Assert(r.Close(), chk.IsNil) // closing again is harmless
+}
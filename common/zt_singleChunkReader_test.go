@@ -0,0 +1,1012 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	chk "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+type singleChunkReaderSuite struct{}
+
+var _ = chk.Suite(&singleChunkReaderSuite{})
+
+type nullChunkStatusLogger struct{}
+
+func (nullChunkStatusLogger) LogChunkStatus(id ChunkID, reason WaitReason) {}
+func (nullChunkStatusLogger) IsWaitingOnFinalBodyReads() bool              { return false }
+
+type nullLogger struct{}
+
+func (nullLogger) ShouldLog(level pipeline.LogLevel) bool  { return false }
+func (nullLogger) Log(level pipeline.LogLevel, msg string) {}
+func (nullLogger) Panic(err error)                         { panic(err) }
+
+// closeableCountingReaderAt counts the reads made on a byte slice, so we can check how often the chunk reader goes to "disk"
+type closeableCountingReaderAt struct {
+	countingReaderAt
+}
+
+func (r *closeableCountingReaderAt) Close() error {
+	return nil
+}
+
+func newTestFile(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+// newTestChunkReader makes a reader for the given range of fileContent, and returns the counter of the reads made on the file
+func newTestChunkReader(fileContent []byte, offset int64, length int64) (SingleChunkReader, *closeableCountingReaderAt) {
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	reader := NewSingleChunkReader(context.Background(), factory, NewChunkID("test", offset, length), length,
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024*1024), NewCacheLimiter(1024*1024))
+	return reader, source
+}
+
+func (s *singleChunkReaderSuite) TestRepeatedSmallReadsUseBufferedData(c *chk.C) {
+	fileContent := newTestFile(1000)
+	reader, source := newTestChunkReader(fileContent, 100, 800)
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+
+	// read in small pieces, of a size that doesn't divide the chunk evenly
+	result := make([]byte, 0)
+	p := make([]byte, 7)
+	for {
+		n, err := reader.Read(p)
+		result = append(result, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, chk.IsNil)
+	}
+
+	c.Assert(bytes.Equal(result, fileContent[100:900]), chk.Equals, true)
+	c.Assert(source.count, chk.Equals, 1) // just the prefetch
+}
+
+// newFaultyChunkReader makes a reader for the given range of source, with nil pooling, so that failed reads can't affect other tests
+func newFaultyChunkReader(source *faultyReaderAt, offset int64, length int64) SingleChunkReader {
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	return NewSingleChunkReader(context.Background(), factory, NewChunkID("test", offset, length), length,
+		nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024))
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchReportsReadError(c *chk.C) {
+	source := newFaultyReaderAt(newTestFile(1000))
+	diskError := errors.New("disk error")
+	source.errorsAtOffsets[500] = diskError
+
+	// a chunk that covers the bad offset fails
+	reader := newFaultyChunkReader(source, 400, 200)
+	c.Assert(reader.BlockingPrefetch(source, false), chk.Equals, diskError)
+	reader.Close()
+
+	// but one that doesn't, works
+	reader = newFaultyChunkReader(source, 0, 400)
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchReportsShortRead(c *chk.C) {
+	source := newFaultyReaderAt(newTestFile(1000))
+	source.maxReadLength = 100
+
+	reader := newFaultyChunkReader(source, 0, 200)
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.ErrorMatches, "short read from test: expected 200 bytes at offset 0, but got 100.*")
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchReportsTruncatedFile(c *chk.C) {
+	source := newFaultyReaderAt(newTestFile(1000)) // the chunk runs past the end, as if the file had shrunk
+
+	reader := newFaultyChunkReader(source, 800, 500)
+	defer reader.Close()
+	err := reader.BlockingPrefetch(source, false)
+	c.Assert(err, chk.ErrorMatches, "short read from test: expected 500 bytes at offset 800, but got 200.*")
+	c.Assert(errors.Is(err, io.ErrUnexpectedEOF), chk.Equals, true)
+
+	shortRead := &ShortReadError{}
+	c.Assert(errors.As(err, &shortRead), chk.Equals, true)
+	c.Assert(*shortRead, chk.Equals, ShortReadError{FileName: "test", Offset: 800, ExpectedLength: 500, BytesRead: 200})
+
+	// as does a windowed reader, whether the short read is in the prefetched window, or later, in the pipeline
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	newWindowedReader := func(offset int64) SingleChunkReader {
+		return NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", offset, 500), 500,
+			nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{PrefetchWindowSize: 100})
+	}
+	windowed := newWindowedReader(950)
+	defer windowed.Close()
+	err = windowed.BlockingPrefetch(source, false)
+	c.Assert(errors.As(err, &shortRead), chk.Equals, true)
+	c.Assert(*shortRead, chk.Equals, ShortReadError{FileName: "test", Offset: 950, ExpectedLength: 100, BytesRead: 50})
+
+	windowed = newWindowedReader(800)
+	defer windowed.Close()
+	c.Assert(windowed.BlockingPrefetch(source, false), chk.IsNil) // the first window is all there
+	_, err = ioutil.ReadAll(windowed)
+	c.Assert(errors.As(err, &shortRead), chk.Equals, true)
+	c.Assert(*shortRead, chk.Equals, ShortReadError{FileName: "test", Offset: 1000, ExpectedLength: 100, BytesRead: 0})
+
+	// the sequential reader reports it the same way, rather than as the io.EOF that ends its chunks
+	sequential := NewSequentialFileReader(source, "test", 1200, 600, NewMultiSizeSlicePool(1024))
+	defer sequential.Close()
+	_, _, err = sequential.Next()
+	c.Assert(err, chk.IsNil)
+	_, _, err = sequential.Next()
+	c.Assert(err, chk.ErrorMatches, "short read from test: expected 600 bytes at offset 600, but got 400.*")
+}
+
+func (s *singleChunkReaderSuite) TestChunkCountLimiter(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := newFaultyReaderAt(fileContent)
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	countLimiter := semaphore.NewWeighted(3)
+	newReader := func(offset int64) SingleChunkReader {
+		return NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", offset, 100), 100,
+			nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{ChunkCountLimiter: countLimiter})
+	}
+
+	readers := []SingleChunkReader{newReader(0), newReader(100), newReader(200)}
+	for _, reader := range readers {
+		c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	}
+	c.Assert(countLimiter.TryAcquire(1), chk.Equals, false) // full, at exactly 3, even though the byte limit is far away
+
+	// a prefetch waits until a place is free
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	waiting := NewSingleChunkReaderWithOptions(ctx, factory, NewChunkID("test", 300, 100), 100,
+		nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{ChunkCountLimiter: countLimiter})
+	c.Assert(waiting.BlockingPrefetch(source, false), chk.Equals, context.DeadlineExceeded)
+	waiting.Close()
+
+	// but a retry doesn't, to avoid deadlock. And since it didn't take a place, closing it doesn't free one
+	retry := newReader(300)
+	c.Assert(retry.BlockingPrefetch(source, true), chk.IsNil)
+	retry.Close()
+	c.Assert(countLimiter.TryAcquire(1), chk.Equals, false)
+
+	// closing a reader frees its place
+	readers[0].Close()
+	c.Assert(countLimiter.TryAcquire(1), chk.Equals, true)
+	countLimiter.Release(1)
+
+	for _, reader := range readers[1:] {
+		reader.Close()
+	}
+	c.Assert(countLimiter.TryAcquire(3), chk.Equals, true) // all free again
+}
+
+func (s *singleChunkReaderSuite) TestPadToLength(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := newFaultyReaderAt(fileContent)
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+
+	// the final chunk of the file, padded to a 512 byte block
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 900, 100), 100,
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024), NewCacheLimiter(1024*1024), SingleChunkReaderOptions{PadToLength: 512})
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	c.Assert(reader.Length(), chk.Equals, int64(512))
+
+	result := &bytes.Buffer{}
+	_, err := io.Copy(result, reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(result.Len(), chk.Equals, 512)
+	c.Assert(bytes.Equal(result.Bytes()[:100], fileContent[900:]), chk.Equals, true)
+	c.Assert(bytes.Equal(result.Bytes()[100:], make([]byte, 412)), chk.Equals, true)
+}
+
+// a ByteSlicePooler that rents out slices full of junk, like a pool that doesn't clear the slices that are returned to it
+type dirtySlicePool struct{}
+
+func (dirtySlicePool) RentSlice(desiredLength uint32) []byte {
+	return bytes.Repeat([]byte{0xff}, int(desiredLength))
+}
+
+func (dirtySlicePool) ReturnSlice(slice []byte) {}
+
+func (dirtySlicePool) Prune() {}
+
+func (s *singleChunkReaderSuite) TestPadToLengthWithDirtyPool(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := newFaultyReaderAt(fileContent)
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 900, 100), 100,
+		nullChunkStatusLogger{}, nullLogger{}, dirtySlicePool{}, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{PadToLength: 512})
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+
+	result := &bytes.Buffer{}
+	_, err := io.Copy(result, reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(bytes.Equal(result.Bytes()[:100], fileContent[900:]), chk.Equals, true)
+	c.Assert(bytes.Equal(result.Bytes()[100:], make([]byte, 412)), chk.Equals, true) // the padding is zero, whatever the pool gave us
+}
+
+func (s *singleChunkReaderSuite) TestSizeCheckedReader(c *chk.C) {
+	factory := func() (CloseableReaderAt, error) { return newFaultyReaderAt(newTestFile(1000)), nil }
+	newReader := func(offset, length int64) (SingleChunkReader, error) {
+		return NewSizeCheckedSingleChunkReader(context.Background(), factory, NewChunkID("test", offset, length), length, 1000,
+			nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{})
+	}
+
+	// the last chunk, exactly up to the end of the file
+	reader, err := newReader(900, 100)
+	c.Assert(err, chk.IsNil)
+	c.Assert(reader.Length(), chk.Equals, int64(100))
+	reader.Close()
+
+	// off by one
+	_, err = newReader(900, 101)
+	c.Assert(err, chk.ErrorMatches, "chunk test, of 101 bytes at offset 900, does not fit in the file, which is 1000 bytes")
+	_, err = newReader(1000, 1)
+	c.Assert(err, chk.NotNil)
+}
+
+// eagainReaderAt fails its first few reads with EAGAIN, like a non-blocking special file that doesn't have data ready yet
+type eagainReaderAt struct {
+	*faultyReaderAt
+	failuresLeft int
+}
+
+func (r *eagainReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if r.failuresLeft > 0 {
+		r.failuresLeft--
+		return 0, &os.PathError{Op: "read", Path: "test", Err: syscall.EAGAIN}
+	}
+	return r.faultyReaderAt.ReadAt(p, off)
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchRetriesEAGAIN(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &eagainReaderAt{faultyReaderAt: newFaultyReaderAt(fileContent), failuresLeft: 3}
+
+	reader := newFaultyChunkReader(source.faultyReaderAt, 100, 200)
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	c.Assert(source.failuresLeft, chk.Equals, 0)
+
+	data := make([]byte, 200)
+	_, err := io.ReadFull(reader, data)
+	c.Assert(err, chk.IsNil)
+	c.Assert(bytes.Equal(data, fileContent[100:300]), chk.Equals, true)
+}
+
+func (s *singleChunkReaderSuite) TestStrictClose(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	newReader := func(strict bool) SingleChunkReader {
+		return NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 0, 100), 100,
+			nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{StrictClose: strict})
+	}
+	buffer := make([]byte, 10)
+
+	// by default, a closed reader goes back to the file before failing
+	lenient := newReader(false)
+	c.Assert(lenient.Close(), chk.IsNil)
+	_, err := lenient.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	_, err = lenient.Read(buffer)
+	c.Assert(err, chk.NotNil)
+	c.Assert(err, chk.Not(chk.Equals), ErrClosedReader)
+	c.Assert(source.count, chk.Equals, 1)
+
+	strict := newReader(true)
+	c.Assert(strict.BlockingPrefetch(source, false), chk.IsNil)
+	reads := source.count
+	c.Assert(strict.Close(), chk.IsNil)
+	_, err = strict.Read(buffer)
+	c.Assert(err, chk.Equals, ErrClosedReader)
+	_, err = strict.Seek(0, io.SeekStart)
+	c.Assert(err, chk.Equals, ErrClosedReader)
+	c.Assert(strict.BlockingPrefetch(source, false), chk.Equals, ErrClosedReader)
+	_, err = strict.ChunkMD5()
+	c.Assert(err, chk.Equals, ErrClosedReader)
+	c.Assert(source.count, chk.Equals, reads)
+}
+
+func (s *singleChunkReaderSuite) TestLengthProbeDoesNoIO(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	newChunkID := func() ChunkID { return NewChunkID("test", 100, 200) }
+	pool := NewMultiSizeSlicePool(1024)
+	limiter := NewCacheLimiter(1024 * 1024)
+
+	variants := map[string]func() SingleChunkReader{
+		"plain": func() SingleChunkReader {
+			return NewSingleChunkReader(context.Background(), factory, newChunkID(), 200, nullChunkStatusLogger{}, nullLogger{}, pool, limiter)
+		},
+		"padded": func() SingleChunkReader {
+			return NewSingleChunkReaderWithOptions(context.Background(), factory, newChunkID(), 200, nullChunkStatusLogger{}, nullLogger{}, pool, limiter,
+				SingleChunkReaderOptions{PadToLength: 256})
+		},
+		"concat": func() SingleChunkReader {
+			return NewConcatChunkReader(context.Background(), []byte("HEADER"), factory, newChunkID(), 200, nullChunkStatusLogger{}, nullLogger{}, pool, limiter)
+		},
+		"empty": func() SingleChunkReader {
+			return NewSingleChunkReader(context.Background(), factory, newChunkID(), 0, nullChunkStatusLogger{}, nullLogger{}, pool, limiter)
+		},
+		"sequential": func() SingleChunkReader {
+			_, reader, err := NewSequentialFileReader(source, "test", 1000, 200, pool).Next()
+			c.Assert(err, chk.IsNil)
+			return reader
+		},
+	}
+
+	for name, newReader := range variants {
+		comment := chk.Commentf("variant %s", name)
+		reader := newReader()
+		source.count = 0 // the sequential reader reads its chunk up front, but nothing else reads before prefetching
+
+		// before prefetching, the probe doesn't read anything
+		length, err := reader.Seek(0, io.SeekEnd)
+		c.Assert(err, chk.IsNil, comment)
+		c.Assert(length, chk.Equals, reader.Length(), comment)
+		_, err = reader.Seek(0, io.SeekStart)
+		c.Assert(err, chk.IsNil, comment)
+		c.Assert(source.count, chk.Equals, 0, comment)
+
+		// after prefetching, the probe keeps the buffer, so reading it all needs no more I/O
+		c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil, comment)
+		readsForPrefetch := source.count
+		_, _ = reader.Seek(0, io.SeekEnd)
+		_, _ = reader.Seek(0, io.SeekStart)
+		data, err := ioutil.ReadAll(reader)
+		c.Assert(err, chk.IsNil, comment)
+		c.Assert(int64(len(data)), chk.Equals, length, comment)
+		c.Assert(source.count, chk.Equals, readsForPrefetch, comment)
+
+		reader.Close()
+	}
+	c.Assert(limiter.WaitForZero(context.Background()), chk.IsNil)
+}
+
+func (s *singleChunkReaderSuite) TestTransform(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	xor := func(p []byte) {
+		for i := range p {
+			p[i] ^= 0x5a
+		}
+	}
+	expected := append([]byte(nil), fileContent[100:300]...)
+	xor(expected)
+
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 100, 200), 200,
+		nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{Transform: xor})
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+
+	// seeking back part way through reuses the buffer, which must not be transformed again
+	partial := make([]byte, 50)
+	_, err := io.ReadFull(reader, partial)
+	c.Assert(err, chk.IsNil)
+	c.Assert(partial, chk.DeepEquals, expected[:50])
+	_, err = reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	data, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, expected)
+
+	// a retry after the buffer has gone re-reads the file, and transforms the fresh data once
+	_, err = reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	data, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, expected)
+	c.Assert(source.count, chk.Equals, 2)
+
+	md5OfExpected := md5.Sum(expected)
+	reader.Seek(0, io.SeekStart)
+	chunkMD5, err := reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	c.Assert(chunkMD5, chk.DeepEquals, md5OfExpected[:])
+}
+
+func (s *singleChunkReaderSuite) TestNilSlicePool(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := newFaultyReaderAt(fileContent)
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	limiter := NewCacheLimiter(1024 * 1024)
+	reader := NewSingleChunkReader(context.Background(), factory, NewChunkID("test", 200, 500), 500,
+		nullChunkStatusLogger{}, nullLogger{}, nil, limiter)
+
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	data, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, fileContent[200:700])
+
+	// the buffer, freed at the end of the read, is allocated again for a retry
+	_, err = reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	data, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, fileContent[200:700])
+
+	// and the buffers are still accounted for, even though there's no pool to return them to
+	c.Assert(reader.Close(), chk.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(limiter.WaitForZero(ctx), chk.IsNil)
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchOverMaxRentSize(c *chk.C) {
+	source := newFaultyReaderAt(newTestFile(1000))
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	pool := NewMultiSizeSlicePoolWithOptions(1024, SlicePoolOptions{MaxRentSize: 256})
+	limiter := NewCacheLimiter(1024 * 1024)
+	countLimiter := semaphore.NewWeighted(1)
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 0, 500), 500,
+		nullChunkStatusLogger{}, nullLogger{}, pool, limiter, SingleChunkReaderOptions{ChunkCountLimiter: countLimiter})
+	defer reader.Close()
+
+	// the chunk is too big for the pool, so the prefetch fails, without panicking, whatever debugCheckRentedSlices says
+	c.Assert(debugCheckRentedSlices, chk.Equals, false)
+	c.Assert(reader.BlockingPrefetch(source, false), chk.ErrorMatches, "cannot rent a slice of 500 bytes.*")
+
+	// and gives back what it reserved
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(limiter.WaitForZero(ctx), chk.IsNil)
+	c.Assert(countLimiter.TryAcquire(1), chk.Equals, true)
+}
+
+func (s *singleChunkReaderSuite) TestChunkMD5(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := newFaultyReaderAt(fileContent)
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	reader := NewSingleChunkReader(context.Background(), factory, NewChunkID("test", 100, 300), 300,
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024), NewCacheLimiter(1024*1024))
+	defer reader.Close()
+	expected := md5.Sum(fileContent[100:400])
+
+	// it prefetches, if need be
+	chunkMD5, err := reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	c.Assert(chunkMD5, chk.DeepEquals, expected[:])
+
+	// it's of the whole chunk, wherever the reader is
+	_, err = io.ReadFull(reader, make([]byte, 50))
+	c.Assert(err, chk.IsNil)
+	chunkMD5, err = reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	c.Assert(chunkMD5, chk.DeepEquals, expected[:])
+
+	// and it's cached, so it doesn't need the data again, once the buffer has gone
+	_, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	source.errorsAtOffsets[100] = errors.New("disk error")
+	chunkMD5, err = reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	c.Assert(chunkMD5, chk.DeepEquals, expected[:])
+
+	// an empty chunk has the MD5 of nothing
+	empty := NewSingleChunkReader(context.Background(), factory, NewChunkID("test", 1000, 0), 0,
+		nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024))
+	emptyMD5 := md5.Sum(nil)
+	chunkMD5, err = empty.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	c.Assert(chunkMD5, chk.DeepEquals, emptyMD5[:])
+}
+
+func (s *singleChunkReaderSuite) TestExpectedMD5(c *chk.C) {
+	fileContent := newTestFile(1000)
+	factory := func() (CloseableReaderAt, error) { return newFaultyReaderAt(fileContent), nil }
+	limiter := NewCacheLimiter(1024 * 1024)
+	newReader := func(expectedMD5 []byte) SingleChunkReader {
+		return NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 100, 200), 200,
+			nullChunkStatusLogger{}, nullLogger{}, nil, limiter, SingleChunkReaderOptions{ExpectedMD5: expectedMD5})
+	}
+	expected := md5.Sum(fileContent[100:300])
+
+	// unchanged, so it reads as usual
+	reader := newReader(expected[:])
+	data, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, fileContent[100:300])
+	reader.Close()
+
+	// the source has changed since the MD5 was taken
+	fileContent[150] ^= 0xff
+	reader = newReader(expected[:])
+	_, err = reader.Read(make([]byte, 10))
+	c.Assert(err, chk.ErrorMatches, "chunk test has changed: its MD5 is .*, but .* was expected")
+	_, err = reader.ChunkMD5()
+	c.Assert(err, chk.NotNil)
+	reader.Close()
+
+	// the failed prefetches gave back their RAM
+	c.Assert(limiter.WaitForZero(context.Background()), chk.IsNil)
+}
+
+func (s *singleChunkReaderSuite) TestReadVectored(c *chk.C) {
+	fileContent := newTestFile(1000)
+	reader, source := newTestChunkReader(fileContent, 100, 200)
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+
+	// fills each buffer in turn, from the current position
+	first := make([]byte, 20)
+	_, err := reader.Read(first)
+	c.Assert(err, chk.IsNil)
+	bufs := [][]byte{make([]byte, 30), make([]byte, 0), make([]byte, 50)}
+	n, err := reader.ReadVectored(bufs)
+	c.Assert(err, chk.IsNil)
+	c.Assert(n, chk.Equals, 80)
+	c.Assert(bufs[0], chk.DeepEquals, fileContent[120:150])
+	c.Assert(bufs[2], chk.DeepEquals, fileContent[150:200])
+
+	// stops at the end of the chunk
+	bufs = [][]byte{make([]byte, 50), make([]byte, 500), make([]byte, 10)}
+	n, err = reader.ReadVectored(bufs)
+	c.Assert(err, chk.Equals, io.EOF)
+	c.Assert(n, chk.Equals, 100)
+	c.Assert(bufs[0], chk.DeepEquals, fileContent[200:250])
+	c.Assert(bufs[1][:50], chk.DeepEquals, fileContent[250:300])
+
+	n, err = reader.ReadVectored(bufs)
+	c.Assert(err, chk.Equals, io.EOF)
+	c.Assert(n, chk.Equals, 0)
+	c.Assert(source.count, chk.Equals, 1)
+}
+
+// gatedReaderAt blocks each read until a value is sent on gate
+type gatedReaderAt struct {
+	inner io.ReaderAt
+	gate  chan struct{}
+}
+
+func (r *gatedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	<-r.gate
+	return r.inner.ReadAt(p, off)
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchAsync(c *chk.C) {
+	fileContent := newTestFile(1000)
+	reader, source := newTestChunkReader(fileContent, 100, 200)
+	defer reader.Close()
+	gated := &gatedReaderAt{inner: source, gate: make(chan struct{})}
+
+	done := reader.PrefetchAsync(gated, false)
+
+	// a Read made before the prefetch completes waits for it, rather than going to the file itself
+	readResult := make(chan []byte)
+	go func() {
+		p := make([]byte, 200)
+		n, _ := reader.Read(p)
+		readResult <- p[:n]
+	}()
+	select {
+	case <-done:
+		c.Fatal("prefetch finished before its read was allowed")
+	case <-readResult:
+		c.Fatal("read finished before the prefetch")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	gated.gate <- struct{}{}
+	c.Assert(<-done, chk.IsNil)
+	c.Assert(<-readResult, chk.DeepEquals, fileContent[100:300])
+	c.Assert(source.count, chk.Equals, 1)
+
+	// errors come through the channel
+	faultySource := newFaultyReaderAt(fileContent)
+	faultySource.errorsAtOffsets[500] = errors.New("disk error")
+	faultyReader := newFaultyChunkReader(faultySource, 400, 200)
+	defer faultyReader.Close()
+	c.Assert(<-faultyReader.PrefetchAsync(faultySource, false), chk.ErrorMatches, "disk error")
+}
+
+func (s *singleChunkReaderSuite) TestReadRateLimiter(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &countingReaderAt{inner: bytes.NewReader(fileContent)}
+	factory := func() (CloseableReaderAt, error) { return &closeableCountingReaderAt{*source}, nil }
+	limiter := NewRateLimiter(10000, 500)
+
+	// two readers share one budget: the first read is within the burst, and the second must wait for 500 more bytes
+	start := time.Now()
+	for _, offset := range []int64{0, 500} {
+		reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", offset, 500), 500,
+			nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{ReadRateLimiter: limiter})
+		c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+		reader.Close()
+	}
+	c.Assert(time.Since(start) >= 45*time.Millisecond, chk.Equals, true)
+
+	// and a cancelled wait fails the prefetch
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reader := NewSingleChunkReaderWithOptions(ctx, factory, NewChunkID("test", 0, 1000), 1000,
+		nullChunkStatusLogger{}, nullLogger{}, nil, NewCacheLimiter(1024*1024), SingleChunkReaderOptions{ReadRateLimiter: limiter})
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.NotNil)
+	c.Assert(source.count, chk.Equals, 2)
+}
+
+func (s *singleChunkReaderSuite) TestReset(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	limiter := NewCacheLimiterWithOptions(1024*1024, CacheLimiterOptions{UnderflowGuard: EUnderflowGuard.Panic()})
+	reader := NewSingleChunkReader(context.Background(), factory, NewChunkID("test", 0, 300), 300,
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024), limiter).(ResettableChunkReader)
+
+	// reset part way through a chunk, with its buffer still held
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	_, err := reader.Read(make([]byte, 10))
+	c.Assert(err, chk.IsNil)
+	c.Assert(reader.Reset(factory, NewChunkID("test", 300, 500), 500), chk.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Assert(limiter.WaitForZero(ctx), chk.IsNil) // the old buffer was released, exactly once
+
+	c.Assert(reader.Length(), chk.Equals, int64(500))
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	data, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, fileContent[300:800])
+	_, err = reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+
+	// a closed reader can be reused too
+	c.Assert(reader.Close(), chk.IsNil)
+	c.Assert(reader.Reset(factory, NewChunkID("test", 800, 200), 200), chk.IsNil)
+	data, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, fileContent[800:])
+	chunkMD5, err := reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	expectedMD5 := md5.Sum(fileContent[800:])
+	c.Assert(chunkMD5, chk.DeepEquals, expectedMD5[:]) // not the cached MD5 of an earlier chunk
+	c.Assert(reader.Close(), chk.IsNil)
+
+	c.Assert(reader.Reset(factory, NewChunkID("test", 0, 0), 0), chk.NotNil)
+}
+
+// peakCacheLimiter records the most that has been added to a CacheLimiter at once
+type peakCacheLimiter struct {
+	CacheLimiter
+	current int64
+	peak    int64
+}
+
+func (l *peakCacheLimiter) added(count int64) {
+	current := atomic.AddInt64(&l.current, count)
+	for {
+		peak := atomic.LoadInt64(&l.peak)
+		if current <= peak || atomic.CompareAndSwapInt64(&l.peak, peak, current) {
+			return
+		}
+	}
+}
+
+func (l *peakCacheLimiter) TryAdd(count int64, useRelaxedLimit bool) bool {
+	added := l.CacheLimiter.TryAdd(count, useRelaxedLimit)
+	if added {
+		l.added(count)
+	}
+	return added
+}
+
+func (l *peakCacheLimiter) WaitUntilAdd(ctx context.Context, count int64, useRelaxedLimit Predicate) error {
+	err := l.CacheLimiter.WaitUntilAdd(ctx, count, useRelaxedLimit)
+	if err == nil {
+		l.added(count)
+	}
+	return err
+}
+
+func (l *peakCacheLimiter) Remove(count int64) {
+	atomic.AddInt64(&l.current, -count)
+	l.CacheLimiter.Remove(count)
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchWindow(c *chk.C) {
+	const window = 1000
+	fileContent := newTestFile(10000)
+	expected := fileContent[500:8500]
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	pool := NewMultiSizeSlicePool(1024 * 1024)
+	limiter := &peakCacheLimiter{CacheLimiter: NewCacheLimiter(1024 * 1024)}
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 500, 8000), 8000,
+		nullChunkStatusLogger{}, nullLogger{}, pool, limiter, SingleChunkReaderOptions{PrefetchWindowSize: window})
+	defer reader.Close()
+
+	// the prefetch reads only the first window, and starts reading the second in the background
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	c.Assert(atomic.LoadInt64(&limiter.current), chk.Equals, int64(2*window))
+	c.Assert(reader.GetPrologueState().LeadingBytes, chk.DeepEquals, expected[:512])
+
+	// read the whole chunk in small reads, as a sender would
+	data := make([]byte, 0)
+	buf := make([]byte, 100)
+	for {
+		n, err := reader.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, chk.IsNil)
+	}
+	c.Assert(data, chk.DeepEquals, expected)
+
+	// no buffer was bigger than the window, and there were never more than two in RAM
+	c.Assert(pool.LargestRentSize(), chk.Equals, uint32(window))
+	c.Assert(atomic.LoadInt64(&limiter.peak) <= 2*window, chk.Equals, true)
+	c.Assert(atomic.LoadInt64(&limiter.current), chk.Equals, int64(0))
+
+	// the MD5 is of the whole chunk, and was worked out as it was read
+	reads := source.count
+	chunkMD5, err := reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	expectedMD5 := md5.Sum(expected)
+	c.Assert(chunkMD5, chk.DeepEquals, expectedMD5[:])
+	c.Assert(source.count, chk.Equals, reads)
+
+	// a retry seeks back, and reads it all again
+	_, err = reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	data, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(data, chk.DeepEquals, expected)
+	c.Assert(atomic.LoadInt64(&limiter.current), chk.Equals, int64(0))
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchWindowOutOfOrder(c *chk.C) {
+	fileContent := newTestFile(5000)
+	opened := 0 // the reader may use its handle from two goroutines at once, so count the handles, not the reads
+	factory := func() (CloseableReaderAt, error) {
+		opened++
+		return newFaultyReaderAt(fileContent), nil
+	}
+	limiter := NewCacheLimiterWithOptions(1024*1024, CacheLimiterOptions{UnderflowGuard: EUnderflowGuard.Panic()})
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 0, 5000), 5000,
+		nullChunkStatusLogger{}, nullLogger{}, nil, limiter, SingleChunkReaderOptions{PrefetchWindowSize: 1024})
+
+	// probing the length does no I/O
+	length, err := reader.Seek(0, io.SeekEnd)
+	c.Assert(err, chk.IsNil)
+	c.Assert(length, chk.Equals, int64(5000))
+	c.Assert(opened, chk.Equals, 0)
+
+	// reads after a seek start from the new position
+	_, err = reader.Seek(3000, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(reader, buf)
+	c.Assert(err, chk.IsNil)
+	c.Assert(buf, chk.DeepEquals, fileContent[3000:3010])
+
+	// the MD5 covers the whole chunk, even though we haven't read it all
+	chunkMD5, err := reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	expectedMD5 := md5.Sum(fileContent)
+	c.Assert(chunkMD5, chk.DeepEquals, expectedMD5[:])
+
+	// closing part way through releases everything
+	c.Assert(reader.Close(), chk.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Assert(limiter.WaitForZero(ctx), chk.IsNil)
+
+	// options that need the whole chunk turn windowing off
+	reader = NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 0, 5000), 5000,
+		nullChunkStatusLogger{}, nullLogger{}, nil, limiter, SingleChunkReaderOptions{PrefetchWindowSize: 1024, Transform: func(p []byte) {}})
+	_, isWindowed := reader.(*windowedChunkReader)
+	c.Assert(isWindowed, chk.Equals, false)
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchWindowReadFailure(c *chk.C) {
+	fileContent := newTestFile(5000)
+	source := newFaultyReaderAt(fileContent)
+	source.errorsAtOffsets[2500] = errors.New("transient failure")
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	limiter := NewCacheLimiter(1024 * 1024)
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 0, 5000), 5000,
+		nullChunkStatusLogger{}, nullLogger{}, nil, limiter, SingleChunkReaderOptions{PrefetchWindowSize: 1024})
+	defer reader.Close()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+
+	// the third window fails
+	buf := make([]byte, 2048)
+	_, err := io.ReadFull(reader, buf)
+	c.Assert(err, chk.IsNil)
+	_, err = reader.Read(buf)
+	c.Assert(err, chk.ErrorMatches, "transient failure")
+
+	// reading again, without a seek, carries on from the same place
+	// (the failed read stopped everything in the background, so it's safe to change the source)
+	delete(source.errorsAtOffsets, 2500)
+	rest, err := ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(rest, chk.DeepEquals, fileContent[2048:])
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Assert(limiter.WaitForZero(ctx), chk.IsNil)
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchWindowCloseInterruptsRead(c *chk.C) {
+	fileContent := newTestFile(5000)
+	factory := func() (CloseableReaderAt, error) { return newFaultyReaderAt(fileContent), nil }
+	limiter := NewCacheLimiter(2048)
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 0, 5000), 5000,
+		nullChunkStatusLogger{}, nullLogger{}, nil, limiter, SingleChunkReaderOptions{PrefetchWindowSize: 1024, StrictClose: true})
+	source, _ := factory()
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+
+	// once the head has been read, use up the RAM, so that the next window can't be
+	_, err := io.ReadFull(reader, make([]byte, 1024))
+	c.Assert(err, chk.IsNil)
+	c.Assert(limiter.TryAdd(2048, true), chk.Equals, true)
+	readResult := make(chan error, 1)
+	go func() {
+		_, err := reader.Read(make([]byte, 10))
+		readResult <- err
+	}()
+	time.Sleep(100 * time.Millisecond) // let the Read get stuck
+
+	// Close doesn't wait for the Read, but stops it
+	closed := make(chan error, 1)
+	go func() { closed <- reader.Close() }()
+	select {
+	case err = <-closed:
+		c.Assert(err, chk.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Close waited for a Read that was stuck")
+	}
+	select {
+	case err = <-readResult:
+		c.Assert(err, chk.ErrorMatches, "closed while reading")
+	case <-time.After(5 * time.Second):
+		c.Fatal("Close didn't interrupt the Read")
+	}
+
+	// and everything the reader had is released
+	limiter.Remove(2048)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Assert(limiter.WaitForZero(ctx), chk.IsNil)
+}
+
+func (s *singleChunkReaderSuite) TestPrefetchBuffersArePooled(c *chk.C) {
+	const chunkSize = 1000
+	fileContent := newTestFile(100 * chunkSize)
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	pool := NewMultiSizeSlicePool(1024)
+	limiter := NewCacheLimiter(1024 * 1024)
+
+	// read every chunk in the file, a few at a time, as the transfer engine would
+	const inFlight = 4
+	for offset := int64(0); offset < int64(len(fileContent)); offset += inFlight * chunkSize {
+		readers := make([]SingleChunkReader, 0, inFlight)
+		for i := int64(0); i < inFlight; i++ {
+			chunkOffset := offset + i*chunkSize
+			reader := NewSingleChunkReader(context.Background(), factory, NewChunkID("test", chunkOffset, chunkSize), chunkSize,
+				nullChunkStatusLogger{}, nullLogger{}, pool, limiter)
+			c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+			readers = append(readers, reader)
+		}
+		for i, reader := range readers {
+			data, err := ioutil.ReadAll(reader)
+			c.Assert(err, chk.IsNil)
+			chunkOffset := offset + int64(i)*chunkSize
+			c.Assert(data, chk.DeepEquals, fileContent[chunkOffset:chunkOffset+chunkSize])
+			c.Assert(reader.Close(), chk.IsNil)
+		}
+	}
+
+	// only the first batch had to allocate. After that, every buffer came back out of the pool
+	total := TotalSlicePoolStats(pool.PoolStats())
+	c.Assert(total.Misses, chk.Equals, int64(inFlight))
+	c.Assert(total.Hits, chk.Equals, int64(100-inFlight))
+	c.Assert(total.Drops, chk.Equals, int64(0))
+}
+
+func (s *singleChunkReaderSuite) TestHashOnPrefetch(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 100, 600), 600,
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024), NewCacheLimiter(1024*1024), SingleChunkReaderOptions{HashOnPrefetch: true})
+	defer reader.Close()
+	expectedMD5 := md5.Sum(fileContent[100:700])
+
+	// the hash is worked out by the prefetch
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	c.Assert(reader.(*singleChunkReader).md5, chk.DeepEquals, expectedMD5[:])
+
+	chunkMD5, err := reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	c.Assert(chunkMD5, chk.DeepEquals, expectedMD5[:])
+
+	// a retry reads the chunk again, but doesn't hash it again, and the hash is the same
+	_, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	_, err = reader.Seek(0, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	reader.(*singleChunkReader).md5[0] ^= 0xFF // would be overwritten if the retry's prefetch hashed again
+	_, err = ioutil.ReadAll(reader)
+	c.Assert(err, chk.IsNil)
+	c.Assert(source.count, chk.Equals, 2)
+	reader.(*singleChunkReader).md5[0] ^= 0xFF
+	chunkMD5, err = reader.ChunkMD5()
+	c.Assert(err, chk.IsNil)
+	c.Assert(chunkMD5, chk.DeepEquals, expectedMD5[:])
+
+	// without the option, the prefetch leaves it until it's asked for
+	reader = NewSingleChunkReader(context.Background(), factory, NewChunkID("test", 100, 600), 600,
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024), NewCacheLimiter(1024*1024))
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	c.Assert(reader.(*singleChunkReader).md5, chk.IsNil)
+	c.Assert(reader.Close(), chk.IsNil)
+}
+
+func (s *singleChunkReaderSuite) TestKeepBufferForRetry(c *chk.C) {
+	fileContent := newTestFile(1000)
+	source := &closeableCountingReaderAt{countingReaderAt{inner: bytes.NewReader(fileContent)}}
+	factory := func() (CloseableReaderAt, error) { return source, nil }
+	limiter := &peakCacheLimiter{CacheLimiter: NewCacheLimiterWithOptions(1024*1024, CacheLimiterOptions{UnderflowGuard: EUnderflowGuard.Panic()})}
+	reader := NewSingleChunkReaderWithOptions(context.Background(), factory, NewChunkID("test", 200, 500), 500,
+		nullChunkStatusLogger{}, nullLogger{}, NewMultiSizeSlicePool(1024), limiter, SingleChunkReaderOptions{KeepBufferForRetry: true})
+
+	c.Assert(reader.BlockingPrefetch(source, false), chk.IsNil)
+	for attempt := 0; attempt < 3; attempt++ {
+		_, err := reader.Seek(0, io.SeekStart)
+		c.Assert(err, chk.IsNil)
+		data, err := ioutil.ReadAll(reader)
+		c.Assert(err, chk.IsNil)
+		c.Assert(data, chk.DeepEquals, fileContent[200:700])
+	}
+
+	// every attempt was served from the prefetch, which is still counted until Close
+	c.Assert(source.count, chk.Equals, 1)
+	c.Assert(limiter.current, chk.Equals, int64(500))
+
+	// Close releases it, just once (the limiter panics if it's removed twice)
+	c.Assert(reader.Close(), chk.IsNil)
+	c.Assert(reader.Close(), chk.IsNil)
+	c.Assert(limiter.current, chk.Equals, int64(0))
+}